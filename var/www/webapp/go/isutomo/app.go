@@ -2,119 +2,155 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
-	"strings"
-
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/config"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/graceful"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/health"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/openapi"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 )
 
 type Friend struct {
-	ID      int64  `db:"id"`
-	Me      string `db:"me"`
-	Friends string `db:"friends"`
+	ID      int64    `db:"id"`
+	Me      string   `db:"me"`
+	Friends []string `db:"friends"`
 }
 
 type DB struct {
-	Host string
-	Port string
-	User string
-	Pass string
-	Name string
+	DBConfig
 	Conn *sql.DB
 }
 
-var conn *DB
+var (
+	conn *DB
+	cfg  = defaultConfig()
 
-func (db *DB) initEnvs() error {
+	// readiness holds the checks of /readyz; main adds the server check.
+	readiness       = newReadiness()
+	errShuttingDown = errors.New("shutting down")
+)
 
-	db.Host = os.Getenv("ISUTOMO_DB_HOST")
-	db.Port = os.Getenv("ISUTOMO_DB_PORT")
-	db.User = os.Getenv("ISUTOMO_DB_USER")
-	db.Pass = os.Getenv("ISUTOMO_DB_PASSWORD")
-	db.Name = os.Getenv("ISUTOMO_DB_NAME")
+func newReadiness() *health.Checker {
+	c := health.New(2 * time.Second)
+	c.Add("mysql", func(ctx context.Context) error {
+		if conn == nil || conn.Conn == nil {
+			return errors.New("not connected")
+		}
+		return conn.Conn.PingContext(ctx)
+	})
+	return c
+}
 
-	if len(db.Host) == 0 {
-		db.Host = "localhost"
-	}
+func (db *DB) dsn() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true", db.User, db.Password, db.Host, db.Port, db.Name)
+}
 
-	if len(db.Port) == 0 {
-		db.Port = "3306"
-	}
+func (db *DB) connect() error {
+	var err error
+	db.Conn, err = tracing.OpenDB("mysql", db.dsn())
+	return err
+}
 
-	if len(db.User) == 0 {
-		db.User = "root"
-	}
+// fetchFriend returns the friends of user. A user without a friends row has
+// no friends yet; its ID is 0.
+func (db *DB) fetchFriend(ctx context.Context, user string) (*Friend, error) {
 
-	if len(db.Name) == 0 {
-		db.Name = "isuwitter"
-	}
+	friend := &Friend{Me: user}
 
-	return nil
-}
+	err := db.Conn.QueryRowContext(ctx, "SELECT id, me FROM friends WHERE me = ?", user).Scan(&friend.ID, &friend.Me)
 
-func (db *DB) dsn() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true", db.User, db.Pass, db.Host, db.Port, db.Name)
-}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
 
-func (db *DB) connect() error {
-	err := db.initEnvs()
+	rows, err := db.Conn.QueryContext(ctx, "SELECT friend FROM friendships WHERE me = ? ORDER BY created_at, friend", user)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	db.Conn, err = sql.Open("mysql", db.dsn())
+	defer rows.Close()
 
-	if err != nil {
-		return err
+	friend.Friends = []string{}
+	for rows.Next() {
+		var f string
+		if err := rows.Scan(&f); err != nil {
+			return nil, err
+		}
+		friend.Friends = append(friend.Friends, f)
 	}
 
-	return nil
+	return friend, rows.Err()
 }
 
-func (db *DB) fetchFriend(user string) (*Friend, error) {
+// ensureUser creates the friends row of user unless it exists, and reports
+// whether it did.
+func (db *DB) ensureUser(ctx context.Context, user string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "INSERT IGNORE INTO friends (me, friends) VALUES (?, '')", user)
 
-	friend := new(Friend)
+	if err != nil {
+		return false, err
+	}
 
-	stmt, err := db.Conn.Prepare("SELECT * FROM friends WHERE me = ?")
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// addFriendship makes me follow friend. It reports false when me already
+// follows friend. A single INSERT IGNORE keeps concurrent follows from losing
+// each other's update.
+func (db *DB) addFriendship(ctx context.Context, me, friend string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "INSERT IGNORE INTO friendships (me, friend, created_at) VALUES (?, ?, NOW(6))", me, friend)
 
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	err = stmt.QueryRow(user).Scan(&friend.ID, &friend.Me, &friend.Friends)
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// removeFriendship makes me unfollow friend. It reports false when me did not
+// follow friend.
+func (db *DB) removeFriendship(ctx context.Context, me, friend string) (bool, error) {
+	res, err := db.Conn.ExecContext(ctx, "DELETE FROM friendships WHERE me = ? AND friend = ?", me, friend)
 
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return friend, nil
-}
+	n, err := res.RowsAffected()
 
-func (db *DB) updateFriend(user, friends string) error {
-	_, err := db.Conn.Exec("UPDATE friends SET friends = ? WHERE me = ?", friends, user)
-	return err
+	return n > 0, err
 }
 
 func (friend *Friend) getFriends() []string {
-	return strings.Split(friend.Friends, ",")
+	return friend.Friends
 }
 
 func getUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	me := mux.Vars(r)["me"]
+	me := userVar(r, "me")
 
-	friend, err := conn.fetchFriend(me)
+	friend, err := conn.fetchFriend(r.Context(), me)
 	if err != nil {
-		errorResponseWriter(w, http.StatusBadRequest, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
@@ -125,7 +161,7 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		errorResponseWriter(w, http.StatusInternalServerError, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
@@ -136,139 +172,139 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func postUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	me := mux.Vars(r)["me"]
-
-	friend, err := conn.fetchFriend(me)
-	if err != nil {
-		errorResponseWriter(w, http.StatusBadRequest, err)
-		return
-	}
+	me := userVar(r, "me")
 
 	data := struct {
 		User string `json:"user"`
 	}{}
 
-	err = JSONUnmarshaler(r.Body, &data)
+	err := JSONUnmarshaler(r.Body, &data)
 
 	if err != nil {
-		errorResponseWriter(w, http.StatusBadRequest, err)
+		errorResponseWriter(w, codeInvalidBody, "invalid request body: "+err.Error())
 		return
 	}
 
-	for _, val := range friend.getFriends() {
-		if strings.EqualFold(val, data.User) {
+	data.User = username.Canonical(data.User)
 
-			errJSON, err := json.Marshal(struct {
-				Error string `json:"error"`
-			}{
-				Error: data.User + " is already your friend.",
-			})
+	if data.User == "" {
+		errorResponseWriter(w, codeInvalidBody, "user is required")
+		return
+	}
+	if username.Reserved(data.User) {
+		errorResponseWriter(w, codeInvalidBody, data.User+" is a reserved name")
+		return
+	}
 
-			if err != nil {
-				errorResponseWriter(w, http.StatusInternalServerError, err)
-				return
-			}
+	_, err = conn.ensureUser(r.Context(), me)
 
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(errJSON)
-			return
-		}
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
 	}
 
-	conn.updateFriend(me, friend.Friends+","+data.User)
-
-	friendJSON, err := json.Marshal(struct {
-		Friends []string `json:"friends"`
-	}{
-		Friends: append(friend.getFriends(), data.User),
-	})
+	added, err := conn.addFriendship(r.Context(), me, data.User)
 
 	if err != nil {
-		errorResponseWriter(w, http.StatusInternalServerError, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(friendJSON)
+	if !added {
+		errorResponseWriter(w, codeAlreadyFollowing, data.User+" is already your friend.")
+		return
+	}
+
+	friendsResponseWriter(w, r, http.StatusOK, me)
 }
 
 func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	me := mux.Vars(r)["me"]
+	me := userVar(r, "me")
+
+	data := struct {
+		User string `json:"user"`
+	}{}
+
+	err := JSONUnmarshaler(r.Body, &data)
 
-	friend, err := conn.fetchFriend(me)
 	if err != nil {
-		errorResponseWriter(w, http.StatusBadRequest, err)
+		errorResponseWriter(w, codeInvalidBody, "invalid request body: "+err.Error())
 		return
 	}
 
-	friends := friend.getFriends()
+	data.User = username.Canonical(data.User)
 
-	data := struct {
-		User string `json:"user"`
-	}{}
+	if data.User == "" {
+		errorResponseWriter(w, codeInvalidBody, "user is required")
+		return
+	}
 
-	err = JSONUnmarshaler(r.Body, &data)
+	removed, err := conn.removeFriendship(r.Context(), me, data.User)
 
 	if err != nil {
-		errorResponseWriter(w, http.StatusBadRequest, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
-	for _, val := range friends {
-		if strings.EqualFold(val, data.User) {
+	if !removed {
+		errorResponseWriter(w, codeNotFollowing, data.User+" is not your friend.")
+		return
+	}
 
-			friends = remove(friends, data.User)
+	friendsResponseWriter(w, r, http.StatusOK, me)
+}
 
-			conn.updateFriend(me, strings.Join(friends, ","))
+// putUserHandler provisions the isutomo record of me. It responds 201 when
+// the record was created and 200 when it already existed.
+func putUserHandler(w http.ResponseWriter, r *http.Request) {
 
-			friendJSON, err := json.Marshal(struct {
-				Friends []string `json:"friends"`
-			}{
-				Friends: friends,
-			})
+	me := userVar(r, "me")
 
-			if err != nil {
-				errorResponseWriter(w, http.StatusInternalServerError, err)
-				return
-			}
+	created, err := conn.ensureUser(r.Context(), me)
 
-			w.WriteHeader(http.StatusOK)
-			w.Write(friendJSON)
-			return
-		}
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
 	}
 
-	errJSON, err := json.Marshal(struct {
-		Error string `json:"error"`
-	}{
-		Error: data.User + " is not your friend.",
-	})
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	friendsResponseWriter(w, r, status, me)
+}
+
+// userVar returns the canonical form of the user name in the path variable
+// key.
+func userVar(r *http.Request, key string) string {
+	return username.Canonical(mux.Vars(r)[key])
+}
+
+// friendsResponseWriter writes the current friend list of me.
+func friendsResponseWriter(w http.ResponseWriter, r *http.Request, status int, me string) {
+
+	friend, err := conn.fetchFriend(r.Context(), me)
 
 	if err != nil {
-		errorResponseWriter(w, http.StatusInternalServerError, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write(errJSON)
-	return
-
-}
+	friendJSON, err := json.Marshal(struct {
+		Friends []string `json:"friends"`
+	}{
+		Friends: friend.getFriends(),
+	})
 
-func remove(array []string, tval string) []string {
-	result := []string{}
-	for _, v := range array {
-		if v != tval {
-			result = append(result, v)
-		}
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
 	}
-	return result
-}
 
-func errorResponseWriter(w http.ResponseWriter, status int, err error) {
 	w.WriteHeader(status)
-	w.Write([]byte(err.Error()))
+	w.Write(friendJSON)
 }
 
 func JSONUnmarshaler(body io.Reader, i interface{}) error {
@@ -288,25 +324,43 @@ func JSONUnmarshaler(body io.Reader, i interface{}) error {
 	return nil
 }
 func initializeHandler(w http.ResponseWriter, r *http.Request) {
-	path, err := exec.LookPath("mysql")
+	start := time.Now()
+
+	seeded, err := conn.seed(seedFilePath())
 	if err != nil {
-		errorResponseWriter(w, http.StatusInternalServerError, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
-	err = exec.Command(path, "-u", "root", "-D", "isuwitter", "-e", "source ../../sql/seed_isutomo.sql").Run()
+	migrateStart := time.Now()
+
+	if err := conn.resetFriendships(); err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+	count, err := conn.migrateFriendships()
 	if err != nil {
-		errorResponseWriter(w, http.StatusInternalServerError, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
+	migrated := SeedStep{
+		Step:         "migrate",
+		RowsAffected: int64(count),
+		Elapsed:      time.Since(migrateStart).Seconds(),
+	}
+
 	resultJSON, err := json.Marshal(struct {
-		Result []string `json:"result"`
+		Result   []string   `json:"result"`
+		Progress []SeedStep `json:"progress"`
+		Elapsed  float64    `json:"elapsed"`
 	}{
-		Result: []string{"ok"},
+		Result:   []string{"ok"},
+		Progress: []SeedStep{seeded, migrated},
+		Elapsed:  time.Since(start).Seconds(),
 	})
 	if err != nil {
-		errorResponseWriter(w, http.StatusInternalServerError, err)
+		internalErrorResponseWriter(w, r, err)
 		return
 	}
 
@@ -318,24 +372,138 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 func NewRouter() *mux.Router {
 
 	router := mux.NewRouter().StrictSlash(true)
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 
 	router.Methods(http.MethodGet).Path("/initialize").HandlerFunc(initializeHandler)
-	router.Methods(http.MethodGet).Path("/{me}").HandlerFunc(getUserHandler)
-	router.Methods(http.MethodPost).Path("/{me}").HandlerFunc(postUserHandler)
-	router.Methods(http.MethodDelete).Path("/{me}").HandlerFunc(deleteUserHandler)
+	// the endpoints that are not about one user, under a prefix no user
+	// name can take
+	router.Methods(http.MethodGet).Path(reservedPath("openapi.json")).HandlerFunc(openapi.Handler)
+	router.Methods(http.MethodGet).Path(reservedPath("healthz")).HandlerFunc(health.LiveHandler)
+	router.Methods(http.MethodGet).Path(reservedPath("readyz")).HandlerFunc(readiness.ReadyHandler)
+	router.Methods(http.MethodPost).Path(reservedPath("lookup")).HandlerFunc(postLookupHandler)
+	router.Methods(http.MethodPost).Path(reservedPath("batch")).HandlerFunc(postBatchHandler)
+	router.Methods(http.MethodGet).Path("/{me}/followers").HandlerFunc(rejectReservedNames(getFollowersHandler))
+	router.Methods(http.MethodGet).Path("/{me}/following/{user}").HandlerFunc(rejectReservedNames(getFollowingHandler))
+	router.Methods(http.MethodGet).Path("/{me}/mutual/{user}").HandlerFunc(rejectReservedNames(getMutualHandler))
+	for _, key := range []string{"count", "limit", "cursor"} {
+		router.Methods(http.MethodGet).Path("/{me}").Queries(key, "").HandlerFunc(rejectReservedNames(getUserPageHandler))
+	}
+	router.Methods(http.MethodGet).Path("/{me}").HandlerFunc(rejectReservedNames(getUserHandler))
+	router.Methods(http.MethodPost).Path("/{me}").HandlerFunc(rejectReservedNames(postUserHandler))
+	router.Methods(http.MethodPut).Path("/{me}").HandlerFunc(rejectReservedNames(putUserHandler))
+	router.Methods(http.MethodDelete).Path("/{me}").HandlerFunc(rejectReservedNames(deleteUserHandler))
 
 	return router
 }
 
+func reservedPath(name string) string {
+	return "/" + username.Prefix + "/" + name
+}
+
+// rejectReservedNames wraps the handler of a /{me} route, refusing the user
+// names username.Reserved keeps for the endpoints.
+func rejectReservedNames(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{"me", "user"} {
+			if name, ok := mux.Vars(r)[key]; ok && username.Reserved(name) {
+				errorResponseWriter(w, codeInvalidParameter, name+" is a reserved name")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// traced starts a span for every request, continuing the trace of isuwitter,
+// and names it after the route template router matches.
+func traced(router *mux.Router) http.Handler {
+	return tracing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if router.Match(r, &match) {
+			if route, err := match.Route.GetPathTemplate(); err == nil {
+				tracing.SetRoute(r.Context(), r.Method, route)
+			}
+		}
+		router.ServeHTTP(w, r)
+	}), "isutomo")
+}
+
 func main() {
 
-	conn = new(DB)
+	loader := config.New(flag.CommandLine, &cfg, "ISUTOMO_CONFIG")
+	migrate := flag.Bool("migrate", false, "build the friendships table from the friends column and exit")
+	migrateUsernames := flag.Bool("migrate-usernames", false, "rewrite user names to their canonical form and exit")
+	flag.Parse()
+
+	if err := loader.Load(); err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	err := cfg.Validate()
+	if loader.PrintRequested() {
+		// print even an invalid config, which is what it is for
+		loader.Print(os.Stdout)
+		if err == nil {
+			return
+		}
+	}
+	if err != nil {
+		log.Fatalf("config: %s", err)
+	}
+
+	conn = &DB{DBConfig: cfg.DB}
+
+	err = conn.connect()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *migrate {
+		count, err := conn.migrateFriendships()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("migrated %d friendships", count)
+		return
+	}
+
+	if *migrateUsernames {
+		users, edges, err := conn.migrateUsernames()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("canonicalized %d users and %d friendships", users, edges)
+		return
+	}
 
-	err := conn.connect()
+	err = conn.ensureSchema()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Fatalln(http.ListenAndServe(":8081", NewRouter()))
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.options("isutomo"))
+	if err != nil {
+		log.Fatalf("tracing: %s", err)
+	}
+
+	srv := graceful.New(&http.Server{Addr: cfg.Listen, Handler: traced(NewRouter())}, cfg.Shutdown.Delay, cfg.Shutdown.Timeout)
+	readiness.Add("server", func(ctx context.Context) error {
+		if !srv.Ready() {
+			return errShuttingDown
+		}
+		return nil
+	})
+	err = srv.ListenAndServe()
+	log.Printf("server stopped: %v", err)
+
+	if err := conn.Conn.Close(); err != nil {
+		log.Println(err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Println(err)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
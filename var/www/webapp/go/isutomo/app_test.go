@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/config"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/health"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/openapi"
+)
+
+// setupDB connects to the database configured like isutomo is, by
+// $ISUTOMO_CONFIG and ISUTOMO_DB_*, and skips the test when it is not
+// reachable.
+func setupDB(t *testing.T) {
+	t.Helper()
+
+	c := defaultConfig()
+	if err := config.New(flag.NewFlagSet("test", flag.ContinueOnError), &c, "ISUTOMO_CONFIG").Load(); err != nil {
+		t.Fatal(err)
+	}
+	conn = &DB{DBConfig: c.DB}
+	if err := conn.connect(); err != nil {
+		t.Skip(err)
+	}
+	if err := conn.Conn.Ping(); err != nil {
+		t.Skipf("database is not available: %v", err)
+	}
+	if err := conn.ensureSchema(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// requireMariaDB skips tests of concurrent writes unless the database is
+// MariaDB, whose transactions they rely on; other MySQL-compatible servers
+// used for testing may lose some of the writes.
+func requireMariaDB(t *testing.T) {
+	t.Helper()
+
+	var version string
+	if err := conn.Conn.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(version, "MariaDB") {
+		t.Skipf("concurrent writes are only checked against MariaDB, not %s", version)
+	}
+}
+
+func createTestUser(t *testing.T) string {
+	t.Helper()
+
+	me := fmt.Sprintf("t%d", time.Now().UnixNano()%1e12)
+	if _, err := conn.Conn.Exec("INSERT INTO friends (me, friends) VALUES (?, '')", me); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Conn.Exec("DELETE FROM friendships WHERE me = ?", me)
+		conn.Conn.Exec("DELETE FROM friends WHERE me = ?", me)
+	})
+	return me
+}
+
+// doJSON sends body to url and returns the response. It does not use t so
+// that it can be called from any goroutine.
+func doJSON(method, url, body string) (int, []byte, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// newTestServer serves NewRouter, checking every request and response
+// against the OpenAPI document.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	spec, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(spec.Middleware(NewRouter(), func(err error) {
+		t.Errorf("openapi: %v", err)
+	}))
+}
+
+func TestConcurrentFollow(t *testing.T) {
+	setupDB(t)
+	requireMariaDB(t)
+	me := createTestUser(t)
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, body, err := doJSON(http.MethodPost, ts.URL+"/"+me, fmt.Sprintf(`{"user":"friend%d"}`, i))
+			if err != nil || status != http.StatusOK {
+				errs <- fmt.Sprintf("follow friend%d: %d %s %v", i, status, body, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	status, body, err := doJSON(http.MethodGet, ts.URL+"/"+me, "")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("GET /%s: %d %s %v", me, status, body, err)
+	}
+	var data struct {
+		Friends []string `json:"friends"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Friends) != n {
+		t.Errorf("got %d friends, want %d: %v", len(data.Friends), n, data.Friends)
+	}
+}
+
+func TestConcurrentFollowSameUser(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	const n = 20
+	var wg sync.WaitGroup
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _, err := doJSON(http.MethodPost, ts.URL+"/"+me, `{"user":"alice"}`)
+			if err != nil {
+				t.Error(err)
+			}
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	ok := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			ok++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d follows succeeded, want exactly 1", ok)
+	}
+}
+
+func TestConcurrentUnfollow(t *testing.T) {
+	setupDB(t)
+	requireMariaDB(t)
+	me := createTestUser(t)
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	const n = 30
+	for i := 0; i < n; i++ {
+		if status, body, err := doJSON(http.MethodPost, ts.URL+"/"+me, fmt.Sprintf(`{"user":"friend%d"}`, i)); err != nil || status != http.StatusOK {
+			t.Fatalf("follow friend%d: %d %s %v", i, status, body, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i += 2 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if status, body, err := doJSON(http.MethodDelete, ts.URL+"/"+me, fmt.Sprintf(`{"user":"friend%d"}`, i)); err != nil || status != http.StatusOK {
+				t.Errorf("unfollow friend%d: %d %s %v", i, status, body, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	friend, err := conn.fetchFriend(context.Background(), me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(friend.getFriends()); got != n/2 {
+		t.Errorf("got %d friends, want %d: %v", got, n/2, friend.getFriends())
+	}
+}
+
+func TestUnknownUser(t *testing.T) {
+	setupDB(t)
+	me := fmt.Sprintf("n%d", time.Now().UnixNano()%1e12)
+	t.Cleanup(func() {
+		conn.Conn.Exec("DELETE FROM friendships WHERE me = ?", me)
+		conn.Conn.Exec("DELETE FROM friends WHERE me = ?", me)
+	})
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	status, body, err := doJSON(http.MethodGet, ts.URL+"/"+me, "")
+	if err != nil || status != http.StatusOK || string(body) != `{"friends":[]}` {
+		t.Errorf("GET unknown user: %d %s %v", status, body, err)
+	}
+
+	status, body, err = doJSON(http.MethodPost, ts.URL+"/"+me, `{"user":"alice"}`)
+	if err != nil || status != http.StatusOK || string(body) != `{"friends":["alice"]}` {
+		t.Errorf("first follow: %d %s %v", status, body, err)
+	}
+
+	status, body, err = doJSON(http.MethodPut, ts.URL+"/"+me, "")
+	if err != nil || status != http.StatusOK {
+		t.Errorf("PUT existing user: %d %s %v", status, body, err)
+	}
+}
+
+func TestPutUser(t *testing.T) {
+	setupDB(t)
+	me := fmt.Sprintf("p%d", time.Now().UnixNano()%1e12)
+	t.Cleanup(func() {
+		conn.Conn.Exec("DELETE FROM friends WHERE me = ?", me)
+	})
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	for i, want := range []int{http.StatusCreated, http.StatusOK} {
+		status, body, err := doJSON(http.MethodPut, ts.URL+"/"+me, "")
+		if err != nil || status != want || string(body) != `{"friends":[]}` {
+			t.Errorf("PUT #%d: %d %s %v, want %d", i, status, body, err, want)
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodPost, "/alice", `{"user":`, http.StatusUnprocessableEntity, codeInvalidBody},
+		{http.MethodPost, "/alice", `{}`, http.StatusUnprocessableEntity, codeInvalidBody},
+		{http.MethodDelete, "/alice", `not json`, http.StatusUnprocessableEntity, codeInvalidBody},
+		{http.MethodGet, "/alice/bob/carol", "", http.StatusNotFound, codeNotFound},
+	}
+	for _, tt := range tests {
+		status, body, err := doJSON(tt.method, ts.URL+tt.path, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res ErrorResponse
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Errorf("%s %s: invalid error body %q: %v", tt.method, tt.path, body, err)
+			continue
+		}
+		if status != tt.status || res.Code != tt.code || res.Error == "" {
+			t.Errorf("%s %s: got %d %+v, want %d %s", tt.method, tt.path, status, res, tt.status, tt.code)
+		}
+	}
+}
+
+func TestFollowConflicts(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	tests := []struct {
+		method string
+		status int
+		code   string
+	}{
+		{http.MethodDelete, http.StatusConflict, codeNotFollowing},
+		{http.MethodPost, http.StatusOK, ""},
+		{http.MethodPost, http.StatusConflict, codeAlreadyFollowing},
+		{http.MethodDelete, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		status, body, err := doJSON(tt.method, ts.URL+"/"+me, `{"user":"alice"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res ErrorResponse
+		json.Unmarshal(body, &res)
+		if status != tt.status || res.Code != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.method, status, body, tt.status, tt.code)
+		}
+	}
+}
+
+func TestRelations(t *testing.T) {
+	setupDB(t)
+	a := createTestUser(t)
+	b := a + "b"
+	c := a + "c"
+	t.Cleanup(func() {
+		conn.Conn.Exec("DELETE FROM friendships WHERE me IN (?, ?)", b, c)
+		conn.Conn.Exec("DELETE FROM friends WHERE me IN (?, ?)", b, c)
+	})
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	for _, edge := range [][2]string{{a, b}, {b, a}, {a, c}, {b, c}, {c, a}} {
+		if status, body, err := doJSON(http.MethodPost, ts.URL+"/"+edge[0], `{"user":"`+edge[1]+`"}`); err != nil || status != http.StatusOK {
+			t.Fatalf("follow %v: %d %s %v", edge, status, body, err)
+		}
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   string
+	}{
+		{http.MethodGet, "/" + a + "/followers", "", `{"followers":["` + b + `","` + c + `"]}`},
+		{http.MethodGet, "/" + c + "/following/" + a, "", `{"following":true}`},
+		{http.MethodGet, "/" + a + "/following/" + c + "x", "", `{"following":false}`},
+		{http.MethodGet, "/" + a + "/mutual/" + b, "", `{"following":true,"followed_by":true,"mutual":true,"common_friends":["` + c + `"]}`},
+		{http.MethodPost, "/_/lookup", `{"me":"` + a + `","users":["` + b + `","` + c + `"]}`,
+			`{"users":[` +
+				`{"user":"` + b + `","following":true,"followed_by":true,"following_count":2,"followers_count":1},` +
+				`{"user":"` + c + `","following":true,"followed_by":true,"following_count":1,"followers_count":2}]}`},
+	}
+	for _, tt := range tests {
+		status, body, err := doJSON(tt.method, ts.URL+tt.path, tt.body)
+		if err != nil || status != http.StatusOK || string(body) != tt.want {
+			t.Errorf("%s %s: %d %s %v, want %s", tt.method, tt.path, status, body, err, tt.want)
+		}
+	}
+}
+
+func TestFriendsPagination(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	want := []string{}
+	for i := 0; i < 5; i++ {
+		friend := me + "f" + strconv.Itoa(i)
+		if status, body, err := doJSON(http.MethodPost, ts.URL+"/"+me, `{"user":"`+friend+`"}`); err != nil || status != http.StatusOK {
+			t.Fatalf("follow %s: %d %s %v", friend, status, body, err)
+		}
+		want = append(want, friend)
+	}
+
+	got := []string{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("pagination does not terminate")
+		}
+		status, body, err := doJSON(http.MethodGet, ts.URL+"/"+me+"?limit=2&cursor="+cursor, "")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("page %d: %d %s %v", pages, status, body, err)
+		}
+		var res struct {
+			Friends    []string `json:"friends"`
+			NextCursor string   `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, res.Friends...)
+		if res.NextCursor == "" {
+			break
+		}
+		cursor = res.NextCursor
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{http.MethodGet, "/" + me + "?count=1", "", http.StatusOK, `{"count":5}`},
+		{http.MethodGet, "/" + me + "?limit=0", "", http.StatusUnprocessableEntity, ""},
+		{http.MethodGet, "/" + me + "?cursor=%21", "", http.StatusUnprocessableEntity, ""},
+		{http.MethodPost, "/_/batch", `{"users":["` + me + `","` + me + `x"]}`, http.StatusOK,
+			`{"friends":{"` + me + `":["` + strings.Join(want, `","`) + `"],"` + me + `x":[]}}`},
+	}
+	for _, tt := range tests {
+		status, body, err := doJSON(tt.method, ts.URL+tt.path, tt.body)
+		if err != nil || status != tt.status || (tt.want != "" && string(body) != tt.want) {
+			t.Errorf("%s %s: %d %s %v, want %d %s", tt.method, tt.path, status, body, err, tt.status, tt.want)
+		}
+	}
+}
+
+func TestSplitSQL(t *testing.T) {
+	src := "-- header\n" +
+		"/*!40101 SET NAMES utf8 */;\n" +
+		"DROP TABLE IF EXISTS `a;b`; # trailing\n" +
+		"/* block; comment */\n" +
+		"INSERT INTO friends VALUES (1,'x;y','it\\'s;'),(2,\"q;\",'');\n" +
+		"SELECT 1--\n"
+	want := []string{
+		"/*!40101 SET NAMES utf8 */",
+		"DROP TABLE IF EXISTS `a;b`",
+		"INSERT INTO friends VALUES (1,'x;y','it\\'s;'),(2,\"q;\",'')",
+		"SELECT 1",
+	}
+	got := splitSQL([]byte(src))
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+
+	f, err := ioutil.TempFile("", "seed*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "LOCK TABLES `friends` WRITE;\nUPDATE friends SET friends = '%[1]sa,%[1]sb' WHERE me = '%[1]s';\nUNLOCK TABLES;\n", me)
+	f.Close()
+
+	step, err := conn.seed(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step.Statements != 1 || step.RowsAffected != 1 {
+		t.Errorf("got %+v, want 1 statement affecting 1 row", step)
+	}
+
+	if _, err := conn.seed(f.Name() + ".missing"); err == nil {
+		t.Error("seeding a missing file succeeded")
+	}
+}
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+	upper := strings.ToUpper(me)
+
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{http.MethodPost, "/" + upper, `{"user":"` + upper + `X"}`, http.StatusOK, `{"friends":["` + me + `x"]}`},
+		{http.MethodPost, "/" + me, `{"user":"` + me + `x"}`, http.StatusConflict, ""},
+		{http.MethodGet, "/" + me + "x/followers", "", http.StatusOK, `{"followers":["` + me + `"]}`},
+		{http.MethodPost, "/_/batch", `{"users":["` + upper + `"]}`, http.StatusOK, `{"friends":{"` + upper + `":["` + me + `x"]}}`},
+		{http.MethodDelete, "/" + me, `{"user":"` + upper + `X"}`, http.StatusOK, `{"friends":[]}`},
+		{http.MethodGet, "/" + upper, "", http.StatusOK, `{"friends":[]}`},
+	}
+	for _, s := range steps {
+		status, body, err := doJSON(s.method, ts.URL+s.path, s.body)
+		if err != nil || status != s.status || (s.want != "" && string(body) != s.want) {
+			t.Errorf("%s %s %s: %d %s %v, want %d %s", s.method, s.path, s.body, status, body, err, s.status, s.want)
+		}
+	}
+}
+
+func TestMigrateUsernames(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+	upper := strings.ToUpper(me)
+
+	old := time.Now().Add(-time.Hour)
+	for _, edge := range [][2]string{{upper, me + "a"}, {me, upper + "A"}, {me, me + "b"}} {
+		if _, err := conn.Conn.Exec("INSERT INTO friendships (me, friend, created_at) VALUES (?, ?, ?)", edge[0], edge[1], old); err != nil {
+			t.Fatal(err)
+		}
+		old = old.Add(time.Second)
+	}
+	t.Cleanup(func() {
+		conn.Conn.Exec("DELETE FROM friendships WHERE me IN (?, ?)", me, upper)
+	})
+
+	if _, edges, err := conn.migrateUsernames(); err != nil || edges != 2 {
+		t.Fatalf("got %d changed edges, %v; want 2", edges, err)
+	}
+
+	friend, err := conn.fetchFriend(context.Background(), me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := me + "a," + me + "b"; strings.Join(friend.getFriends(), ",") != want {
+		t.Errorf("got %v, want %s", friend.getFriends(), want)
+	}
+}
+
+func TestMigrateFriendshipsKeepsFollows(t *testing.T) {
+	setupDB(t)
+	me := createTestUser(t)
+	if _, err := conn.addFriendship(context.Background(), me, me+"a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.migrateFriendships(); err != errFriendshipsNotEmpty {
+		t.Fatalf("got %v, want %v", err, errFriendshipsNotEmpty)
+	}
+	friend, err := conn.fetchFriend(context.Background(), me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := friend.getFriends(); len(got) != 1 || got[0] != me+"a" {
+		t.Errorf("got %v after a refused migration", got)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	status, body, err := doJSON(http.MethodGet, ts.URL+"/_/openapi.json", "")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("got %d %v", status, err)
+	}
+	if string(body) != openapi.Document {
+		t.Error("served document differs from openapi.Document")
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	setupDB(t)
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	for _, tt := range []struct{ method, path, body string }{
+		{http.MethodPut, "/healthz", ""},
+		{http.MethodGet, "/Lookup", ""},
+		{http.MethodGet, "/_/followers", ""},
+		{http.MethodPost, "/alice", `{"user":"batch"}`},
+	} {
+		status, body, err := doJSON(tt.method, ts.URL+tt.path, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%s %s %s: got %d %s", tt.method, tt.path, tt.body, status, body)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	setupDB(t)
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	status, body, err := doJSON(http.MethodGet, ts.URL+"/_/healthz", "")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("healthz: got %d %v", status, err)
+	}
+
+	status, body, err = doJSON(http.MethodGet, ts.URL+"/_/readyz", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report health.Report
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || report.Checks["mysql"].Status != health.StatusOK {
+		t.Errorf("readyz: got %d %s", status, body)
+	}
+
+	saved := conn
+	defer func() { conn = saved }()
+	conn = &DB{DBConfig: saved.DBConfig}
+	conn.Conn, _ = sql.Open("mysql", "root@tcp(127.0.0.1:1)/isuwitter")
+	defer conn.Conn.Close()
+
+	status, body, err = doJSON(http.MethodGet, ts.URL+"/_/readyz", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = health.Report{}
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable || report.Checks["mysql"].Status != health.StatusFail {
+		t.Errorf("readyz with MariaDB down: got %d %s", status, body)
+	}
+}
@@ -0,0 +1,346 @@
+// Package client is a client of the isutomo API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Error codes returned by isutomo.
+const (
+	CodeNotFound         = "not_found"
+	CodeAlreadyFollowing = "already_following"
+	CodeNotFollowing     = "not_following"
+	CodeInvalidBody      = "invalid_body"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeInternal         = "internal"
+)
+
+// Error is returned for non-2xx responses.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("isutomo: %s %s: %d %s: %s", e.Method, e.Path, e.StatusCode, e.Code, e.Message)
+}
+
+// Temporary reports whether the same request may succeed later.
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500
+}
+
+// ErrorCode returns the isutomo error code of err, or "" if err is not an
+// *Error.
+func ErrorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// Client calls the isutomo API at Endpoint. The zero value is not usable; use
+// New.
+type Client struct {
+	Endpoint   string
+	HTTPClient *http.Client
+
+	// Timeout bounds every call but Initialize, which uses
+	// InitializeTimeout since it reseeds the database.
+	Timeout           time.Duration
+	InitializeTimeout time.Duration
+
+	// Calls that do not change the follow state (all but Follow, Unfollow
+	// and Initialize) are retried up to Retries times on network errors and
+	// 5xx responses. Initialize is not, since a retry could run while the
+	// reseed it follows is still running on isutomo.
+	Retries   int
+	RetryWait time.Duration
+
+	// Observe, when set, is called after every call with the name of the
+	// Client method, the time it took including retries and its error.
+	Observe func(op string, elapsed time.Duration, err error)
+}
+
+// New returns a Client with the default timeouts and retries.
+func New(endpoint string) *Client {
+	return &Client{
+		Endpoint:          endpoint,
+		HTTPClient:        http.DefaultClient,
+		Timeout:           3 * time.Second,
+		InitializeTimeout: time.Minute,
+		Retries:           2,
+		RetryWait:         50 * time.Millisecond,
+	}
+}
+
+type friendsResponse struct {
+	Friends []string `json:"friends"`
+}
+
+type userRequest struct {
+	User string `json:"user"`
+}
+
+// GetFriends returns the users me follows.
+func (c *Client) GetFriends(ctx context.Context, me string) ([]string, error) {
+	var res friendsResponse
+	_, err := c.do(ctx, "GetFriends", c.Timeout, true, http.MethodGet, userPath(me), nil, &res)
+	return res.Friends, err
+}
+
+// GetFriendsPage returns up to limit users me follows, starting at cursor
+// ("" for the first page), and the cursor of the next page or "" on the last.
+func (c *Client) GetFriendsPage(ctx context.Context, me string, limit int, cursor string) ([]string, string, error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	var res struct {
+		Friends    []string `json:"friends"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	_, err := c.do(ctx, "GetFriendsPage", c.Timeout, true, http.MethodGet, userPath(me)+"?"+q.Encode(), nil, &res)
+	return res.Friends, res.NextCursor, err
+}
+
+// CountFriends returns the number of users me follows.
+func (c *Client) CountFriends(ctx context.Context, me string) (int, error) {
+	var res struct {
+		Count int `json:"count"`
+	}
+	_, err := c.do(ctx, "CountFriends", c.Timeout, true, http.MethodGet, userPath(me)+"?count=1", nil, &res)
+	return res.Count, err
+}
+
+// BatchFriends returns the friends of each of users.
+func (c *Client) BatchFriends(ctx context.Context, users []string) (map[string][]string, error) {
+	req := struct {
+		Users []string `json:"users"`
+	}{users}
+	var res struct {
+		Friends map[string][]string `json:"friends"`
+	}
+	// batch only reads, so it is safe to retry although it is a POST
+	_, err := c.do(ctx, "BatchFriends", c.Timeout, true, http.MethodPost, "/_/batch", req, &res)
+	return res.Friends, err
+}
+
+// Follow makes me follow user and returns the friends of me afterwards. It
+// fails with CodeAlreadyFollowing if me already follows user.
+func (c *Client) Follow(ctx context.Context, me, user string) ([]string, error) {
+	var res friendsResponse
+	_, err := c.do(ctx, "Follow", c.Timeout, false, http.MethodPost, userPath(me), userRequest{user}, &res)
+	return res.Friends, err
+}
+
+// Unfollow makes me unfollow user and returns the friends of me afterwards.
+// It fails with CodeNotFollowing if me does not follow user.
+func (c *Client) Unfollow(ctx context.Context, me, user string) ([]string, error) {
+	var res friendsResponse
+	_, err := c.do(ctx, "Unfollow", c.Timeout, false, http.MethodDelete, userPath(me), userRequest{user}, &res)
+	return res.Friends, err
+}
+
+// Relation describes how the user given to Lookup is related to User.
+type Relation struct {
+	User           string `json:"user"`
+	Following      bool   `json:"following"`
+	FollowedBy     bool   `json:"followed_by"`
+	FollowingCount int    `json:"following_count"`
+	FollowersCount int    `json:"followers_count"`
+}
+
+// MutualResult is the relation between two users.
+type MutualResult struct {
+	Following     bool     `json:"following"`
+	FollowedBy    bool     `json:"followed_by"`
+	Mutual        bool     `json:"mutual"`
+	CommonFriends []string `json:"common_friends"`
+}
+
+// GetFollowers returns the users following user.
+func (c *Client) GetFollowers(ctx context.Context, user string) ([]string, error) {
+	var res struct {
+		Followers []string `json:"followers"`
+	}
+	_, err := c.do(ctx, "GetFollowers", c.Timeout, true, http.MethodGet, userPath(user)+"/followers", nil, &res)
+	return res.Followers, err
+}
+
+// IsFollowing reports whether me follows user.
+func (c *Client) IsFollowing(ctx context.Context, me, user string) (bool, error) {
+	var res struct {
+		Following bool `json:"following"`
+	}
+	_, err := c.do(ctx, "IsFollowing", c.Timeout, true, http.MethodGet, userPath(me)+"/following/"+url.PathEscape(user), nil, &res)
+	return res.Following, err
+}
+
+// Mutual returns whether a and b follow each other and whom they both follow.
+func (c *Client) Mutual(ctx context.Context, a, b string) (*MutualResult, error) {
+	var res MutualResult
+	_, err := c.do(ctx, "Mutual", c.Timeout, true, http.MethodGet, userPath(a)+"/mutual/"+url.PathEscape(b), nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Lookup returns the relation of me with each of users, in the same order, in
+// a single request. me may be empty to only get the counts.
+func (c *Client) Lookup(ctx context.Context, me string, users []string) ([]Relation, error) {
+	req := struct {
+		Me    string   `json:"me,omitempty"`
+		Users []string `json:"users"`
+	}{me, users}
+	var res struct {
+		Users []Relation `json:"users"`
+	}
+	// lookup only reads, so it is safe to retry although it is a POST
+	_, err := c.do(ctx, "Lookup", c.Timeout, true, http.MethodPost, "/_/lookup", req, &res)
+	return res.Users, err
+}
+
+// Provision creates the isutomo record of me and reports whether it did not
+// exist yet.
+func (c *Client) Provision(ctx context.Context, me string) (bool, error) {
+	var res friendsResponse
+	status, err := c.do(ctx, "Provision", c.Timeout, true, http.MethodPut, userPath(me), nil, &res)
+	return status == http.StatusCreated, err
+}
+
+// Initialize reseeds the isutomo database. It is not retried.
+func (c *Client) Initialize(ctx context.Context) error {
+	_, err := c.do(ctx, "Initialize", c.InitializeTimeout, false, http.MethodGet, "/initialize", nil, nil)
+	return err
+}
+
+// Ping checks that isutomo serves its API. It is not retried, so that a
+// readiness check sees a failure at once.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "Ping", c.Timeout, false, http.MethodGet, "/_/healthz", nil, nil)
+	return err
+}
+
+func userPath(me string) string {
+	return "/" + url.PathEscape(me)
+}
+
+// do sends the request of op, retrying it if idempotent, and decodes the
+// response into out. It returns the status code of the last response.
+func (c *Client) do(ctx context.Context, op string, timeout time.Duration, idempotent bool, method, path string, in, out interface{}) (int, error) {
+	if c.Observe == nil {
+		return c.try(ctx, timeout, idempotent, method, path, in, out)
+	}
+	start := time.Now()
+	status, err := c.try(ctx, timeout, idempotent, method, path, in, out)
+	c.Observe(op, time.Since(start), err)
+	return status, err
+}
+
+func (c *Client) try(ctx context.Context, timeout time.Duration, idempotent bool, method, path string, in, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+
+	retries := 0
+	if idempotent {
+		retries = c.Retries
+	}
+	for i := 0; ; i++ {
+		status, err := c.doOnce(ctx, timeout, method, path, body, out)
+		if err == nil || i >= retries || !retryable(err) || ctx.Err() != nil {
+			return status, err
+		}
+		select {
+		case <-ctx.Done():
+			return status, err
+		case <-time.After(c.RetryWait):
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, timeout time.Duration, method, path string, body []byte, out interface{}) (int, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.Endpoint+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e := &Error{Method: method, Path: path, StatusCode: resp.StatusCode}
+		var res struct {
+			Code  string `json:"code"`
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &res) == nil && res.Code != "" {
+			e.Code = res.Code
+			e.Message = res.Error
+		} else {
+			e.Code = CodeInternal
+			e.Message = string(b)
+		}
+		return resp.StatusCode, e
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func retryable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Temporary()
+	}
+	// network errors and timeouts
+	return true
+}
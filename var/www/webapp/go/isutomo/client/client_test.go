@@ -0,0 +1,377 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/openapi"
+)
+
+func newTestClient(h http.HandlerFunc) (*Client, func()) {
+	ts := httptest.NewServer(h)
+	c := New(ts.URL)
+	c.RetryWait = time.Millisecond
+	return c, ts.Close
+}
+
+// newSpecTestClient is newTestClient checking the traffic against the
+// OpenAPI document of isutomo, so that the client and the stub responses
+// cannot drift from the API.
+func newSpecTestClient(t *testing.T, h http.HandlerFunc) (*Client, func()) {
+	t.Helper()
+
+	spec, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(spec.Middleware(h, func(err error) {
+		t.Errorf("openapi: %v", err)
+	}))
+	c := New(ts.URL)
+	c.RetryWait = time.Millisecond
+	return c, ts.Close
+}
+
+func TestGetFriends(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.EscapedPath() != "/a%2Fb" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+		}
+		w.Write([]byte(`{"friends":["alice","bob"]}`))
+	})
+	defer done()
+
+	friends, err := c.GetFriends(context.Background(), "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 2 || friends[0] != "alice" || friends[1] != "bob" {
+		t.Errorf("got %v", friends)
+	}
+}
+
+func TestFollowEncodesBody(t *testing.T) {
+	const user = `evil","user":"admin`
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if len(body) != 1 || body["user"] != user {
+			t.Errorf("got body %v", body)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		w.Write([]byte(`{"friends":["x"]}`))
+	})
+	defer done()
+
+	if _, err := c.Follow(context.Background(), "me", user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypedError(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"code":"already_following","error":"alice is already your friend."}`))
+	})
+	defer done()
+
+	_, err := c.Follow(context.Background(), "me", "alice")
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %T %v, want *Error", err, err)
+	}
+	if e.StatusCode != http.StatusConflict || e.Code != CodeAlreadyFollowing || e.Temporary() {
+		t.Errorf("got %+v", e)
+	}
+	if ErrorCode(err) != CodeAlreadyFollowing {
+		t.Errorf("ErrorCode = %q", ErrorCode(err))
+	}
+}
+
+func TestUnstructuredError(t *testing.T) {
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusBadGateway)
+	})
+	defer done()
+	c.Retries = 0
+
+	_, err := c.GetFriends(context.Background(), "me")
+	if ErrorCode(err) != CodeInternal || !err.(*Error).Temporary() {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	var calls int32
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"code":"internal","error":"internal server error"}`))
+			return
+		}
+		w.Write([]byte(`{"friends":[]}`))
+	})
+	defer done()
+
+	if _, err := c.GetFriends(context.Background(), "me"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestNoRetryOnFollowOrInitialize(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer done()
+
+	if _, err := c.Follow(context.Background(), "me", "alice"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := c.Unfollow(context.Background(), "me", "alice"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := c.Initialize(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":"not_found","error":"not found"}`))
+	})
+	defer done()
+
+	if err := c.Initialize(context.Background()); ErrorCode(err) != CodeNotFound {
+		t.Fatalf("got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	defer done()
+	c.Timeout = 10 * time.Millisecond
+	c.Retries = 0
+
+	start := time.Now()
+	if _, err := c.GetFriends(context.Background(), "me"); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+func TestPing(t *testing.T) {
+	var calls int32
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Method != http.MethodGet || r.URL.Path != "/_/healthz" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+	done()
+
+	// a down isutomo fails at the first attempt
+	if err := c.Ping(context.Background()); err == nil {
+		t.Error("Ping succeeded against a closed server")
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	var calls int32
+	c, done := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":"not_found","error":"no such user"}`))
+	})
+	defer done()
+
+	type observation struct {
+		op  string
+		err error
+	}
+	var got []observation
+	c.Observe = func(op string, elapsed time.Duration, err error) {
+		got = append(got, observation{op, err})
+	}
+
+	_, err := c.GetFriends(context.Background(), "me")
+	// the retry is part of the same observation
+	if len(got) != 1 || got[0].op != "GetFriends" || got[0].err != err || ErrorCode(err) != CodeNotFound {
+		t.Errorf("got %+v for %v", got, err)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	var calls int32
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("got method %s", r.Method)
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte(`{"friends":[]}`))
+	})
+	defer done()
+
+	for i, want := range []bool{true, false} {
+		created, err := c.Provision(context.Background(), "me")
+		if err != nil || created != want {
+			t.Errorf("#%d: got %v %v, want %v", i, created, err, want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/_/lookup" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var body struct {
+			Me    string   `json:"me"`
+			Users []string `json:"users"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if body.Me != "me" || len(body.Users) != 2 {
+			t.Errorf("got body %+v", body)
+		}
+		w.Write([]byte(`{"users":[{"user":"a","following":true,"followed_by":false,"following_count":1,"followers_count":2},{"user":"b","following":false,"followed_by":true,"following_count":0,"followers_count":0}]}`))
+	})
+	defer done()
+
+	relations, err := c.Lookup(context.Background(), "me", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Relation{
+		{User: "a", Following: true, FollowingCount: 1, FollowersCount: 2},
+		{User: "b", FollowedBy: true},
+	}
+	if len(relations) != len(want) || relations[0] != want[0] || relations[1] != want[1] {
+		t.Errorf("got %+v, want %+v", relations, want)
+	}
+}
+
+func TestRelationPaths(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/a%20b/followers":
+			w.Write([]byte(`{"followers":["x"]}`))
+		case "/a%20b/following/c%2Fd":
+			w.Write([]byte(`{"following":true}`))
+		case "/a%20b/mutual/c%2Fd":
+			w.Write([]byte(`{"following":true,"followed_by":true,"mutual":true,"common_friends":["x"]}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.EscapedPath())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer done()
+	ctx := context.Background()
+
+	if followers, err := c.GetFollowers(ctx, "a b"); err != nil || len(followers) != 1 {
+		t.Errorf("GetFollowers: %v %v", followers, err)
+	}
+	if following, err := c.IsFollowing(ctx, "a b", "c/d"); err != nil || !following {
+		t.Errorf("IsFollowing: %v %v", following, err)
+	}
+	if m, err := c.Mutual(ctx, "a b", "c/d"); err != nil || !m.Mutual || len(m.CommonFriends) != 1 {
+		t.Errorf("Mutual: %+v %v", m, err)
+	}
+}
+
+func TestGetFriendsPage(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alice" || r.URL.Query().Get("limit") != "2" || r.URL.Query().Get("cursor") != "abc" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"friends":["bob","carol"],"next_cursor":"def"}`))
+	})
+	defer done()
+
+	friends, next, err := c.GetFriendsPage(context.Background(), "alice", 2, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 2 || friends[0] != "bob" || friends[1] != "carol" || next != "def" {
+		t.Errorf("got %v %q", friends, next)
+	}
+}
+
+func TestCountFriends(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alice" || r.URL.Query().Get("count") == "" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"count":3}`))
+	})
+	defer done()
+
+	n, err := c.CountFriends(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d, want 3", n)
+	}
+}
+
+func TestBatchFriends(t *testing.T) {
+	c, done := newSpecTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/_/batch" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"friends":{"a":["b"],"b":[]}}`))
+	})
+	defer done()
+
+	friends, err := c.BatchFriends(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 2 || len(friends["a"]) != 1 || friends["a"][0] != "b" || len(friends["b"]) != 0 {
+		t.Errorf("got %v", friends)
+	}
+}
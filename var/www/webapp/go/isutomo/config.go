@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+)
+
+// Config holds the settings of isutomo, loaded by package config.
+type Config struct {
+	Listen   string         `json:"listen" env:"ISUTOMO_LISTEN" flag:"listen" usage:"address to serve the API on"`
+	SeedFile string         `json:"seed_file" env:"ISUTOMO_SEED_FILE" flag:"seed-file" usage:"SQL file /initialize loads, ../../sql/seed_isutomo.sql from the binary when empty"`
+	DB       DBConfig       `json:"db"`
+	Shutdown ShutdownConfig `json:"shutdown"`
+	Tracing  TracingConfig  `json:"tracing"`
+}
+
+// DBConfig locates the MariaDB database holding the friendships.
+type DBConfig struct {
+	Host     string `json:"host" env:"ISUTOMO_DB_HOST" flag:"db-host" usage:"MariaDB host"`
+	Port     int    `json:"port" env:"ISUTOMO_DB_PORT" flag:"db-port" usage:"MariaDB port"`
+	User     string `json:"user" env:"ISUTOMO_DB_USER" flag:"db-user" usage:"MariaDB user"`
+	Password string `json:"password" env:"ISUTOMO_DB_PASSWORD" secret:"true"`
+	Name     string `json:"name" env:"ISUTOMO_DB_NAME" flag:"db-name" usage:"MariaDB database"`
+}
+
+// ShutdownConfig times the draining on SIGTERM, see package graceful.
+type ShutdownConfig struct {
+	Delay   time.Duration `json:"delay" env:"ISUTOMO_SHUTDOWN_DELAY" flag:"shutdown-delay" usage:"time to keep serving once unready on SIGTERM"`
+	Timeout time.Duration `json:"timeout" env:"ISUTOMO_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"time to wait for the requests in flight on SIGTERM"`
+}
+
+// TracingConfig selects where the OpenTelemetry spans go, see package
+// tracing.
+type TracingConfig struct {
+	Exporter string `json:"exporter" env:"ISUTOMO_TRACING_EXPORTER" flag:"tracing" usage:"span exporter: none, otlp or file"`
+	Endpoint string `json:"endpoint" env:"ISUTOMO_TRACING_ENDPOINT" flag:"tracing-endpoint" usage:"host:port of the OTLP/HTTP collector"`
+	File     string `json:"file" env:"ISUTOMO_TRACING_FILE" flag:"tracing-file" usage:"file the file exporter appends JSON spans to"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ":8081",
+		DB: DBConfig{
+			Host: "localhost",
+			Port: 3306,
+			User: "root",
+			Name: "isuwitter",
+		},
+		Shutdown: ShutdownConfig{
+			Delay:   time.Second,
+			Timeout: 10 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter: tracing.ExporterNone,
+			Endpoint: "localhost:4318",
+		},
+	}
+}
+
+// Validate reports the first setting isutomo cannot start with.
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen is empty")
+	}
+	if err := c.DB.Validate(); err != nil {
+		return err
+	}
+	if err := c.Shutdown.Validate(); err != nil {
+		return err
+	}
+	return c.Tracing.Validate()
+}
+
+func (c *DBConfig) Validate() error {
+	switch {
+	case c.Host == "":
+		return errors.New("db.host is empty")
+	case c.Port < 1 || c.Port > 65535:
+		return fmt.Errorf("db.port %d is not a port", c.Port)
+	case c.User == "":
+		return errors.New("db.user is empty")
+	case c.Name == "":
+		return errors.New("db.name is empty")
+	}
+	return nil
+}
+
+func (c *ShutdownConfig) Validate() error {
+	switch {
+	case c.Delay < 0:
+		return fmt.Errorf("shutdown.delay %s is negative", c.Delay)
+	case c.Timeout <= 0:
+		return fmt.Errorf("shutdown.timeout %s is not positive", c.Timeout)
+	}
+	return nil
+}
+
+func (c *TracingConfig) Validate() error {
+	switch c.Exporter {
+	case tracing.ExporterNone:
+	case tracing.ExporterOTLP:
+		if c.Endpoint == "" {
+			return errors.New("tracing.endpoint is empty")
+		}
+	case tracing.ExporterFile:
+		if c.File == "" {
+			return errors.New("tracing.file is empty")
+		}
+	default:
+		return fmt.Errorf("tracing.exporter %q is not none, otlp or file", c.Exporter)
+	}
+	return nil
+}
+
+// options returns the tracing.Options of service.
+func (c *TracingConfig) options(service string) tracing.Options {
+	return tracing.Options{Service: service, Exporter: c.Exporter, Endpoint: c.Endpoint, File: c.File}
+}
@@ -0,0 +1,308 @@
+// Package config loads the settings of isuwitter and isutomo into a typed
+// struct.
+//
+// Each setting is a field of the struct, tagged with its key in the JSON
+// config file, and optionally with the environment variable and the flag
+// that override it:
+//
+//	type Config struct {
+//		Listen string `json:"listen" env:"ISUTOMO_LISTEN" flag:"listen" usage:"address to serve HTTP on"`
+//		DB     struct {
+//			Password string `json:"password" env:"ISUTOMO_DB_PASSWORD" secret:"true"`
+//		} `json:"db"`
+//	}
+//
+// The values the struct holds before loading are the defaults. A setting is
+// then taken from the first of these that sets it:
+//
+//  1. the flag given on the command line,
+//  2. the environment variable, when not empty,
+//  3. the config file named by -config or else by its environment variable,
+//  4. the default.
+//
+// Fields may be strings, ints, bools or time.Durations, written as "10s" in
+// the file and in the environment. Secrets are redacted by Print.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the secrets Print writes.
+const Redacted = "<redacted>"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Loader fills a config struct. Create it with New before parsing the flags,
+// then call Load after.
+type Loader struct {
+	fs      *flag.FlagSet
+	fields  []*field
+	fileEnv string
+
+	file  *string
+	print *bool
+}
+
+type field struct {
+	// path holds the JSON keys leading to the field, as in db.host.
+	path   []string
+	env    string
+	flag   string
+	secret bool
+	value  reflect.Value
+}
+
+func (f *field) name() string {
+	return strings.Join(f.path, ".")
+}
+
+// New registers on fs the flags of cfg, a pointer to a config struct holding
+// the defaults, as well as -config and -print-config. fileEnv is the
+// environment variable naming the config file when -config is not given.
+func New(fs *flag.FlagSet, cfg interface{}, fileEnv string) *Loader {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic("config: New needs a pointer to a struct")
+	}
+
+	l := &Loader{fs: fs, fileEnv: fileEnv}
+	l.file = fs.String("config", "", "JSON file to read the settings from (default $"+fileEnv+")")
+	l.print = fs.Bool("print-config", false, "print the settings, secrets redacted, and exit")
+	l.walk(v.Elem(), nil)
+	return l
+}
+
+func (l *Loader) walk(v reflect.Value, path []string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		p := append(append([]string{}, path...), key)
+		if sf.Type.Kind() == reflect.Struct {
+			l.walk(v.Field(i), p)
+			continue
+		}
+
+		f := &field{
+			path:   p,
+			env:    sf.Tag.Get("env"),
+			flag:   sf.Tag.Get("flag"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		}
+		if f.flag != "" {
+			l.define(f, sf.Tag.Get("usage"))
+		}
+		l.fields = append(l.fields, f)
+	}
+}
+
+// define registers the flag of f. The flag does not write to the field,
+// since the file and the environment are read after parsing; Load applies
+// the flags given last.
+func (l *Loader) define(f *field, usage string) {
+	if f.env != "" {
+		usage += " ($" + f.env + ")"
+	}
+	switch v := f.value; {
+	case v.Type() == durationType:
+		l.fs.Duration(f.flag, time.Duration(v.Int()), usage)
+	case v.Kind() == reflect.String:
+		l.fs.String(f.flag, v.String(), usage)
+	case v.Kind() == reflect.Int:
+		l.fs.Int(f.flag, int(v.Int()), usage)
+	case v.Kind() == reflect.Bool:
+		l.fs.Bool(f.flag, v.Bool(), usage)
+	default:
+		panic("config: unsupported type " + v.Type().String())
+	}
+}
+
+// PrintRequested reports whether -print-config was given.
+func (l *Loader) PrintRequested() bool {
+	return *l.print
+}
+
+// Load reads the config file, then the environment, then the flags fs was
+// parsed from, into the config struct.
+func (l *Loader) Load() error {
+	path := *l.file
+	if path == "" {
+		path = os.Getenv(l.fileEnv)
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := l.loadJSON(data); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	for _, f := range l.fields {
+		if f.env == "" {
+			continue
+		}
+		if s := os.Getenv(f.env); s != "" {
+			if err := parse(f.value, s); err != nil {
+				return fmt.Errorf("$%s: %s", f.env, err)
+			}
+		}
+	}
+
+	set := map[string]bool{}
+	l.fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+	for _, f := range l.fields {
+		if set[f.flag] {
+			if err := parse(f.value, l.fs.Lookup(f.flag).Value.String()); err != nil {
+				return fmt.Errorf("-%s: %s", f.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Loader) loadJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var doc map[string]interface{}
+	if err := d.Decode(&doc); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, f := range l.fields {
+		v, ok := lookup(doc, f.path)
+		if !ok {
+			continue
+		}
+		seen[f.name()] = true
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case json.Number:
+			s = v.String()
+		case bool:
+			s = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("%s: want a string, a number or a bool", f.name())
+		}
+		if err := parse(f.value, s); err != nil {
+			return fmt.Errorf("%s: %s", f.name(), err)
+		}
+	}
+	return unknownKeys(doc, nil, seen)
+}
+
+// lookup returns the value at path in doc.
+func lookup(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// unknownKeys returns an error naming a setting of doc that is not in seen,
+// which is most likely a typo.
+func unknownKeys(doc map[string]interface{}, path []string, seen map[string]bool) error {
+	for key, v := range doc {
+		p := append(append([]string{}, path...), key)
+		if m, ok := v.(map[string]interface{}); ok {
+			if err := unknownKeys(m, p, seen); err != nil {
+				return err
+			}
+			continue
+		}
+		if name := strings.Join(p, "."); !seen[name] {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+	}
+	return nil
+}
+
+// parse sets v from s.
+func parse(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", s)
+		}
+		v.SetBool(b)
+	default:
+		panic("config: unsupported type " + v.Type().String())
+	}
+	return nil
+}
+
+func format(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Print writes the settings as a config file, secrets redacted.
+func (l *Loader) Print(w io.Writer) error {
+	doc := map[string]interface{}{}
+	for _, f := range l.fields {
+		m := doc
+		for _, key := range f.path[:len(f.path)-1] {
+			if m[key] == nil {
+				m[key] = map[string]interface{}{}
+			}
+			m = m[key].(map[string]interface{})
+		}
+		var v interface{} = f.value.Interface()
+		switch {
+		case f.secret && f.value.String() != "":
+			v = Redacted
+		case f.value.Type() == durationType:
+			v = format(f.value)
+		}
+		m[f.path[len(f.path)-1]] = v
+	}
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	return e.Encode(doc)
+}
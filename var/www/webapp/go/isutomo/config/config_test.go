@@ -0,0 +1,196 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Listen  string        `json:"listen" env:"TEST_LISTEN" flag:"listen" usage:"address to listen on"`
+	PerPage int           `json:"per_page" env:"TEST_PER_PAGE" flag:"per-page"`
+	Debug   bool          `json:"debug" flag:"debug"`
+	Timeout time.Duration `json:"timeout" env:"TEST_TIMEOUT"`
+	DB      struct {
+		Host     string `json:"host" env:"TEST_DB_HOST" flag:"db-host"`
+		Password string `json:"password" env:"TEST_DB_PASSWORD" secret:"true"`
+	} `json:"db"`
+}
+
+func defaults() *testConfig {
+	cfg := &testConfig{Listen: ":8080", PerPage: 50, Timeout: 5 * time.Second}
+	cfg.DB.Host = "localhost"
+	return cfg
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// load loads cfg from args, with the environment set to env.
+func load(t *testing.T, cfg *testConfig, env map[string]string, args ...string) (*Loader, error) {
+	t.Helper()
+	for _, key := range []string{"TEST_CONFIG", "TEST_LISTEN", "TEST_PER_PAGE", "TEST_TIMEOUT", "TEST_DB_HOST", "TEST_DB_PASSWORD"} {
+		t.Setenv(key, env[key])
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	l := New(fs, cfg, "TEST_CONFIG")
+	if err := fs.Parse(args); err != nil {
+		return l, err
+	}
+	return l, l.Load()
+}
+
+func TestDefaults(t *testing.T) {
+	cfg := defaults()
+	if _, err := load(t, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *cfg != *defaults() {
+		t.Errorf("got %+v, want the defaults", cfg)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, `{
+		"listen": ":1",
+		"per_page": 10,
+		"debug": true,
+		"timeout": "1m",
+		"db": {"host": "file", "password": "from-file"}
+	}`)
+
+	cfg := defaults()
+	env := map[string]string{"TEST_CONFIG": path, "TEST_LISTEN": ":2", "TEST_DB_HOST": "env"}
+	if _, err := load(t, cfg, env, "-listen", ":3"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaults()
+	want.Listen = ":3"
+	want.PerPage = 10
+	want.Debug = true
+	want.Timeout = time.Minute
+	want.DB.Host = "env"
+	want.DB.Password = "from-file"
+	if *cfg != *want {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestConfigFlagWinsOverEnv(t *testing.T) {
+	cfg := defaults()
+	env := map[string]string{"TEST_CONFIG": writeFile(t, `{"per_page": 1}`)}
+	if _, err := load(t, cfg, env, "-config", writeFile(t, `{"per_page": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PerPage != 2 {
+		t.Errorf("per_page = %d, want 2 from the -config file", cfg.PerPage)
+	}
+}
+
+func TestBoolFlag(t *testing.T) {
+	cfg := defaults()
+	if _, err := load(t, cfg, nil, "-debug"); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Debug {
+		t.Error("-debug alone does not set debug")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown setting", map[string]string{"TEST_CONFIG": writeFile(t, `{"db": {"hots": "x"}}`)}, nil, "unknown setting db.hots"},
+		{"wrong type in file", map[string]string{"TEST_CONFIG": writeFile(t, `{"per_page": "ten"}`)}, nil, `per_page: "ten" is not an integer`},
+		{"object for a value", map[string]string{"TEST_CONFIG": writeFile(t, `{"listen": {}}`)}, nil, "listen: want a string"},
+		{"bad JSON", map[string]string{"TEST_CONFIG": writeFile(t, `{`)}, nil, "unexpected EOF"},
+		{"missing file", nil, []string{"-config", "/nonexistent/config.json"}, "no such file"},
+		{"bad env", map[string]string{"TEST_TIMEOUT": "soon"}, nil, "$TEST_TIMEOUT: "},
+		{"bad flag", nil, []string{"-per-page", "x"}, `invalid value "x" for flag -per-page`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, defaults(), tt.env, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := defaults()
+	l, err := load(t, cfg, map[string]string{"TEST_DB_PASSWORD": "hunter2"}, "-print-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.PrintRequested() {
+		t.Error("-print-config is not reported")
+	}
+
+	var buf bytes.Buffer
+	if err := l.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "hunter2") || !strings.Contains(out, `"password": "`+Redacted+`"`) {
+		t.Errorf("the password is not redacted:\n%s", out)
+	}
+	if !strings.Contains(out, `"timeout": "5s"`) {
+		t.Errorf("the duration is not printed as in a config file:\n%s", out)
+	}
+
+	// what Print writes loads back, but for the secrets
+	path := writeFile(t, out)
+	again := defaults()
+	if _, err := load(t, again, map[string]string{"TEST_CONFIG": path}); err != nil {
+		t.Fatal(err)
+	}
+	again.DB.Password = cfg.DB.Password
+	if *again != *cfg {
+		t.Errorf("got %+v, want %+v", again, cfg)
+	}
+}
+
+func TestPrintLeavesEmptySecrets(t *testing.T) {
+	l, err := load(t, defaults(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	l.Print(&buf)
+	if !strings.Contains(buf.String(), `"password": ""`) {
+		t.Errorf("an empty password is shown as set:\n%s", buf.String())
+	}
+}
+
+func TestUsage(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	New(fs, defaults(), "TEST_CONFIG")
+	f := fs.Lookup("listen")
+	if f == nil {
+		t.Fatal("no -listen flag")
+	}
+	if f.DefValue != ":8080" || f.Usage != "address to listen on ($TEST_LISTEN)" {
+		t.Errorf("got default %q and usage %q", f.DefValue, f.Usage)
+	}
+	if fs.Lookup("timeout") != nil {
+		t.Error("a setting without flag tag has a flag")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Error codes of the error responses. Clients should branch on these rather
+// than on the message, which is meant for humans.
+const (
+	codeNotFound         = "not_found"
+	codeAlreadyFollowing = "already_following"
+	codeNotFollowing     = "not_following"
+	codeInvalidBody      = "invalid_body"
+	codeInvalidParameter = "invalid_parameter"
+	codeInternal         = "internal"
+)
+
+var errorStatuses = map[string]int{
+	codeNotFound:         http.StatusNotFound,
+	codeAlreadyFollowing: http.StatusConflict,
+	codeNotFollowing:     http.StatusConflict,
+	codeInvalidBody:      http.StatusUnprocessableEntity,
+	codeInvalidParameter: http.StatusUnprocessableEntity,
+	codeInternal:         http.StatusInternalServerError,
+}
+
+// ErrorResponse is the body of every non-2xx response.
+type ErrorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+func errorResponseWriter(w http.ResponseWriter, code, message string) {
+
+	status, ok := errorStatuses[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	errJSON, err := json.Marshal(ErrorResponse{
+		Code:  code,
+		Error: message,
+	})
+
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(errJSON)
+}
+
+// internalErrorResponseWriter logs err and responds with a generic message so
+// that driver errors are not exposed to clients.
+func internalErrorResponseWriter(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	errorResponseWriter(w, codeInternal, "internal server error")
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	errorResponseWriter(w, codeNotFound, r.Method+" "+r.URL.Path+" is not found")
+}
@@ -0,0 +1,97 @@
+// Package graceful runs the HTTP server of isuwitter and isutomo until
+// SIGTERM or SIGINT, then drains it: the server turns unready, keeps serving
+// for a delay so that load balancers stop sending it requests, stops
+// accepting connections and waits for the requests in flight to finish.
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server wraps an http.Server with the shutdown sequence.
+type Server struct {
+	HTTP *http.Server
+	// Delay is how long the server keeps serving once unready.
+	Delay time.Duration
+	// Timeout bounds the wait for the requests in flight, after which their
+	// connections are closed.
+	Timeout time.Duration
+
+	ready    int32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New returns a Server draining srv as set by delay and timeout.
+func New(srv *http.Server, delay, timeout time.Duration) *Server {
+	return &Server{HTTP: srv, Delay: delay, Timeout: timeout, stop: make(chan struct{})}
+}
+
+// Ready reports whether the server is serving and not shutting down.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// Stop starts the shutdown as a signal would. The server is unready once
+// Stop returns.
+func (s *Server) Stop() {
+	atomic.StoreInt32(&s.ready, 0)
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// ListenAndServe listens on s.HTTP.Addr and calls Serve.
+func (s *Server) ListenAndServe() error {
+	addr := s.HTTP.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves on ln until a signal or Stop, then drains the server. It
+// returns nil once all requests finished, or the error that ended serving
+// or draining.
+func (s *Server) Serve(ln net.Listener) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sig)
+
+	served := make(chan error, 1)
+	go func() { served <- s.HTTP.Serve(ln) }()
+	atomic.StoreInt32(&s.ready, 1)
+
+	select {
+	case err := <-served:
+		atomic.StoreInt32(&s.ready, 0)
+		return err
+	case <-sig:
+	case <-s.stop:
+	}
+
+	atomic.StoreInt32(&s.ready, 0)
+	time.Sleep(s.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	if err := s.HTTP.Shutdown(ctx); err != nil {
+		s.HTTP.Close()
+		<-served
+		return err
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
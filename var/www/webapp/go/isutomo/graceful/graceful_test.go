@@ -0,0 +1,125 @@
+package graceful
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// start serves h on a local port and returns the server, its URL and the
+// result of Serve.
+func start(t *testing.T, h http.Handler, delay, timeout time.Duration) (*Server, string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(&http.Server{Handler: h}, delay, timeout)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	for !s.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	return s, "http://" + ln.Addr().String(), done
+}
+
+func get(url string) (string, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestDrainsRequestsInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	})
+	s, url, done := start(t, h, 50*time.Millisecond, time.Second)
+
+	slow := make(chan string, 1)
+	go func() {
+		body, err := get(url + "/slow")
+		if err != nil {
+			body = err.Error()
+		}
+		slow <- body
+	}()
+	<-started
+
+	s.Stop()
+	if s.Ready() {
+		t.Error("still ready after Stop")
+	}
+	// requests are served during the delay
+	if body, err := get(url + "/"); err != nil || body != "ok" {
+		t.Errorf("during the delay got %q, %v", body, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Serve returned %v with a request in flight", err)
+	default:
+	}
+	if _, err := get(url + "/"); err == nil {
+		t.Error("a new request is served after the delay")
+	}
+
+	close(release)
+	if body := <-slow; body != "ok" {
+		t.Errorf("the request in flight got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	s, url, done := start(t, h, 0, 50*time.Millisecond)
+
+	go get(url)
+	<-started
+	s.Stop()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Serve returned %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve does not give up on the request in flight")
+	}
+}
+
+func TestServeError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	s := New(&http.Server{}, 0, time.Second)
+	if err := s.Serve(ln); err == nil {
+		t.Error("Serve on a closed listener returned nil")
+	}
+	if s.Ready() {
+		t.Error("ready after Serve failed")
+	}
+}
@@ -0,0 +1,157 @@
+// Package health serves the /healthz and /readyz endpoints of isuwitter and
+// isutomo. /healthz answers as long as the process serves HTTP; /readyz runs
+// the checks of the dependencies and answers 503 when one fails, with the
+// result and latency of every check in JSON.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports why a dependency is unusable, or nil when it is usable.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a check.
+type Result struct {
+	Status string `json:"status"`
+	// LatencyMS is how long the check took, in milliseconds.
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the body of /readyz. Status is StatusFail when any check failed.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the checks of /readyz.
+type Checker struct {
+	// Timeout bounds every check.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+// New returns a Checker without checks.
+func New(timeout time.Duration) *Checker {
+	return &Checker{Timeout: timeout}
+}
+
+// Add registers check under name, replacing a check of the same name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.checks {
+		if c.checks[i].name == name {
+			c.checks[i].check = check
+			return
+		}
+	}
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// Names returns the names of the checks, sorted.
+func (c *Checker) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, len(c.checks))
+	for i, nc := range c.checks {
+		names[i] = nc.name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs the checks concurrently and waits for all of them.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.Unlock()
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}(i, nc.check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	for i, nc := range checks {
+		report.Checks[nc.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// run runs check, giving up when ctx is done even if check does not.
+func run(ctx context.Context, check Check) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	res := Result{Status: StatusOK, LatencyMS: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// ReadyHandler serves the Report of Run, with 503 when it failed.
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// LiveHandler serves /healthz.
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,115 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func serve(h http.HandlerFunc) (int, Report) {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	json.Unmarshal(w.Body.Bytes(), &report)
+	return w.Code, report
+}
+
+func TestReady(t *testing.T) {
+	c := New(time.Second)
+	c.Add("mysql", func(ctx context.Context) error { return nil })
+	c.Add("redis", func(ctx context.Context) error { return nil })
+
+	code, report := serve(c.ReadyHandler)
+	if code != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("got %d %q, want 200 %q", code, report.Status, StatusOK)
+	}
+	if len(report.Checks) != 2 || report.Checks["mysql"].Status != StatusOK || report.Checks["redis"].Status != StatusOK {
+		t.Errorf("got checks %+v", report.Checks)
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	c := New(time.Second)
+	c.Add("mysql", func(ctx context.Context) error { return nil })
+	c.Add("redis", func(ctx context.Context) error { return errors.New("connection refused") })
+
+	code, report := serve(c.ReadyHandler)
+	if code != http.StatusServiceUnavailable || report.Status != StatusFail {
+		t.Errorf("got %d %q, want 503 %q", code, report.Status, StatusFail)
+	}
+	if got := report.Checks["redis"]; got.Status != StatusFail || got.Error != "connection refused" {
+		t.Errorf("got redis %+v", got)
+	}
+	if got := report.Checks["mysql"]; got.Status != StatusOK || got.Error != "" {
+		t.Errorf("got mysql %+v", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c := New(20 * time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	// a check ignoring its context still does not hold /readyz
+	c.Add("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+
+	start := time.Now()
+	report := c.Run(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run took %s", elapsed)
+	}
+	got := report.Checks["stuck"]
+	if got.Status != StatusFail || got.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("got %+v", got)
+	}
+	if got.LatencyMS < 20 {
+		t.Errorf("latency %vms is below the timeout", got.LatencyMS)
+	}
+}
+
+func TestChecksRunConcurrently(t *testing.T) {
+	c := New(time.Second)
+	for _, name := range []string{"a", "b", "c"} {
+		c.Add(name, func(ctx context.Context) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	}
+	start := time.Now()
+	c.Run(context.Background())
+	if elapsed := time.Since(start); elapsed > 140*time.Millisecond {
+		t.Errorf("Run took %s for three checks of 50ms", elapsed)
+	}
+}
+
+func TestAddReplaces(t *testing.T) {
+	c := New(time.Second)
+	c.Add("b", func(ctx context.Context) error { return errors.New("old") })
+	c.Add("a", func(ctx context.Context) error { return nil })
+	c.Add("b", func(ctx context.Context) error { return nil })
+
+	if got := c.Names(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got names %v", got)
+	}
+	if report := c.Run(context.Background()); report.Status != StatusOK {
+		t.Errorf("the replaced check still runs: %+v", report)
+	}
+}
+
+func TestLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	LiveHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}`+"\n" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+)
+
+// The friendships table holds one row per follow edge. It replaces the
+// comma-separated friends column, which is now only read to build it; the
+// friends table itself remains the list of users known to isutomo.
+const createFriendshipsTable = `CREATE TABLE IF NOT EXISTS friendships (
+	me VARCHAR(20) NOT NULL,
+	friend VARCHAR(20) NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	PRIMARY KEY (me, friend),
+	INDEX me_created_at (me, created_at),
+	INDEX friend_me (friend, me)
+) DEFAULT CHARSET=utf8mb4`
+
+// ensureSchema creates the friendships table and the unique index on
+// friends.me that lets ensureUser create rows without races. Seeding the
+// database recreates friends, so this is also run after it.
+func (db *DB) ensureSchema() error {
+	if _, err := db.Conn.Exec(createFriendshipsTable); err != nil {
+		return err
+	}
+	var exists int
+	err := db.Conn.QueryRow(`SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'friends' AND index_name = 'me'`).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+	_, err = db.Conn.Exec("CREATE UNIQUE INDEX me ON friends (me)")
+	return err
+}
+
+// errFriendshipsNotEmpty is returned by migrateFriendships instead of
+// mixing the friends column with the follows made since a migration.
+var errFriendshipsNotEmpty = errors.New("friendships is not empty: it is already migrated")
+
+// migrateFriendships builds friendships from the friends column. The
+// created_at of the edges of a user follow the order of the column, so that
+// friend lists keep their order. Names are canonicalized on the way, so the
+// friend lists of users whose names differ only in case are merged. An empty
+// friendships table is required; /initialize empties it with
+// resetFriendships first.
+func (db *DB) migrateFriendships() (int, error) {
+	if err := db.ensureSchema(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var migrated int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM friendships LIMIT 1) AS f").Scan(&migrated); err != nil {
+		return 0, err
+	}
+	if migrated > 0 {
+		return 0, errFriendshipsNotEmpty
+	}
+
+	rows, err := tx.Query("SELECT me, friends FROM friends ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	edges := map[string][]string{}
+	for rows.Next() {
+		var me string
+		var friends sql.NullString
+		if err := rows.Scan(&me, &friends); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		me = username.Canonical(me)
+		edges[me] = append(edges[me], strings.Split(friends.String, ",")...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if _, err := canonicalizeUsers(tx); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("INSERT IGNORE INTO friendships (me, friend, created_at) VALUES (?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	base := time.Now()
+	count := 0
+	for me, friends := range edges {
+		seen := map[string]bool{}
+		for i, friend := range friends {
+			friend = username.Canonical(friend)
+			if friend == "" || seen[friend] {
+				continue
+			}
+			seen[friend] = true
+			if _, err := stmt.Exec(me, friend, base.Add(time.Duration(i)*time.Microsecond)); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+
+	return count, tx.Commit()
+}
+
+// resetFriendships drops every follow, which the seed data replaces.
+func (db *DB) resetFriendships() error {
+	_, err := db.Conn.Exec("DELETE FROM friendships")
+	return err
+}
+
+// migrateUsernames rewrites the names in friends and friendships to their
+// canonical form. Users whose names only differ in case are merged into the
+// one created first, and an edge that appears under several spellings keeps
+// its oldest created_at. It returns the number of renamed or merged users
+// and the number of edges that changed.
+func (db *DB) migrateUsernames() (int, int, error) {
+	if err := db.ensureSchema(); err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	users, err := canonicalizeUsers(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	edges, err := canonicalizeFriendships(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return users, edges, tx.Commit()
+}
+
+// canonicalizeUsers renames the rows of friends to canonical names, deleting
+// all but the oldest row of each canonical name. Rows are addressed by id so
+// that it works whatever the collation of friends.me is.
+func canonicalizeUsers(tx *sql.Tx) (int, error) {
+	rows, err := tx.Query("SELECT id, me FROM friends ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	kept := map[string]bool{}
+	var duplicates []int64
+	renames := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var me string
+		if err := rows.Scan(&id, &me); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		canonical := username.Canonical(me)
+		switch {
+		case kept[canonical]:
+			duplicates = append(duplicates, id)
+		case canonical != me:
+			renames[id] = canonical
+			fallthrough
+		default:
+			kept[canonical] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// duplicates go first so that renaming does not hit the unique index
+	for _, id := range duplicates {
+		if _, err := tx.Exec("DELETE FROM friends WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	for id, me := range renames {
+		if _, err := tx.Exec("UPDATE friends SET me = ? WHERE id = ?", me, id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(duplicates) + len(renames), nil
+}
+
+// canonicalizeFriendships rebuilds friendships with canonical names if any
+// edge is not canonical yet.
+func canonicalizeFriendships(tx *sql.Tx) (int, error) {
+	type edge struct{ me, friend string }
+
+	rows, err := tx.Query("SELECT me, friend, created_at FROM friendships")
+	if err != nil {
+		return 0, err
+	}
+	createdAt := map[edge]time.Time{}
+	changed := 0
+	for rows.Next() {
+		var e edge
+		var t time.Time
+		if err := rows.Scan(&e.me, &e.friend, &t); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		c := edge{username.Canonical(e.me), username.Canonical(e.friend)}
+		if c != e {
+			changed++
+		}
+		if old, ok := createdAt[c]; !ok || t.Before(old) {
+			createdAt[c] = t
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if changed == 0 {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM friendships"); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO friendships (me, friend, created_at) VALUES (?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for e, t := range createdAt {
+		if _, err := stmt.Exec(e.me, e.friend, t); err != nil {
+			return 0, err
+		}
+	}
+
+	return changed, nil
+}
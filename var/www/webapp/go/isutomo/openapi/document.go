@@ -0,0 +1,367 @@
+package openapi
+
+// Document is the OpenAPI 3 description of the isutomo API. Keep it in sync
+// with NewRouter and the handlers; the tests of isutomo and of its client
+// validate their traffic against it.
+const Document = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "isutomo",
+    "description": "Follow graph of isuwitter users. User names are case-insensitive and returned in canonical form. The endpoints not about one user are under /_/, and the names _, initialize, healthz, readyz, lookup, batch and openapi.json are refused.",
+    "version": "1.0.0"
+  },
+  "servers": [
+    {"url": "http://localhost:8081"}
+  ],
+  "paths": {
+    "/initialize": {
+      "get": {
+        "operationId": "initialize",
+        "summary": "Reseed the database and rebuild the friendships table",
+        "responses": {
+          "200": {
+            "description": "Seeded",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/InitializeResult"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/_/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "This document",
+        "responses": {
+          "200": {
+            "description": "OpenAPI document",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          }
+        }
+      }
+    },
+    "/_/healthz": {
+      "get": {
+        "operationId": "healthz",
+        "summary": "Liveness of the process",
+        "responses": {
+          "200": {
+            "description": "Alive",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Live"}}}
+          }
+        }
+      }
+    },
+    "/_/readyz": {
+      "get": {
+        "operationId": "readyz",
+        "summary": "Readiness to serve, with the checks of the dependencies",
+        "responses": {
+          "200": {
+            "description": "Ready",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ready"}}}
+          },
+          "503": {
+            "description": "A check failed or the server is shutting down",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ready"}}}
+          }
+        }
+      }
+    },
+    "/_/lookup": {
+      "post": {
+        "operationId": "lookup",
+        "summary": "Relations between one user and many users",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LookupRequest"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "One relation per requested user, in request order",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LookupResult"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/_/batch": {
+      "post": {
+        "operationId": "batchFriends",
+        "summary": "Friend lists of many users",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Users"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "Friend lists keyed by the names as requested",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchFriends"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/{me}/followers": {
+      "parameters": [{"$ref": "#/components/parameters/Me"}],
+      "get": {
+        "operationId": "getFollowers",
+        "summary": "Users following me",
+        "responses": {
+          "200": {
+            "description": "Followers, oldest follow first",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Followers"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/{me}/following/{user}": {
+      "parameters": [{"$ref": "#/components/parameters/Me"}, {"$ref": "#/components/parameters/User"}],
+      "get": {
+        "operationId": "isFollowing",
+        "summary": "Whether me follows user",
+        "responses": {
+          "200": {
+            "description": "Follow state",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Following"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/{me}/mutual/{user}": {
+      "parameters": [{"$ref": "#/components/parameters/Me"}, {"$ref": "#/components/parameters/User"}],
+      "get": {
+        "operationId": "mutual",
+        "summary": "Relation between me and user and their common friends",
+        "responses": {
+          "200": {
+            "description": "Relation",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Mutual"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/{me}": {
+      "parameters": [{"$ref": "#/components/parameters/Me"}],
+      "get": {
+        "operationId": "getFriends",
+        "summary": "Users me follows",
+        "description": "Without query parameters the whole list is returned. With limit or cursor the list is paginated, and with count only its length is returned.",
+        "parameters": [
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000}},
+          {"name": "cursor", "in": "query", "schema": {"type": "string"}},
+          {"name": "count", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Friends, oldest follow first, or their count",
+            "content": {"application/json": {"schema": {"anyOf": [
+              {"$ref": "#/components/schemas/FriendsPage"},
+              {"$ref": "#/components/schemas/Count"}
+            ]}}}
+          },
+          "422": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "operationId": "follow",
+        "summary": "Make me follow user",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserRequest"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "Friends of me afterwards",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Friends"}}}
+          },
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "operationId": "provision",
+        "summary": "Create the record of me",
+        "responses": {
+          "200": {
+            "description": "Already existed",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Friends"}}}
+          },
+          "201": {
+            "description": "Created",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Friends"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "operationId": "unfollow",
+        "summary": "Make me unfollow user",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UserRequest"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "Friends of me afterwards",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Friends"}}}
+          },
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "Me": {"name": "me", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/Name"}},
+      "User": {"name": "user", "in": "path", "required": true, "schema": {"$ref": "#/components/schemas/Name"}}
+    },
+    "responses": {
+      "Error": {
+        "description": "Error",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Name": {"type": "string", "minLength": 1},
+      "Names": {"type": "array", "items": {"$ref": "#/components/schemas/Name"}},
+      "Error": {
+        "type": "object",
+        "required": ["code", "error"],
+        "properties": {
+          "code": {"type": "string", "enum": ["not_found", "already_following", "not_following", "invalid_body", "invalid_parameter", "internal"]},
+          "error": {"type": "string"}
+        }
+      },
+      "Live": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {"status": {"type": "string", "enum": ["ok"]}}
+      },
+      "Ready": {
+        "type": "object",
+        "required": ["status", "checks"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "fail"]},
+          "checks": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "required": ["status", "latency_ms"],
+              "properties": {
+                "status": {"type": "string", "enum": ["ok", "fail"]},
+                "latency_ms": {"type": "number", "minimum": 0},
+                "error": {"type": "string"}
+              }
+            }
+          }
+        }
+      },
+      "UserRequest": {
+        "type": "object",
+        "required": ["user"],
+        "properties": {"user": {"$ref": "#/components/schemas/Name"}}
+      },
+      "Users": {
+        "type": "object",
+        "required": ["users"],
+        "properties": {"users": {"type": "array", "maxItems": 1000, "items": {"$ref": "#/components/schemas/Name"}}}
+      },
+      "LookupRequest": {
+        "type": "object",
+        "required": ["users"],
+        "properties": {
+          "me": {"type": "string"},
+          "users": {"type": "array", "maxItems": 1000, "items": {"$ref": "#/components/schemas/Name"}}
+        }
+      },
+      "Friends": {
+        "type": "object",
+        "required": ["friends"],
+        "properties": {"friends": {"$ref": "#/components/schemas/Names"}}
+      },
+      "FriendsPage": {
+        "type": "object",
+        "required": ["friends"],
+        "properties": {
+          "friends": {"$ref": "#/components/schemas/Names"},
+          "next_cursor": {"type": "string", "description": "Cursor of the next page, absent on the last page"}
+        }
+      },
+      "Count": {
+        "type": "object",
+        "required": ["count"],
+        "properties": {"count": {"type": "integer", "minimum": 0}}
+      },
+      "Followers": {
+        "type": "object",
+        "required": ["followers"],
+        "properties": {"followers": {"$ref": "#/components/schemas/Names"}}
+      },
+      "Following": {
+        "type": "object",
+        "required": ["following"],
+        "properties": {"following": {"type": "boolean"}}
+      },
+      "Mutual": {
+        "type": "object",
+        "required": ["following", "followed_by", "mutual", "common_friends"],
+        "properties": {
+          "following": {"type": "boolean"},
+          "followed_by": {"type": "boolean"},
+          "mutual": {"type": "boolean"},
+          "common_friends": {"$ref": "#/components/schemas/Names"}
+        }
+      },
+      "Relation": {
+        "type": "object",
+        "required": ["user", "following", "followed_by", "following_count", "followers_count"],
+        "properties": {
+          "user": {"$ref": "#/components/schemas/Name"},
+          "following": {"type": "boolean"},
+          "followed_by": {"type": "boolean"},
+          "following_count": {"type": "integer", "minimum": 0},
+          "followers_count": {"type": "integer", "minimum": 0}
+        }
+      },
+      "LookupResult": {
+        "type": "object",
+        "required": ["users"],
+        "properties": {"users": {"type": "array", "items": {"$ref": "#/components/schemas/Relation"}}}
+      },
+      "BatchFriends": {
+        "type": "object",
+        "required": ["friends"],
+        "properties": {
+          "friends": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/Names"}}
+        }
+      },
+      "SeedStep": {
+        "type": "object",
+        "required": ["step", "rows_affected", "elapsed"],
+        "properties": {
+          "step": {"type": "string", "enum": ["seed", "migrate"]},
+          "statements": {"type": "integer", "minimum": 0},
+          "rows_affected": {"type": "integer", "minimum": 0},
+          "elapsed": {"type": "number", "minimum": 0}
+        }
+      },
+      "InitializeResult": {
+        "type": "object",
+        "required": ["result"],
+        "properties": {
+          "result": {"type": "array", "items": {"type": "string"}},
+          "progress": {"type": "array", "items": {"$ref": "#/components/schemas/SeedStep"}},
+          "elapsed": {"type": "number", "minimum": 0}
+        }
+      }
+    }
+  }
+}
+`
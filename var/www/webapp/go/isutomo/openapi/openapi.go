@@ -0,0 +1,143 @@
+// Package openapi holds the OpenAPI document of the isutomo API and a
+// validator that checks HTTP traffic against it.
+//
+// The validator understands the subset of OpenAPI 3 used by Document: path
+// templates, path and query parameters, JSON request and response bodies,
+// local $ref, and the type, properties, required, items,
+// additionalProperties, enum, anyOf, minLength, minimum, maximum and
+// maxItems schema keywords.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Spec is a parsed OpenAPI document.
+type Spec struct {
+	OpenAPI    string               `json:"openapi"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components struct {
+		Parameters map[string]*Parameter `json:"parameters"`
+		Responses  map[string]*Response  `json:"responses"`
+		Schemas    map[string]*Schema    `json:"schemas"`
+	} `json:"components"`
+}
+
+// PathItem holds the operations on a path.
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters"`
+	Get        *Operation   `json:"get"`
+	Post       *Operation   `json:"post"`
+	Put        *Operation   `json:"put"`
+	Delete     *Operation   `json:"delete"`
+}
+
+// Operation is a method on a path.
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a path or query parameter.
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody describes the body of a request.
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response describes the body of a response.
+type Response struct {
+	Ref     string                `json:"$ref"`
+	Content map[string]*MediaType `json:"content"`
+}
+
+// MediaType holds the schema of a body.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Items                *Schema            `json:"items"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Enum                 []interface{}      `json:"enum"`
+	AnyOf                []*Schema          `json:"anyOf"`
+	MinLength            *int               `json:"minLength"`
+	MaxItems             *int               `json:"maxItems"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+var (
+	loadOnce sync.Once
+	spec     *Spec
+	loadErr  error
+)
+
+// Load parses Document.
+func Load() (*Spec, error) {
+	loadOnce.Do(func() {
+		spec = new(Spec)
+		loadErr = json.Unmarshal([]byte(Document), spec)
+	})
+	return spec, loadErr
+}
+
+// Handler serves Document.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(Document))
+}
+
+func (p *PathItem) operation(method string) *Operation {
+	switch method {
+	case http.MethodGet:
+		return p.Get
+	case http.MethodPost:
+		return p.Post
+	case http.MethodPut:
+		return p.Put
+	case http.MethodDelete:
+		return p.Delete
+	}
+	return nil
+}
+
+func (s *Spec) parameter(p *Parameter) *Parameter {
+	if p.Ref != "" {
+		return s.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+func (s *Spec) response(r *Response) *Response {
+	if r.Ref != "" {
+		return s.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+func (s *Spec) schema(sc *Schema) *Schema {
+	for sc != nil && sc.Ref != "" {
+		sc = s.Components.Schemas[strings.TrimPrefix(sc.Ref, "#/components/schemas/")]
+	}
+	return sc
+}
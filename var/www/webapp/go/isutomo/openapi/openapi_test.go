@@ -0,0 +1,148 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDocumentRefs(t *testing.T) {
+	s, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(sc *Schema, where string)
+	check = func(sc *Schema, where string) {
+		if sc == nil {
+			return
+		}
+		if sc.Ref != "" && s.schema(sc) == nil {
+			t.Errorf("%s: dangling %s", where, sc.Ref)
+		}
+		for name, p := range sc.Properties {
+			check(p, where+"."+name)
+		}
+		for _, alt := range sc.AnyOf {
+			check(alt, where)
+		}
+		check(sc.Items, where+"[]")
+		check(sc.AdditionalProperties, where+"{}")
+	}
+	for name, sc := range s.Components.Schemas {
+		check(sc, name)
+	}
+
+	for path, item := range s.Paths {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+			op := item.operation(method)
+			if op == nil {
+				continue
+			}
+			where := method + " " + path
+			for _, p := range append(append([]*Parameter{}, item.Parameters...), op.Parameters...) {
+				if s.parameter(p) == nil {
+					t.Errorf("%s: dangling %s", where, p.Ref)
+				}
+			}
+			if op.RequestBody != nil {
+				for _, mt := range op.RequestBody.Content {
+					check(mt.Schema, where)
+				}
+			}
+			for status, r := range op.Responses {
+				if s.response(r) == nil {
+					t.Errorf("%s %s: dangling %s", where, status, r.Ref)
+					continue
+				}
+				for _, mt := range s.response(r).Content {
+					check(mt.Schema, where+" "+status)
+				}
+			}
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	s, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		path   string
+		valid  bool
+	}{
+		{http.MethodGet, "/alice", "", "/{me}", true},
+		{http.MethodGet, "/alice?limit=10&cursor=x", "", "/{me}", true},
+		{http.MethodGet, "/alice?limit=0", "", "/{me}", false},
+		{http.MethodGet, "/alice?limit=x", "", "/{me}", false},
+		{http.MethodPost, "/alice", `{"user":"bob"}`, "/{me}", true},
+		{http.MethodPost, "/alice", `{"user":""}`, "/{me}", false},
+		{http.MethodPost, "/alice", `{}`, "/{me}", false},
+		{http.MethodPost, "/alice", ``, "/{me}", false},
+		{http.MethodPost, "/_/lookup", `{"users":["a"]}`, "/_/lookup", true},
+		{http.MethodPost, "/_/lookup", `{"users":"a"}`, "/_/lookup", false},
+		{http.MethodGet, "/a%2Fb/following/c", "", "/{me}/following/{user}", true},
+		{http.MethodGet, "/a/b/c", "", "", false},
+		{http.MethodPatch, "/alice", "", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		route, err := s.ValidateRequest(r, []byte(tt.body))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s %s %s: got error %v, want valid=%v", tt.method, tt.target, tt.body, err, tt.valid)
+		}
+		if tt.path != "" && (route == nil || route.Path != tt.path) {
+			t.Errorf("%s %s: got route %+v, want %s", tt.method, tt.target, route, tt.path)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	s, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+		resp   string
+		valid  bool
+	}{
+		{http.MethodGet, "/alice", "", http.StatusOK, `{"friends":["bob"]}`, true},
+		{http.MethodGet, "/alice?count=1", "", http.StatusOK, `{"count":1}`, true},
+		{http.MethodGet, "/alice", "", http.StatusOK, `{"friends":"bob"}`, false},
+		{http.MethodGet, "/alice", "", http.StatusOK, `null`, false},
+		{http.MethodPost, "/alice", `{}`, http.StatusUnprocessableEntity, `{"code":"invalid_body","error":"user is required"}`, true},
+		{http.MethodPost, "/alice", `{}`, http.StatusOK, `{"friends":[]}`, false},
+		{http.MethodPost, "/alice", `{"user":"bob"}`, http.StatusConflict, `{"code":"oops","error":""}`, false},
+		{http.MethodPut, "/alice", "", http.StatusAccepted, ``, false},
+		{http.MethodGet, "/a/b/c", "", http.StatusNotFound, `{"code":"not_found","error":"not found"}`, true},
+		{http.MethodGet, "/a/b/c", "", http.StatusOK, `{}`, false},
+	}
+	for _, tt := range tests {
+		var errs []error
+		h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.resp))
+		}), func(err error) {
+			errs = append(errs, err)
+		})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if (len(errs) == 0) != tt.valid {
+			t.Errorf("%s %s %s -> %d %s: got %v, want valid=%v", tt.method, tt.target, tt.body, tt.status, tt.resp, errs, tt.valid)
+		}
+		if rec.Code != tt.status || rec.Body.String() != tt.resp {
+			t.Errorf("%s %s: response not passed through: %d %s", tt.method, tt.target, rec.Code, rec.Body)
+		}
+	}
+}
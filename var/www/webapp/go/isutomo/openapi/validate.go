@@ -0,0 +1,331 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route is an operation matched by a request.
+type Route struct {
+	Method     string
+	Path       string
+	Operation  *Operation
+	PathParams map[string]string
+
+	item *PathItem
+}
+
+// FindRoute returns the operation for method on the path of u. Literal path
+// segments take precedence over templated ones, so /initialize is not /{me}.
+func (s *Spec) FindRoute(method string, u *url.URL) (*Route, error) {
+	segments := strings.Split(u.EscapedPath(), "/")
+
+	var best *Route
+	bestLiterals := -1
+	for path, item := range s.Paths {
+		templ := strings.Split(path, "/")
+		if len(templ) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		literals := 0
+		matched := true
+		for i, t := range templ {
+			if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+				v, err := url.PathUnescape(segments[i])
+				if err != nil || v == "" {
+					matched = false
+					break
+				}
+				params[t[1:len(t)-1]] = v
+				continue
+			}
+			if t != segments[i] {
+				matched = false
+				break
+			}
+			literals++
+		}
+		if matched && literals > bestLiterals {
+			best = &Route{Method: method, Path: path, PathParams: params, item: item}
+			bestLiterals = literals
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("%s is not in the spec", u.Path)
+	}
+	best.Operation = best.item.operation(method)
+	if best.Operation == nil {
+		return nil, fmt.Errorf("%s %s is not in the spec", method, best.Path)
+	}
+	return best, nil
+}
+
+// ValidateRequest checks the parameters and body of r against the spec. The
+// route is returned whenever the operation exists, even if the request is
+// invalid.
+func (s *Spec) ValidateRequest(r *http.Request, body []byte) (*Route, error) {
+	route, err := s.FindRoute(r.Method, r.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	params := append([]*Parameter{}, route.item.Parameters...)
+	params = append(params, route.Operation.Parameters...)
+	query := r.URL.Query()
+	for _, p := range params {
+		p = s.parameter(p)
+		var raw string
+		var ok bool
+		switch p.In {
+		case "path":
+			raw, ok = route.PathParams[p.Name]
+		case "query":
+			if vs, found := query[p.Name]; found {
+				raw, ok = vs[0], true
+			}
+		}
+		if !ok {
+			if p.Required {
+				return route, fmt.Errorf("%s parameter %s is required", p.In, p.Name)
+			}
+			continue
+		}
+		v, err := s.parseParameter(p.Schema, raw)
+		if err != nil {
+			return route, fmt.Errorf("%s parameter %s: %v", p.In, p.Name, err)
+		}
+		if err := s.validate(p.Schema, v, p.Name); err != nil {
+			return route, err
+		}
+	}
+
+	rb := route.Operation.RequestBody
+	if rb == nil {
+		return route, nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if rb.Required {
+			return route, fmt.Errorf("request body is required")
+		}
+		return route, nil
+	}
+	mt, ok := rb.Content["application/json"]
+	if !ok {
+		return route, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return route, fmt.Errorf("request body: %v", err)
+	}
+	if err := s.validate(mt.Schema, v, "body"); err != nil {
+		return route, fmt.Errorf("request %v", err)
+	}
+	return route, nil
+}
+
+// ValidateResponse checks that status is declared for the operation and
+// that body matches its schema.
+func (s *Spec) ValidateResponse(route *Route, status int, body []byte) error {
+	resp, ok := route.Operation.Responses[strconv.Itoa(status)]
+	if !ok {
+		resp, ok = route.Operation.Responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("status %d is not declared", status)
+	}
+	resp = s.response(resp)
+	mt, ok := resp.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("response body %q: %v", body, err)
+	}
+	if err := s.validate(mt.Schema, v, "body"); err != nil {
+		return fmt.Errorf("response %v", err)
+	}
+	return nil
+}
+
+// Middleware validates the traffic of next and passes every violation to
+// report. A request that violates the spec is only reported when next
+// accepts it, since rejecting invalid requests is what the server should do.
+// Requests to paths that are not in the spec must be answered with 404 or
+// 405.
+func (s *Spec) Middleware(next http.Handler, report func(error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		route, reqErr := s.ValidateRequest(r, body)
+
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		where := r.Method + " " + r.URL.RequestURI()
+		switch {
+		case route == nil:
+			if rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+				report(fmt.Errorf("%s: %v, but got %d", where, reqErr, rec.Code))
+			}
+		default:
+			if reqErr != nil && rec.Code < 400 {
+				report(fmt.Errorf("%s: invalid request accepted with %d: %v", where, rec.Code, reqErr))
+			}
+			if err := s.ValidateResponse(route, rec.Code, rec.Body.Bytes()); err != nil {
+				report(fmt.Errorf("%s: %v", where, err))
+			}
+		}
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+}
+
+func (s *Spec) parseParameter(sc *Schema, raw string) (interface{}, error) {
+	sc = s.schema(sc)
+	if sc == nil {
+		return raw, nil
+	}
+	switch sc.Type {
+	case "integer", "number":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", raw)
+		}
+		return f, nil
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", raw)
+		}
+		return b, nil
+	}
+	return raw, nil
+}
+
+// validate checks v, as decoded by encoding/json, against sc.
+func (s *Spec) validate(sc *Schema, v interface{}, path string) error {
+	sc = s.schema(sc)
+	if sc == nil {
+		return nil
+	}
+
+	if len(sc.AnyOf) > 0 {
+		var errs []string
+		for _, alt := range sc.AnyOf {
+			err := s.validate(alt, v, path)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s matches no alternative: %s", path, strings.Join(errs, "; "))
+	}
+
+	if len(sc.Enum) > 0 {
+		found := false
+		for _, e := range sc.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, sc.Enum)
+		}
+	}
+
+	switch sc.Type {
+	case "":
+		return nil
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return typeError(path, sc.Type, v)
+		}
+		if sc.MinLength != nil && len([]rune(str)) < *sc.MinLength {
+			return fmt.Errorf("%s: %q is shorter than %d", path, str, *sc.MinLength)
+		}
+	case "integer", "number":
+		f, ok := v.(float64)
+		if !ok || (sc.Type == "integer" && f != float64(int64(f))) {
+			return typeError(path, sc.Type, v)
+		}
+		if sc.Minimum != nil && f < *sc.Minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, f, *sc.Minimum)
+		}
+		if sc.Maximum != nil && f > *sc.Maximum {
+			return fmt.Errorf("%s: %v is greater than %v", path, f, *sc.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return typeError(path, sc.Type, v)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return typeError(path, sc.Type, v)
+		}
+		if sc.MaxItems != nil && len(items) > *sc.MaxItems {
+			return fmt.Errorf("%s: %d items exceed %d", path, len(items), *sc.MaxItems)
+		}
+		for i, item := range items {
+			if err := s.validate(sc.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return typeError(path, sc.Type, v)
+		}
+		for _, name := range sc.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: %s is required", path, name)
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := sc.Properties[k]
+			if !ok {
+				prop = sc.AdditionalProperties
+			}
+			if err := s.validate(prop, obj[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported schema type %q", path, sc.Type)
+	}
+	return nil
+}
+
+func typeError(path, want string, v interface{}) error {
+	if v == nil {
+		return fmt.Errorf("%s: got null, want %s", path, want)
+	}
+	return fmt.Errorf("%s: got %T, want %s", path, v, want)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// A cursor points right after the edge with the given created_at and friend,
+// the sort key of friend lists.
+func encodeCursor(createdAt time.Time, friend string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "\t" + friend))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	s := strings.SplitN(string(b), "\t", 2)
+	if len(s) != 2 {
+		return time.Time{}, "", errInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, s[0])
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	return createdAt.In(time.Local), s[1], nil
+}
+
+// fetchFriendsPage returns up to limit friends of user after cursor, and the
+// cursor of the next page or "" on the last page.
+func (db *DB) fetchFriendsPage(ctx context.Context, user string, limit int, cursor string) ([]string, string, error) {
+
+	query := "SELECT friend, created_at FROM friendships WHERE me = ?"
+	args := []interface{}{user}
+
+	if cursor != "" {
+		createdAt, friend, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += " AND (created_at > ? OR (created_at = ? AND friend > ?))"
+		args = append(args, createdAt, createdAt, friend)
+	}
+
+	query += " ORDER BY created_at, friend LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Conn.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	friends := []string{}
+	var last time.Time
+	next := ""
+	for rows.Next() {
+		var friend string
+		var createdAt time.Time
+		if err := rows.Scan(&friend, &createdAt); err != nil {
+			return nil, "", err
+		}
+		if len(friends) == limit {
+			next = encodeCursor(last, friends[len(friends)-1])
+			break
+		}
+		friends = append(friends, friend)
+		last = createdAt
+	}
+
+	return friends, next, rows.Err()
+}
+
+func (db *DB) countFriends(ctx context.Context, user string) (int, error) {
+
+	var n int
+
+	err := db.Conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM friendships WHERE me = ?", user).Scan(&n)
+
+	return n, err
+}
+
+// fetchFriendsBatch returns the friend lists of users in a single query.
+func (db *DB) fetchFriendsBatch(ctx context.Context, users []string) (map[string][]string, error) {
+
+	result := map[string][]string{}
+	args := make([]interface{}, len(users))
+	for i, u := range users {
+		result[u] = []string{}
+		args[i] = u
+	}
+
+	if len(users) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Conn.QueryContext(ctx, "SELECT me, friend FROM friendships WHERE me IN ("+placeholders(len(users))+") ORDER BY created_at, friend", args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var me, friend string
+		if err := rows.Scan(&me, &friend); err != nil {
+			return nil, err
+		}
+		result[me] = append(result[me], friend)
+	}
+
+	return result, rows.Err()
+}
+
+// getUserPageHandler serves GET /{me} when it has a count, limit or cursor
+// query parameter.
+func getUserPageHandler(w http.ResponseWriter, r *http.Request) {
+
+	me := userVar(r, "me")
+	query := r.URL.Query()
+
+	if query.Get("count") != "" {
+		n, err := conn.countFriends(r.Context(), me)
+		if err != nil {
+			internalErrorResponseWriter(w, r, err)
+			return
+		}
+		jsonResponseWriter(w, r, struct {
+			Count int `json:"count"`
+		}{
+			Count: n,
+		})
+		return
+	}
+
+	limit := defaultPageLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			errorResponseWriter(w, codeInvalidParameter, "limit must be between 1 and "+strconv.Itoa(maxPageLimit))
+			return
+		}
+	}
+
+	friends, next, err := conn.fetchFriendsPage(r.Context(), me, limit, query.Get("cursor"))
+
+	if err == errInvalidCursor {
+		errorResponseWriter(w, codeInvalidParameter, err.Error())
+		return
+	}
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	jsonResponseWriter(w, r, struct {
+		Friends    []string `json:"friends"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+	}{
+		Friends:    friends,
+		NextCursor: next,
+	})
+}
+
+func postBatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := struct {
+		Users []string `json:"users"`
+	}{}
+
+	err := JSONUnmarshaler(r.Body, &data)
+
+	if err != nil {
+		errorResponseWriter(w, codeInvalidBody, "invalid request body: "+err.Error())
+		return
+	}
+
+	if len(data.Users) > maxLookupUsers {
+		errorResponseWriter(w, codeInvalidBody, "too many users")
+		return
+	}
+
+	users := make([]string, len(data.Users))
+	for i, u := range data.Users {
+		users[i] = username.Canonical(u)
+	}
+
+	canonical, err := conn.fetchFriendsBatch(r.Context(), users)
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	// the lists are keyed by the names as requested
+	friends := make(map[string][]string, len(data.Users))
+	for i, u := range data.Users {
+		friends[u] = canonical[users[i]]
+	}
+
+	jsonResponseWriter(w, r, struct {
+		Friends map[string][]string `json:"friends"`
+	}{
+		Friends: friends,
+	})
+}
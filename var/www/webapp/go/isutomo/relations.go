@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+)
+
+// Relation describes how the requesting user and User are related.
+type Relation struct {
+	User           string `json:"user"`
+	Following      bool   `json:"following"`
+	FollowedBy     bool   `json:"followed_by"`
+	FollowingCount int    `json:"following_count"`
+	FollowersCount int    `json:"followers_count"`
+}
+
+func placeholders(n int) string {
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+func (db *DB) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+
+	rows, err := db.Conn.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+
+	return result, rows.Err()
+}
+
+// fetchFollowers returns the users following user, using the friend_me index.
+func (db *DB) fetchFollowers(ctx context.Context, user string) ([]string, error) {
+	return db.queryStrings(ctx, "SELECT me FROM friendships WHERE friend = ? ORDER BY created_at", user)
+}
+
+func (db *DB) isFollowing(ctx context.Context, me, user string) (bool, error) {
+
+	var n int
+
+	err := db.Conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM friendships WHERE me = ? AND friend = ?", me, user).Scan(&n)
+
+	return n > 0, err
+}
+
+// fetchCommonFriends returns the users both a and b follow.
+func (db *DB) fetchCommonFriends(ctx context.Context, a, b string) ([]string, error) {
+	return db.queryStrings(ctx, `SELECT x.friend FROM friendships x
+		JOIN friendships y ON y.friend = x.friend AND y.me = ?
+		WHERE x.me = ? ORDER BY x.created_at`, b, a)
+}
+
+// fetchRelations returns the relation of me with every user in users with a
+// fixed number of queries. me may be empty to only get the counts.
+func (db *DB) fetchRelations(ctx context.Context, me string, users []string) ([]Relation, error) {
+
+	relations := make([]Relation, len(users))
+	index := map[string][]int{}
+	args := make([]interface{}, len(users))
+	for i, u := range users {
+		relations[i].User = u
+		index[u] = append(index[u], i)
+		args[i] = u
+	}
+
+	if len(users) == 0 {
+		return relations, nil
+	}
+
+	in := placeholders(len(users))
+
+	if me != "" {
+		following, err := db.queryStrings(ctx, "SELECT friend FROM friendships WHERE me = ? AND friend IN ("+in+")", append([]interface{}{me}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range following {
+			for _, i := range index[u] {
+				relations[i].Following = true
+			}
+		}
+
+		followedBy, err := db.queryStrings(ctx, "SELECT me FROM friendships WHERE friend = ? AND me IN ("+in+")", append([]interface{}{me}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range followedBy {
+			for _, i := range index[u] {
+				relations[i].FollowedBy = true
+			}
+		}
+	}
+
+	counts := []struct {
+		query string
+		set   func(r *Relation, n int)
+	}{
+		{"SELECT me, COUNT(*) FROM friendships WHERE me IN (" + in + ") GROUP BY me", func(r *Relation, n int) { r.FollowingCount = n }},
+		{"SELECT friend, COUNT(*) FROM friendships WHERE friend IN (" + in + ") GROUP BY friend", func(r *Relation, n int) { r.FollowersCount = n }},
+	}
+	for _, c := range counts {
+		rows, err := db.Conn.QueryContext(ctx, c.query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var u string
+			var n int
+			if err := rows.Scan(&u, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			for _, i := range index[u] {
+				c.set(&relations[i], n)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return relations, nil
+}
+
+func jsonResponseWriter(w http.ResponseWriter, r *http.Request, v interface{}) {
+
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func getFollowersHandler(w http.ResponseWriter, r *http.Request) {
+
+	me := userVar(r, "me")
+
+	followers, err := conn.fetchFollowers(r.Context(), me)
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	jsonResponseWriter(w, r, struct {
+		Followers []string `json:"followers"`
+	}{
+		Followers: followers,
+	})
+}
+
+func getFollowingHandler(w http.ResponseWriter, r *http.Request) {
+
+	following, err := conn.isFollowing(r.Context(), userVar(r, "me"), userVar(r, "user"))
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	jsonResponseWriter(w, r, struct {
+		Following bool `json:"following"`
+	}{
+		Following: following,
+	})
+}
+
+func getMutualHandler(w http.ResponseWriter, r *http.Request) {
+
+	a, b := userVar(r, "me"), userVar(r, "user")
+
+	relations, err := conn.fetchRelations(r.Context(), a, []string{b})
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	common, err := conn.fetchCommonFriends(r.Context(), a, b)
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	jsonResponseWriter(w, r, struct {
+		Following     bool     `json:"following"`
+		FollowedBy    bool     `json:"followed_by"`
+		Mutual        bool     `json:"mutual"`
+		CommonFriends []string `json:"common_friends"`
+	}{
+		Following:     relations[0].Following,
+		FollowedBy:    relations[0].FollowedBy,
+		Mutual:        relations[0].Following && relations[0].FollowedBy,
+		CommonFriends: common,
+	})
+}
+
+// maxLookupUsers bounds the size of the IN clauses of a lookup.
+const maxLookupUsers = 1000
+
+func postLookupHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := struct {
+		Me    string   `json:"me"`
+		Users []string `json:"users"`
+	}{}
+
+	err := JSONUnmarshaler(r.Body, &data)
+
+	if err != nil {
+		errorResponseWriter(w, codeInvalidBody, "invalid request body: "+err.Error())
+		return
+	}
+
+	if len(data.Users) > maxLookupUsers {
+		errorResponseWriter(w, codeInvalidBody, "too many users")
+		return
+	}
+
+	users := make([]string, len(data.Users))
+	for i, u := range data.Users {
+		users[i] = username.Canonical(u)
+	}
+
+	relations, err := conn.fetchRelations(r.Context(), username.Canonical(data.Me), users)
+
+	if err != nil {
+		internalErrorResponseWriter(w, r, err)
+		return
+	}
+
+	jsonResponseWriter(w, r, struct {
+		Users []Relation `json:"users"`
+	}{
+		Users: relations,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultSeedFile is where the seed lives relative to the isutomo binary,
+// which is built in webapp/go/isutomo.
+const defaultSeedFile = "../../sql/seed_isutomo.sql"
+
+// seedFilePath returns the seed_file setting, or the default seed resolved
+// against the directory of the executable so that it does not depend on the
+// working directory.
+func seedFilePath() string {
+	if cfg.SeedFile != "" {
+		return cfg.SeedFile
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return defaultSeedFile
+	}
+	return filepath.Join(filepath.Dir(exe), defaultSeedFile)
+}
+
+// SeedStep reports one phase of initialization.
+type SeedStep struct {
+	Step         string  `json:"step"`
+	Statements   int     `json:"statements,omitempty"`
+	RowsAffected int64   `json:"rows_affected"`
+	Elapsed      float64 `json:"elapsed"`
+}
+
+// seed executes the SQL file at path in a single transaction. LOCK TABLES
+// and UNLOCK TABLES, which mysqldump emits, are skipped since they cannot be
+// used inside a transaction. Note that MySQL commits implicitly before DDL
+// statements, so only the data statements are atomic.
+func (db *DB) seed(path string) (SeedStep, error) {
+	step := SeedStep{Step: "seed"}
+	start := time.Now()
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return step, err
+	}
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return step, err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitSQL(src) {
+		keyword := strings.ToUpper(strings.Join(strings.Fields(stmt), " "))
+		if strings.HasPrefix(keyword, "LOCK TABLES") || strings.HasPrefix(keyword, "UNLOCK TABLES") {
+			continue
+		}
+		res, err := tx.Exec(stmt)
+		if err != nil {
+			return step, err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			step.RowsAffected += n
+		}
+		step.Statements++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return step, err
+	}
+
+	step.Elapsed = time.Since(start).Seconds()
+	return step, nil
+}
+
+// splitSQL splits a SQL script into statements separated by semicolons,
+// skipping "--", "#" and "/* */" comments and ignoring semicolons in quoted
+// strings and identifiers. Version comments ("/*! ... */") are kept since
+// MySQL executes them. DELIMITER is not supported.
+func splitSQL(src []byte) []string {
+	var stmts []string
+	var buf bytes.Buffer
+
+	flush := func() {
+		if s := strings.TrimSpace(buf.String()); s != "" {
+			stmts = append(stmts, s)
+		}
+		buf.Reset()
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			j := i + 1
+			for ; j < len(src); j++ {
+				if src[j] == '\\' && c != '`' {
+					j++
+					continue
+				}
+				if src[j] == c {
+					break
+				}
+			}
+			if j >= len(src) {
+				j = len(src) - 1
+			}
+			buf.Write(src[i : j+1])
+			i = j
+		case c == '#' || (c == '-' && i+1 < len(src) && src[i+1] == '-' && (i+2 == len(src) || src[i+2] == ' ' || src[i+2] == '\t' || src[i+2] == '\n')):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			buf.WriteByte('\n')
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			j := len(src)
+			if end >= 0 {
+				j = i + 2 + end + 2
+			}
+			if i+2 < len(src) && src[i+2] == '!' {
+				buf.Write(src[i:j])
+			} else {
+				buf.WriteByte(' ')
+			}
+			i = j - 1
+		case c == ';':
+			flush()
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+
+	return stmts
+}
@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+)
+
+// FileSpan is a span as the file exporter writes it.
+type FileSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Service    string                 `json:"service"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Start      time.Time              `json:"start"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+type fileExporter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewFileExporter returns an exporter writing the spans to w as FileSpan
+// JSON lines, which jq and the like can aggregate offline. Shutdown closes w
+// if it is an io.Closer.
+func NewFileExporter(w io.Writer) sdktrace.SpanExporter {
+	return &fileExporter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (e *fileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range spans {
+		if err := e.enc.Encode(fileSpan(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func fileSpan(s sdktrace.ReadOnlySpan) FileSpan {
+	fs := FileSpan{
+		TraceID:    s.SpanContext().TraceID().String(),
+		SpanID:     s.SpanContext().SpanID().String(),
+		Name:       s.Name(),
+		Kind:       s.SpanKind().String(),
+		Start:      s.StartTime(),
+		DurationMS: float64(s.EndTime().Sub(s.StartTime())) / float64(time.Millisecond),
+		Error:      s.Status().Description,
+	}
+	if s.Parent().IsValid() {
+		fs.ParentID = s.Parent().SpanID().String()
+	}
+	if service, ok := s.Resource().Set().Value(semconv.ServiceNameKey); ok {
+		fs.Service = service.AsString()
+	}
+	if attrs := s.Attributes(); len(attrs) > 0 {
+		fs.Attributes = make(map[string]interface{}, len(attrs))
+		for _, kv := range attrs {
+			fs.Attributes[string(kv.Key)] = attributeValue(kv.Value)
+		}
+	}
+	return fs
+}
+
+func attributeValue(v attribute.Value) interface{} {
+	switch v.Type() {
+	case attribute.BOOL:
+		return v.AsBool()
+	case attribute.INT64:
+		return v.AsInt64()
+	case attribute.FLOAT64:
+		return v.AsFloat64()
+	default:
+		return v.Emit()
+	}
+}
@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenDB is sql.Open with a span for every statement run with a context
+// carrying a span, as QueryContext and ExecContext are. The span lasts until
+// the statement returns, not until its rows are read.
+func OpenDB(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	var c driver.Connector = dsnConnector{driver: drv, dsn: dsn}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if c, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(Connector(c, driverName)), nil
+}
+
+// Connector wraps c as OpenDB wraps a driver, system naming the database in
+// the spans.
+func Connector(c driver.Connector, system string) driver.Connector {
+	return &connector{Connector: c, system: system}
+}
+
+type connector struct {
+	driver.Connector
+	system string
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn, system: c.system}, nil
+}
+
+// dsnConnector is the connector of a driver without one.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// tracedConn forwards to Conn what it implements. QueryContext and
+// ExecContext fall back to the context-less Queryer and Execer of older
+// drivers, and answer driver.ErrSkip, making database/sql prepare the
+// statement, when Conn has neither.
+type tracedConn struct {
+	driver.Conn
+	system string
+}
+
+func (c *tracedConn) start(ctx context.Context, op, query string) (context.Context, trace.Span) {
+	return Start(ctx, "sql "+op, semconv.DBSystemKey.String(c.system), semconv.DBStatementKey.String(query))
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, hasContext := c.Conn.(driver.QueryerContext)
+	plain, hasPlain := c.Conn.(driver.Queryer)
+	if !hasContext && !hasPlain {
+		return nil, driver.ErrSkip
+	}
+
+	ctx, span := c.start(ctx, "query", query)
+	var rows driver.Rows
+	var err error
+	if hasContext {
+		rows, err = queryer.QueryContext(ctx, query, args)
+	} else if values, verr := namedValues(args); verr != nil {
+		err = verr
+	} else {
+		rows, err = plain.Query(query, values)
+	}
+	End(span, skipped(err))
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, hasContext := c.Conn.(driver.ExecerContext)
+	plain, hasPlain := c.Conn.(driver.Execer)
+	if !hasContext && !hasPlain {
+		return nil, driver.ErrSkip
+	}
+
+	ctx, span := c.start(ctx, "exec", query)
+	var res driver.Result
+	var err error
+	if hasContext {
+		res, err = execer.ExecContext(ctx, query, args)
+	} else if values, verr := namedValues(args); verr != nil {
+		err = verr
+	} else {
+		res, err = plain.Exec(query, values)
+	}
+	End(span, skipped(err))
+	return res, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("tracing: the driver does not support transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if ch, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return ch.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// tracedStmt traces the prepared statements database/sql falls back to.
+type tracedStmt struct {
+	driver.Stmt
+	conn  *tracedConn
+	query string
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, span := s.conn.start(ctx, "query", s.query)
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else if values, verr := namedValues(args); verr != nil {
+		err = verr
+	} else {
+		rows, err = s.Stmt.Query(values)
+	}
+	End(span, err)
+	return rows, err
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, span := s.conn.start(ctx, "exec", s.query)
+	var res driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else if values, verr := namedValues(args); verr != nil {
+		err = verr
+	} else {
+		res, err = s.Stmt.Exec(values)
+	}
+	End(span, err)
+	return res, err
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.conn.CheckNamedValue(nv)
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("tracing: the driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// skipped hides driver.ErrSkip, with which a driver declines a statement
+// that database/sql then prepares, from the span.
+func skipped(err error) error {
+	if err == driver.ErrSkip {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+// Package tracing sets up OpenTelemetry for isuwitter and isutomo: the
+// tracer provider exporting to an OTLP collector or to a file, the W3C trace
+// context propagated over HTTP between the two, and spans for incoming
+// requests, outgoing requests and SQL statements.
+//
+// Spans other than the request spans are only created under a request span,
+// so that background jobs and calls without a context stay out of the traces.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The exporters Setup accepts.
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+const instrumentationName = "github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+
+// Options configures Setup.
+type Options struct {
+	// Service names the process in the spans.
+	Service string
+	// Exporter is ExporterNone, ExporterOTLP or ExporterFile.
+	Exporter string
+	// Endpoint is the host:port of the OTLP/HTTP collector.
+	Endpoint string
+	// File is where ExporterFile appends the spans, one JSON object a line.
+	File string
+}
+
+// Setup installs the tracer provider and the propagator. The returned
+// function flushes the spans not exported yet; call it before exiting.
+func Setup(ctx context.Context, o Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch o.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(o.Endpoint), otlptracehttp.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	case ExporterFile:
+		f, err := os.OpenFile(o.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter = NewFileExporter(f)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", o.Exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(o.Service))),
+		// isutomo follows the decision of isuwitter
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span named name under the span of ctx. When ctx has no
+// span, it returns ctx and a span that records nothing.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler starts a span for every request h serves, continuing the trace of
+// the caller.
+func Handler(h http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(h, operation)
+}
+
+// SetRoute names the request span of ctx after the route the request
+// matched, such as "GET /{user}".
+func SetRoute(ctx context.Context, method, route string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRouteKey.String(route))
+}
+
+// Transport wraps base so that the requests it sends get a span and carry
+// the trace context. Requests whose context has no span are sent as is.
+func Transport(base http.RoundTripper, peer string) http.RoundTripper {
+	traced := otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return peer + " " + r.Method
+	}))
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if !trace.SpanContextFromContext(r.Context()).IsValid() {
+			return base.RoundTrip(r)
+		}
+		return traced.RoundTrip(r)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
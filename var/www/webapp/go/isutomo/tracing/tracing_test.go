@@ -0,0 +1,223 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// record installs a tracer provider keeping the ended spans.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	saved, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(saved)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+	return recorder
+}
+
+func names(spans []sdktrace.ReadOnlySpan) []string {
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// fakeDriver answers every statement with no rows. Its connections
+// implement QueryerContext and ExecerContext unless prepareOnly.
+type fakeDriver struct{ prepareOnly bool }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	if d.prepareOnly {
+		return fakeConn{}, nil
+	}
+	return fakeContextConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeContextConn struct{ fakeConn }
+
+func (fakeContextConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return fakeRows{}, nil
+}
+
+func (fakeContextConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error                                    { return nil }
+func (fakeStmt) NumInput() int                                   { return -1 }
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(1), nil }
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error)  { return fakeRows{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string              { return []string{"x"} }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("tracingtest", fakeDriver{})
+	sql.Register("tracingtest-prepare", fakeDriver{prepareOnly: true})
+}
+
+func TestSQL(t *testing.T) {
+	for _, name := range []string{"tracingtest", "tracingtest-prepare"} {
+		t.Run(name, func(t *testing.T) {
+			recorder := record(t)
+			db, err := OpenDB(name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// no span without a parent
+			if _, err := db.Exec("UPDATE t SET x = 1"); err != nil {
+				t.Fatal(err)
+			}
+			if got := recorder.Ended(); len(got) != 0 {
+				t.Fatalf("got spans %v without a parent", names(got))
+			}
+
+			ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+			rows, err := db.QueryContext(ctx, "SELECT x FROM t WHERE y = ?", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows.Close()
+			if _, err := db.ExecContext(ctx, "UPDATE t SET x = ?", 2); err != nil {
+				t.Fatal(err)
+			}
+			parent.End()
+
+			spans := recorder.Ended()
+			if len(spans) != 3 || spans[0].Name() != "sql query" || spans[1].Name() != "sql exec" {
+				t.Fatalf("got spans %v", names(spans))
+			}
+			if spans[0].Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Error("the query span is not a child of the request span")
+			}
+			var statement string
+			for _, kv := range spans[0].Attributes() {
+				if kv.Key == "db.statement" {
+					statement = kv.Value.AsString()
+				}
+			}
+			if statement != "SELECT x FROM t WHERE y = ?" {
+				t.Errorf("got db.statement %q", statement)
+			}
+		})
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	recorder := record(t)
+
+	var serverSpan trace.SpanContext
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRoute(r.Context(), r.Method, "/{me}")
+		serverSpan = trace.SpanContextFromContext(r.Context())
+	}), "isutomo"))
+	defer server.Close()
+	client := &http.Client{Transport: Transport(http.DefaultTransport, "isutomo")}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/alice", nil)
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	parent.End()
+
+	if serverSpan.TraceID() != parent.SpanContext().TraceID() {
+		t.Fatal("the server did not continue the trace of the client")
+	}
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		byName[s.Name()] = s
+	}
+	call, served := byName["isutomo GET"], byName["GET /{me}"]
+	if call == nil || served == nil {
+		t.Fatalf("got spans %v", names(recorder.Ended()))
+	}
+	if call.Parent().SpanID() != parent.SpanContext().SpanID() || served.Parent().SpanID() != call.SpanContext().SpanID() {
+		t.Error("the spans are not nested request > call > served")
+	}
+
+	// a request without a span is not traced by the transport
+	before := len(recorder.Ended())
+	res, err = client.Get(server.URL + "/bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	spans := recorder.Ended()[before:]
+	if len(spans) != 1 || spans[0].Parent().IsValid() {
+		t.Errorf("got spans %v, want only the root server span", names(spans))
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	var buf bytes.Buffer
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(NewFileExporter(&buf)))
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	_, child := provider.Tracer("test").Start(ctx, "sql query")
+	child.End()
+	parent.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(&buf)
+	var spans []FileSpan
+	for dec.More() {
+		var s FileSpan
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+	if len(spans) != 2 || spans[0].Name != "sql query" || spans[1].Name != "request" {
+		t.Fatalf("got %+v", spans)
+	}
+	if spans[0].ParentID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID || spans[1].ParentID != "" {
+		t.Errorf("the parent links are wrong: %+v", spans)
+	}
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Options{Service: "test", Exporter: "zipkin"}); err == nil {
+		t.Error("Setup accepted an unknown exporter")
+	}
+}
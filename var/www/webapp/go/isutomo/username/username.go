@@ -0,0 +1,49 @@
+// Package username defines how isuwitter and isutomo compare user names.
+//
+// User names are case-insensitive and insensitive to Unicode normalization:
+// "Alice", "ALICE" and "alice" are the same user, as are a precomposed "é"
+// and "e" followed by a combining acute accent. Every name is stored and
+// used as a key in its canonical form, which is the NFC normalization of its
+// Unicode full case folding.
+package username
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Canonical returns the canonical form of name.
+func Canonical(name string) string {
+	return norm.NFC.String(cases.Fold().String(norm.NFC.String(name)))
+}
+
+// IsCanonical reports whether name is already in canonical form.
+func IsCanonical(name string) bool {
+	return Canonical(name) == name
+}
+
+// Prefix is the first path segment of the endpoints of isutomo that are not
+// about one user, such as /_/healthz. No user can be named after it.
+const Prefix = "_"
+
+// reserved holds the names that would make the path of a user look like
+// the one of an endpoint.
+var reserved = map[string]bool{
+	Prefix:         true,
+	"initialize":   true,
+	"healthz":      true,
+	"readyz":       true,
+	"lookup":       true,
+	"batch":        true,
+	"openapi.json": true,
+}
+
+// Reserved reports whether name cannot be a user name.
+func Reserved(name string) bool {
+	return reserved[Canonical(name)]
+}
+
+// Equal reports whether a and b name the same user.
+func Equal(a, b string) bool {
+	return Canonical(a) == Canonical(b)
+}
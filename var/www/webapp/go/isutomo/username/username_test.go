@@ -0,0 +1,52 @@
+package username
+
+import "testing"
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"ALICE", "alice"},
+		{"Straße", "strasse"},
+		{"Café", "café"},
+		{"Cafe\u0301", "café"},
+		{"İstanbul", "i̇stanbul"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Canonical(tt.name); got != tt.want {
+			t.Errorf("Canonical(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if !IsCanonical(Canonical(tt.name)) {
+			t.Errorf("Canonical(%q) is not canonical", tt.name)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !Equal("Alice", "aLICE") {
+		t.Error(`"Alice" and "aLICE" are not equal`)
+	}
+	if !Equal("Café", "CAFÉ") {
+		t.Error("normalization forms are not equal")
+	}
+	if Equal("alice", "alicia") {
+		t.Error(`"alice" and "alicia" are equal`)
+	}
+}
+
+func TestReserved(t *testing.T) {
+	for _, name := range []string{"_", "healthz", "Readyz", "LOOKUP", "batch", "initialize", "openapi.json"} {
+		if !Reserved(name) {
+			t.Errorf("%q is not reserved", name)
+		}
+	}
+	for _, name := range []string{"alice", "_alice", "healthz2"} {
+		if Reserved(name) {
+			t.Errorf("%q is reserved", name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/settings"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	// accessLog receives a line per request in the with_time format of
+	// nginx.conf, which kataribe.toml parses, when set.
+	accessLog   io.Writer
+	accessLogMu sync.Mutex
+)
+
+// newLogger builds the application log described by c.
+func newLogger(c settings.LogConfig) (*zap.Logger, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, err
+	}
+	zc := zap.NewProductionConfig()
+	if c.Development {
+		zc = zap.NewDevelopmentConfig()
+	}
+	zc.Level = zap.NewAtomicLevelAt(level)
+	return zc.Build()
+}
+
+// requestLog is what the handlers tell logRequests about the request they
+// serve.
+type requestLog struct {
+	// user is the name of the logged-in user as the handler resolved it.
+	user string
+	// cache is the result of the home cache lookup, if any.
+	cache string
+	// route is the template of the route the request matched.
+	route string
+}
+
+type requestLogKey struct{}
+
+// requestLogOf returns the requestLog of r, or one nobody reads when r is
+// not served through logRequests.
+func requestLogOf(r *http.Request) *requestLog {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		return rl
+	}
+	return &requestLog{}
+}
+
+// requestID returns the ID nginx gave r in X-Request-ID, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// logRequests logs every request to logger and, when set, to accessLog. The
+// request ID is echoed in X-Request-ID.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		rl := &requestLog{route: "unknown"}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+
+		fields := []zap.Field{
+			zap.String("method", r.Method),
+			zap.String("route", rl.route),
+			zap.Int("status", rec.status),
+			zap.Int("bytes", rec.bytes),
+			zap.Duration("duration", elapsed),
+			zap.String("request_id", id),
+		}
+		if rl.user != "" {
+			fields = append(fields, zap.String("user", rl.user))
+		}
+		if rl.cache != "" {
+			fields = append(fields, zap.String("cache", rl.cache))
+		}
+		logger.Info("request", fields...)
+
+		if accessLog != nil {
+			line := accessLogLine(r, rec.status, rec.bytes, start, elapsed)
+			accessLogMu.Lock()
+			defer accessLogMu.Unlock()
+			if _, err := io.WriteString(accessLog, line); err != nil {
+				logger.Error("access log", zap.Error(err))
+			}
+		}
+	})
+}
+
+// accessLogLine formats a request as nginx does with
+//
+//	'$remote_addr - $remote_user [$time_local] "$request" $status
+//	$body_bytes_sent "$http_referer" "$http_user_agent" $request_time'
+func accessLogLine(r *http.Request, status, bytes int, start time.Time, elapsed time.Duration) string {
+	addr := escapeLog(remoteAddr(r))
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = escapeLog(u)
+	}
+	return fmt.Sprintf(
+		"%s - %s [%s] \"%s\" %d %d \"%s\" \"%s\" %.3f\n",
+		addr, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLog(r.Method+" "+r.RequestURI+" "+r.Proto),
+		status, bytes,
+		orDash(escapeLog(r.Referer())), orDash(escapeLog(r.UserAgent())),
+		elapsed.Seconds(),
+	)
+}
+
+// remoteAddr returns the address of the client, which nginx passes in
+// X-Real-IP or X-Forwarded-For since the connection comes from nginx itself.
+func remoteAddr(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return addr
+}
+
+// escapeLog escapes s as nginx escapes variables in a log: quotes,
+// backslashes and bytes outside printable ASCII become \xHH.
+func escapeLog(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&b, `\x%02X`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
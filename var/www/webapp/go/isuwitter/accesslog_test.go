@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// kataribeFormat is log_format of kataribe.toml.
+var kataribeFormat = regexp.MustCompile(`^([^ ]+) ([^ ]+) ([^ ]+) \[([^\]]+)\] "((?:\\"|[^"])*)" (\d+) (\d+|-) "((?:\\"|[^"])*)" "((?:\\"|[^"])*)" ([0-9.]+)$`)
+
+func TestRequestLog(t *testing.T) {
+	h := newHarness(t)
+	core, logs := observer.New(zapcore.InfoLevel)
+	var access bytes.Buffer
+	savedLogger, savedAccessLog := logger, accessLog
+	logger, accessLog = zap.New(core), &access
+	defer func() { logger, accessLog = savedLogger, savedAccessLog }()
+
+	alice := h.login("alice")
+	alice.get("/")
+	alice.get("/")
+	req, err := http.NewRequest(http.MethodDelete, h.server.URL+"/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.do(req).Body.Close()
+
+	entries := logs.FilterMessage("request").AllUntimed()
+	if len(entries) != 4 {
+		t.Fatalf("got %d request logs, want 4", len(entries))
+	}
+	login, home := entries[0].ContextMap(), entries[2].ContextMap()
+	if login["route"] != "/login" || login["user"] != "alice" || login["status"] != int64(http.StatusFound) {
+		t.Errorf("login: got %v", login)
+	}
+	if home["route"] != "/" || home["user"] != "alice" || home["cache"] != "hit" || home["bytes"].(int64) == 0 {
+		t.Errorf("home: got %v", home)
+	}
+	if id, _ := home["request_id"].(string); len(id) != 32 {
+		t.Errorf("got request ID %q", id)
+	}
+	if _, ok := entries[1].ContextMap()["cache"]; !ok {
+		t.Error("the first home is not logged with its cache lookup")
+	}
+	if unmatched := entries[3].ContextMap(); unmatched["route"] != "unknown" || unmatched["status"] != int64(http.StatusMethodNotAllowed) {
+		t.Errorf("unmatched: got %v", unmatched)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(access.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d access log lines, want 4", len(lines))
+	}
+	m := kataribeFormat.FindStringSubmatch(lines[2])
+	if m == nil {
+		t.Fatalf("kataribe cannot parse %q", lines[2])
+	}
+	if m[5] != "GET / HTTP/1.1" || m[6] != "200" || m[7] != strconv.FormatInt(home["bytes"].(int64), 10) {
+		t.Errorf("got request %q, status %s, bytes %s", m[5], m[6], m[7])
+	}
+}
+
+func TestAccessLogLine(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, `/search?q="x"`, nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("User-Agent", "bench\n")
+	start := time.Date(2019, 6, 29, 10, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+
+	got := accessLogLine(r, 200, 1234, start, 12*time.Millisecond)
+	want := `192.0.2.1 - - [29/Jun/2019:10:00:00 +0900] "GET /search?q=\x22x\x22 HTTP/1.1" 200 1234 "-" "bench\x0A" 0.012` + "\n"
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if !kataribeFormat.MatchString(strings.TrimSuffix(got, "\n")) {
+		t.Error("kataribe cannot parse the line")
+	}
+
+	// behind nginx
+	r.RemoteAddr = "127.0.0.1:50000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	if got := accessLogLine(r, 200, 1234, start, 12*time.Millisecond); !strings.HasPrefix(got, "198.51.100.7 - ") {
+		t.Errorf("X-Forwarded-For: got %q", got)
+	}
+	r.Header.Set("X-Real-IP", "203.0.113.9")
+	if got := accessLogLine(r, 200, 1234, start, 12*time.Millisecond); !strings.HasPrefix(got, "203.0.113.9 - ") {
+		t.Errorf("X-Real-IP: got %q", got)
+	}
+}
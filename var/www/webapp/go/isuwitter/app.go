@@ -3,29 +3,33 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
 	"html"
-	"html/template"
 	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
-	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/config"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/graceful"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/settings"
 	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	"github.com/unrolled/render"
 	"go.uber.org/zap"
 )
 
@@ -47,52 +51,153 @@ type User struct {
 	Password string
 }
 
-const (
-	sessionName     = "isuwitter_session"
-	sessionSecret   = "isuwitter"
-	perPage         = 50
-	isutomoEndpoint = "http://localhost:8081"
-)
+const sessionName = "isuwitter_session"
 
 var (
-	re             *render.Render
 	rex            = regexp.MustCompile("#(\\S+)(\\s|$)")
-	store          *sessions.FilesystemStore
 	db             *sql.DB
 	errInvalidUser = errors.New("Invalid User")
 	redisClient    *redis.Client
+	isutomoClient  *client.Client
+	cfg            = settings.Default()
 	logger, _      = zap.NewDevelopment()
-
-	userIDuserName = make(map[int]string)
-	userNameuserID = make(map[string]int)
+	// clock stamps the entries of tweet-<name>, like NOW() does for MariaDB
+	clock = time.Now
+
+	// directoryMu guards the user directory, which initializeHandler fills
+	// while the handlers and the recommendation job read it
+	directoryMu sync.RWMutex
+	// userIDuserName holds the names users signed up with, which pages show;
+	// userIDcanonicalName their canonical forms, which key userNameuserID and
+	// Redis
+	userIDuserName      = make(map[int]string)
+	userIDcanonicalName = make(map[int]string)
+	userNameuserID      = make(map[string]int)
+	// directoryLoaded tells that loadDirectory has read every user once
+	directoryLoaded bool
 )
 
-func getuserID(name string) int {
-	_, i := getuserIDCtx(context.TODO(), name)
-	return i
-}
+// loadDirectory adds every user in MariaDB to the directory.
+func loadDirectory(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT * FROM users`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user := User{}
+		if err := rows.Scan(&user.ID, &user.Name, &user.Salt, &user.Password); err != nil {
+			return err
+		}
+		addUserToDirectory(user.ID, user.Name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-func getuserIDCtx(pctx context.Context, name string) (context.Context, int) {
-	ctx, task := trace.NewTask(pctx, "getuserID")
-	defer task.End()
+	directoryMu.Lock()
+	defer directoryMu.Unlock()
+	directoryLoaded = true
+	return nil
+}
 
-	return ctx, userNameuserID[name]
+// addUserToDirectory registers a user under the canonical form of name,
+// keeping name for display. When names collide, the user with the smallest ID
+// owns the name.
+func addUserToDirectory(id int, name string) {
+	directoryMu.Lock()
+	defer directoryMu.Unlock()
+
+	key := username.Canonical(name)
+	userIDuserName[id] = name
+	userIDcanonicalName[id] = key
+	if owner, ok := userNameuserID[key]; ok && owner != id {
+		logger.Warn("user name collision", zap.String("name", key), zap.Int("id", id), zap.Int("owner", owner))
+		if owner < id {
+			return
+		}
+	}
+	userNameuserID[key] = id
 }
 
+// getUserName returns the canonical name of a user, or "" if there is none.
+// Users created after initializeHandler loaded the directory are looked up in
+// MariaDB.
 func getUserName(id int) string {
-	_, s := getUserNameCtx(context.TODO(), id)
-	return s
+	directoryMu.RLock()
+	name, ok := userIDcanonicalName[id]
+	directoryMu.RUnlock()
+	if ok {
+		return name
+	}
+
+	if !loadUserToDirectory(`SELECT * FROM users WHERE id = ?`, id) {
+		return ""
+	}
+	directoryMu.RLock()
+	defer directoryMu.RUnlock()
+	return userIDcanonicalName[id]
 }
 
-func getUserNameCtx(pctx context.Context, id int) (context.Context, string) {
-	ctx, task := trace.NewTask(pctx, "getUserName")
-	defer task.End()
+// getDisplayName returns the name the user whose canonical name is name
+// signed up with, or name itself if there is no such user.
+func getDisplayName(name string) string {
+	id := getuserID(name)
+	directoryMu.RLock()
+	defer directoryMu.RUnlock()
+	if display, ok := userIDuserName[id]; ok {
+		return display
+	}
+	return name
+}
+
+// getuserID is the counterpart of getUserName.
+func getuserID(name string) int {
+	name = username.Canonical(name)
+	directoryMu.RLock()
+	id, ok := userNameuserID[name]
+	directoryMu.RUnlock()
+	if ok {
+		return id
+	}
+
+	if !loadUserToDirectory(`SELECT * FROM users WHERE name = ?`, name) {
+		return 0
+	}
+	directoryMu.RLock()
+	defer directoryMu.RUnlock()
+	return userNameuserID[name]
+}
 
-	return ctx, userIDuserName[id]
+// loadUserToDirectory adds the user query finds to the directory and reports
+// whether there was one.
+func loadUserToDirectory(query string, arg interface{}) bool {
+	user, err := findUser(query, arg)
+	if err != nil {
+		logger.Error("findUser", zap.Error(err), zap.Any("arg", arg))
+	}
+	if user == nil {
+		return false
+	}
+	addUserToDirectory(user.ID, user.Name)
+	return true
+}
+
+// findUser returns the user query finds, or nil if there is none.
+func findUser(query string, args ...interface{}) (*User, error) {
+	user := User{}
+	err := db.QueryRow(query, args...).Scan(&user.ID, &user.Name, &user.Salt, &user.Password)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-func redisTweetStore(userName string, text string) error {
-	err := redisClient.LPush("tweet-"+userName, time.Now().Format("2006-01-02 15:04:05")+"\t"+text).Err()
+func redisTweetStore(ctx context.Context, userName string, text string) error {
+	err := redisFor(ctx).LPush("tweet-"+userName, clock().Format("2006-01-02 15:04:05")+"\t"+text).Err()
 	if err != nil {
 		logger.Error(
 			"redisTweetStore",
@@ -104,16 +209,8 @@ func redisTweetStore(userName string, text string) error {
 	return err
 }
 
-func getHomeCache(name string) (string, error) {
-	return redisClient.Get("home-" + name).Result()
-}
-
-func updateHomeCache(name string, home string) error {
-	return redisClient.Set("home-"+name, home, 0).Err()
-}
-
-func clearHomeCache(name string) error {
-	return redisClient.Del("home-" + name).Err()
+func clearHomeCache(ctx context.Context, name string) error {
+	return redisFor(ctx).Del("home-" + name).Err()
 }
 
 func htmlify(tweet string) string {
@@ -129,7 +226,7 @@ func htmlify(tweet string) string {
 	return tweet
 }
 
-func initializeHandler(w http.ResponseWriter, r *http.Request) {
+func (a *app) initializeHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := db.Exec(`DELETE FROM tweets WHERE id > 100000`)
 	if err != nil {
 		badRequest(w)
@@ -141,31 +238,16 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 		badRequest(w)
 		return
 	}
-	{
-		rows, err := db.Query(`SELECT * FROM users`)
-		if err != nil {
-			badRequest(w)
-			return
-		}
-		defer rows.Close()
-		for rows.Next() {
-			user := User{}
-			err := rows.Scan(&user.ID, &user.Name, &user.Salt, &user.Password)
-			if err != nil {
-				badRequest(w)
-				return
-			}
-			userIDuserName[user.ID] = user.Name
-			userNameuserID[user.Name] = user.ID
-		}
+	if err := loadDirectory(r.Context()); err != nil {
+		badRequest(w)
+		return
 	}
 
-	resp, err := http.Get(fmt.Sprintf("%s/initialize", isutomoEndpoint))
-	if err != nil {
+	if err := isutomoClient.Initialize(r.Context()); err != nil {
+		logger.Error("isutomoClient.Initialize", zap.Error(err))
 		badRequest(w)
 		return
 	}
-	defer resp.Body.Close()
 
 	{
 		if err := exec.Command("systemctl", "stop", "redis").Run(); err != nil {
@@ -181,13 +263,13 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 			logger.Info("redis.Ping()", zap.String("result", res))
 		}
 
-		init, err := os.Open("/var/lib/redis/init.rdb")
+		init, err := os.Open(cfg.Redis.InitRDB)
 		if err != nil {
 			logger.Error("failed to open init.rdb", zap.Error(err))
 			return
 		}
 		defer init.Close()
-		dump, err := os.OpenFile("/var/lib/redis/dump.rdb", os.O_CREATE|os.O_WRONLY, 0644)
+		dump, err := os.OpenFile(cfg.Redis.DumpRDB, os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			logger.Error("failed to open dump.rdb", zap.Error(err))
 			return
@@ -202,7 +284,12 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	re.JSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	if err := backfillFollowers(r.Context()); err != nil {
+		badRequest(w)
+		return
+	}
+
+	a.render.JSON(w, http.StatusOK, map[string]string{"result": "ok"})
 }
 
 func initializeRedisHandler(w http.ResponseWriter, r *http.Request) {
@@ -228,7 +315,7 @@ func initializeRedisHandler(w http.ResponseWriter, r *http.Request) {
 				logger.Error("rows.Scan(&t.ID, &t.UserID, &t.Text, &t.CreatedAt)", zap.Error(err))
 				return
 			}
-			if err := redisTweetStore(getUserName(t.UserID), t.Text); err != nil {
+			if err := redisTweetStore(context.Background(), getUserName(t.UserID), t.Text); err != nil {
 				badRequest(w)
 				return
 			}
@@ -236,30 +323,36 @@ func initializeRedisHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	{
-		// copy friends table from MariaDB
-		rows, err := db.Query(`SELECT * FROM friends`)
+		// copy friendships table from MariaDB, a MULTI/EXEC per user
+		rows, err := db.Query(`SELECT me, friend FROM friendships ORDER BY me`)
 		if err != nil {
 			badRequest(w)
-			logger.Error("db.Query(`SELECT * FROM friends`)", zap.Error(err))
+			logger.Error("db.Query(`SELECT me, friend FROM friendships ORDER BY me`)", zap.Error(err))
 			return
 		}
+		var me string
+		var friends []string
 		for rows.Next() {
-			f := Friend{}
-			if err := rows.Scan(&f.ID, &f.Me, &f.Friends); err != nil {
+			f := Friendship{}
+			if err := rows.Scan(&f.Me, &f.Friend); err != nil {
 				badRequest(w)
-				logger.Error("db.Query(`SELECT * FROM friends`)", zap.Error(err))
+				logger.Error("db.Query(`SELECT me, friend FROM friendships ORDER BY me`)", zap.Error(err))
 				return
 			}
-			a := strings.Split(f.Friends, ",")
-			friends := make([]interface{}, len(a))
-			for i, s := range a {
-				friends[i] = s
-			}
-			if err := redisClient.SAdd("friends-"+f.Me, friends...).Err(); err != nil {
-				badRequest(w)
-				logger.Error("redis.SAdd", zap.Error(err), zap.String("user", f.Me))
-				return
+			if name := username.Canonical(f.Me); name != me {
+				if err := addFriends(context.Background(), me, friends); err != nil {
+					badRequest(w)
+					logger.Error("addFriends", zap.Error(err), zap.String("user", me))
+					return
+				}
+				me, friends = name, friends[:0]
 			}
+			friends = append(friends, username.Canonical(f.Friend))
+		}
+		if err := addFriends(context.Background(), me, friends); err != nil {
+			badRequest(w)
+			logger.Error("addFriends", zap.Error(err), zap.String("user", me))
+			return
 		}
 	}
 
@@ -271,13 +364,13 @@ func initializeRedisHandler(w http.ResponseWriter, r *http.Request) {
 
 	{
 		// cp dump.rdb init.rdb
-		dump, err := os.Open("/var/lib/redis/dump.rdb")
+		dump, err := os.Open(cfg.Redis.DumpRDB)
 		if err != nil {
 			logger.Error("failed to open init.rdb", zap.Error(err))
 			return
 		}
 		defer dump.Close()
-		init, err := os.OpenFile("/var/lib/redis/init.rdb", os.O_CREATE|os.O_WRONLY, 0644)
+		init, err := os.OpenFile(cfg.Redis.InitRDB, os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			logger.Error("failed to open dump.rdb", zap.Error(err))
 			return
@@ -289,33 +382,44 @@ func initializeRedisHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func topHandler(w http.ResponseWriter, r *http.Request) {
+func (a *app) topHandler(w http.ResponseWriter, r *http.Request) {
 	var name string
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	userID, ok := session.Values["user_id"]
 	if ok {
-		name = getUserName(userID.(int))
+		name = a.sessionUserName(r, userID.(int))
 	}
 	until := r.URL.Query().Get("until")
 
-	if cache, err := getHomeCache(name); err == nil {
-		w.Write([]byte(cache))
-		return
-	} else {
-		logger.Debug(
-			"cache miss",
-			zap.Error(err),
-			zap.String("name", name),
-		)
+	add := r.URL.Query().Get("append")
+	// only the first page of the home is cached
+	cacheable := until == "" && add == ""
+
+	if cacheable {
+		cache, err := a.tweets.HomeCache(r.Context(), name)
+		if name != "" {
+			observeHomeCache(err)
+			requestLogOf(r).cache = homeCacheResult(err)
+		}
+		if err == nil {
+			w.Write([]byte(cache))
+			return
+		} else {
+			logger.Debug(
+				"cache miss",
+				zap.Error(err),
+				zap.String("name", name),
+			)
+		}
 	}
 
 	if name == "" {
 		flush, _ := session.Values["flush"].(string)
-		session := getSession(w, r)
+		session := a.getSession(w, r)
 		session.Options = &sessions.Options{MaxAge: -1}
 		session.Save(r, w)
 
-		re.HTML(w, http.StatusOK, "index", struct {
+		a.render.HTML(w, http.StatusOK, "index", struct {
 			Name  string
 			Flush string
 		}{
@@ -325,60 +429,42 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var rows *sql.Rows
-	var err error
-	if until == "" {
-		rows, err = db.Query(`SELECT * FROM tweets ORDER BY created_at DESC`)
-	} else {
-		rows, err = db.Query(`SELECT * FROM tweets WHERE created_at < ? ORDER BY created_at DESC`, until)
-	}
-
+	result, err := a.follows.Friends(r.Context(), name)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
-			return
-		}
 		badRequest(w)
 		return
 	}
-	defer rows.Close()
 
-	_, result, err := loadFriends(context.TODO(), name)
+	hidden, err := a.loadHiddenUsers(r.Context(), name)
 	if err != nil {
 		badRequest(w)
 		return
 	}
 
-	tweets := make([]*Tweet, 0)
-	for rows.Next() {
-		t := Tweet{}
-		err := rows.Scan(&t.ID, &t.UserID, &t.HTML, &t.CreatedAt)
-		if err != nil && err != sql.ErrNoRows {
-			badRequest(w)
-			return
+	tweets, err := a.tweets.Scan(r.Context(), until, cfg.PerPage, func(t *Tweet) (bool, error) {
+		t.UserName = a.getUserName(t.UserID)
+		if t.UserName == "" {
+			return false, errInvalidUser
 		}
-		t.Time = t.CreatedAt.Format("2006-01-02 15:04:05")
 
-		t.UserName = getUserName(t.UserID)
-		if t.UserName == "" {
-			badRequest(w)
-			return
+		if hidden[t.UserName] {
+			return false, nil
 		}
 
 		for _, x := range result {
 			if x == t.UserName {
-				tweets = append(tweets, &t)
-				break
+				return true, nil
 			}
 		}
-		if len(tweets) == perPage {
-			break
-		}
+		return false, nil
+	})
+	if err != nil {
+		badRequest(w)
+		return
 	}
 
-	add := r.URL.Query().Get("append")
 	if add != "" {
-		re.HTML(w, http.StatusOK, "_tweets", struct {
+		a.render.HTML(w, http.StatusOK, "_tweets", struct {
 			Tweets []*Tweet
 		}{
 			tweets,
@@ -386,31 +472,40 @@ func topHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recommendations, err := a.loadRecommendations(r.Context(), name)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+
 	var buf bytes.Buffer
-	re.HTML(&buf, http.StatusOK, "index", struct {
-		Name   string
-		Tweets []*Tweet
+	a.render.HTML(&buf, http.StatusOK, "index", struct {
+		Name            string
+		Tweets          []*Tweet
+		Recommendations []Recommendation
 	}{
-		name, tweets,
+		name, tweets, recommendations,
 	})
-	if err := updateHomeCache(name, buf.String()); err != nil {
-		logger.Error(
-			"updateHomeCache",
-			zap.Error(err),
-			zap.String("name", name),
-		)
-		badRequest(w)
-		return
+	if cacheable {
+		if err := a.tweets.SetHomeCache(r.Context(), name, buf.String()); err != nil {
+			logger.Error(
+				"updateHomeCache",
+				zap.Error(err),
+				zap.String("name", name),
+			)
+			badRequest(w)
+			return
+		}
 	}
 	w.Write(buf.Bytes())
 }
 
-func tweetPostHandler(w http.ResponseWriter, r *http.Request) {
+func (a *app) tweetPostHandler(w http.ResponseWriter, r *http.Request) {
 	var name string
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	userID, ok := session.Values["user_id"]
 	if ok {
-		name = getUserName(userID.(int))
+		name = a.sessionUserName(r, userID.(int))
 		if name == "" {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
@@ -428,14 +523,18 @@ func tweetPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	text = htmlify(text)
 
-	_, err := db.Exec(`INSERT INTO tweets (user_id, text, created_at) VALUES (?, ?, NOW())`, userID, text)
-	redisTweetStore(getUserName(userID.(int)), text)
-	if err != nil {
+	if err := a.tweets.Post(r.Context(), userID.(int), name, text); err != nil {
 		badRequest(w)
 		return
 	}
 
-	if err := clearHomeCache(name); err != nil {
+	// the tweet shows up on the home of the followers
+	followers, err := a.follows.Followers(r.Context(), name)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	if err := a.tweets.ClearHomeCache(r.Context(), append(followers, name)...); err != nil {
 		logger.Error(
 			"clearHomeCache",
 			zap.Error(err),
@@ -448,41 +547,39 @@ func tweetPostHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	name := r.FormValue("name")
-	row := db.QueryRow(`SELECT * FROM users WHERE name = ?`, name)
-	user := User{}
-	err := row.Scan(&user.ID, &user.Name, &user.Salt, &user.Password)
-	if err != nil && err != sql.ErrNoRows {
+func (a *app) loginHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.users.Authenticate(r.FormValue("name"), r.FormValue("password"))
+	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
-	if err == sql.ErrNoRows || user.Password != fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+r.FormValue("password")))) {
-		session := getSession(w, r)
+	if user == nil {
+		session := a.getSession(w, r)
 		session.Values["flush"] = "ログインエラー"
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	session.Values["user_id"] = user.ID
 	session.Save(r, w)
+	requestLogOf(r).user = username.Canonical(user.Name)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
+func (a *app) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session := a.getSession(w, r)
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func followHandler(w http.ResponseWriter, r *http.Request) {
+func (a *app) followHandler(w http.ResponseWriter, r *http.Request) {
 	var userName string
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	userID, ok := session.Values["user_id"]
 	if ok {
-		u := getUserName(userID.(int))
+		u := a.sessionUserName(r, userID.(int))
 		if u == "" {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
@@ -493,45 +590,46 @@ func followHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonStr := `{"user":"` + r.FormValue("user") + `"}`
-	req, err := http.NewRequest(http.MethodPost, isutomoEndpoint+pathURIEscape("/"+userName), bytes.NewBuffer([]byte(jsonStr)))
+	user := username.Canonical(r.FormValue("user"))
 
+	blocked, err := a.isBlocking(r.Context(), user, userName)
 	if err != nil {
 		badRequest(w)
 		return
 	}
-
-	resp, err := http.DefaultClient.Do(req)
-
-	if err != nil || resp.StatusCode != 200 {
-		badRequest(w)
+	if blocked {
+		forbidden(w)
 		return
 	}
 
-	if err := clearHomeCache(userName); err != nil {
-		logger.Error(
-			"clearHomeCache",
-			zap.Error(err),
-			zap.String("name", userName),
-		)
+	protected, err := a.follows.IsProtected(r.Context(), user)
+	if err != nil {
 		badRequest(w)
 		return
 	}
+	if protected {
+		if err := a.follows.RequestFollow(r.Context(), userName, user); err != nil {
+			badRequest(w)
+			return
+		}
+		http.Redirect(w, r, "/"+user, http.StatusFound)
+		return
+	}
 
-	if err := addFriend(userName, r.FormValue("user")); err != nil {
-		badRequest(w)
+	if err := a.follows.Follow(r.Context(), userName, user); err != nil {
+		a.followErrorResponse(w, r, err)
 		return
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func unfollowHandler(w http.ResponseWriter, r *http.Request) {
+func (a *app) unfollowHandler(w http.ResponseWriter, r *http.Request) {
 	var userName string
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	userID, ok := session.Values["user_id"]
 	if ok {
-		u := getUserName(userID.(int))
+		u := a.sessionUserName(r, userID.(int))
 		if u == "" {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
@@ -542,47 +640,40 @@ func unfollowHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonStr := `{"user":"` + r.FormValue("user") + `"}`
-	req, err := http.NewRequest(http.MethodDelete, isutomoEndpoint+pathURIEscape("/"+userName), bytes.NewBuffer([]byte(jsonStr)))
-
-	if err != nil {
-		badRequest(w)
+	if err := a.follows.Unfollow(r.Context(), userName, username.Canonical(r.FormValue("user"))); err != nil {
+		a.followErrorResponse(w, r, err)
 		return
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
 
-	if err != nil || resp.StatusCode != 200 {
-		badRequest(w)
-		return
-	}
+var followErrorMessages = map[string]string{
+	client.CodeAlreadyFollowing: "すでにフォローしています",
+	client.CodeNotFollowing:     "フォローしていません",
+	client.CodeInvalidBody:      "フォローできないユーザーです",
+	client.CodeNotFound:         "ユーザーが見つかりません",
+}
 
-	if err := clearHomeCache(userName); err != nil {
-		logger.Error(
-			"clearHomeCache",
-			zap.Error(err),
-			zap.String("name", userName),
-		)
-		badRequest(w)
-		return
-	}
+// followPendingMessage is shown when a follow or unfollow is left to the outbox.
+const followPendingMessage = "処理中です。しばらくすると反映されます"
 
-	if err := removeFriend(userName, r.FormValue("user")); err != nil {
+// followErrorResponse shows the reason isutomo refused a follow or unfollow,
+// or that it is pending, on the user page, and responds 400 for any other
+// error.
+func (a *app) followErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	msg, ok := followErrorMessages[client.ErrorCode(err)]
+	if err == errFollowPending {
+		msg, ok = followPendingMessage, true
+	}
+	if !ok {
 		badRequest(w)
 		return
 	}
-
-	http.Redirect(w, r, "/", http.StatusFound)
-}
-
-func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, sessionName)
-
-	return session
-}
-
-func pathURIEscape(s string) string {
-	return (&url.URL{Path: s}).String()
+	session := a.getSession(w, r)
+	session.Values["flush"] = msg
+	session.Save(r, w)
+	http.Redirect(w, r, "/"+username.Canonical(r.FormValue("user")), http.StatusFound)
 }
 
 func badRequest(w http.ResponseWriter) {
@@ -590,34 +681,67 @@ func badRequest(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(code), code)
 }
 
-func userHandler(w http.ResponseWriter, r *http.Request) {
+func forbidden(w http.ResponseWriter) {
+	code := http.StatusForbidden
+	http.Error(w, http.StatusText(code), code)
+}
+
+func (a *app) userHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, task := trace.NewTask(r.Context(), "userHandler")
 	defer task.End()
 
 	var name string
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	sessionUID, ok := session.Values["user_id"]
 	if ok {
-		ctx, name = getUserNameCtx(ctx, sessionUID.(int))
+		ctx, name = a.getUserNameCtx(ctx, sessionUID.(int))
+		requestLogOf(r).user = name
 	} else {
 		name = ""
 	}
+	flush, _ := session.Values["flush"].(string)
+	if flush != "" {
+		delete(session.Values, "flush")
+		session.Save(r, w)
+	}
 
-	user := mux.Vars(r)["user"]
+	user := username.Canonical(mux.Vars(r)["user"])
 	mypage := user == name
 
 	var userID int
-	ctx, userID = getuserIDCtx(ctx, user)
+	ctx, userID = a.getuserIDCtx(ctx, user)
 	if userID == 0 {
 		http.NotFound(w, r)
 		return
 	}
 
+	if blocked, err := a.isBlocking(ctx, user, name); err != nil {
+		badRequest(w)
+		return
+	} else if blocked {
+		forbidden(w)
+		return
+	}
+
+	visible, err := a.canView(ctx, name, user)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	protected, err := a.follows.IsProtected(ctx, user)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+
 	isFriend := false
+	isMuted := false
+	isBlocked := false
+	isRequested := false
 	if name != "" {
 		var err error
 		result := []string{}
-		ctx, result, err = loadFriends(ctx, name)
+		result, err = a.follows.Friends(ctx, name)
 		if err != nil {
 			badRequest(w)
 			return
@@ -629,61 +753,38 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		}
-	}
-
-	until := r.URL.Query().Get("until")
-	var rows *sql.Rows
-	var err error
 
-	tweets := make([]*Tweet, 0)
-	if until == "" {
-		tctx, task := trace.NewTask(ctx, "LRange")
-		ctx = tctx
-		lRange, err := redisClient.LRange("tweet-"+user, 0, 50).Result()
-		defer task.End()
-		if err != nil {
+		if isMuted, err = a.follows.IsMuting(ctx, name, user); err != nil {
 			badRequest(w)
 			return
 		}
-		for _, tweet := range lRange {
-			splited := strings.SplitN(tweet, "\t", 2)
-			t := Tweet{}
-			t.Time = splited[0]
-			t.HTML = splited[1]
-			t.UserName = user
-			tweets = append(tweets, &t)
+		if isBlocked, err = a.isBlocking(ctx, name, user); err != nil {
+			badRequest(w)
+			return
 		}
-	} else {
-		rows, err = db.Query(`SELECT * FROM tweets WHERE user_id = ? AND created_at < ? ORDER BY created_at DESC`, userID, until)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.NotFound(w, r)
-				return
-			}
+		if isRequested, err = a.follows.HasRequestedFollow(ctx, name, user); err != nil {
 			badRequest(w)
 			return
 		}
-		defer rows.Close()
+	}
 
-		for rows.Next() {
-			t := Tweet{}
-			err := rows.Scan(&t.ID, &t.UserID, &t.HTML, &t.CreatedAt)
-			if err != nil && err != sql.ErrNoRows {
-				badRequest(w)
-				return
-			}
-			t.Time = t.CreatedAt.Format("2006-01-02 15:04:05")
-			t.UserName = user
-			tweets = append(tweets, &t)
-			if len(tweets) == perPage {
-				break
-			}
+	until := r.URL.Query().Get("until")
+
+	tweets := make([]*Tweet, 0)
+	if visible {
+		// protected tweets are only shown to approved followers
+		_, task := trace.NewTask(ctx, "UserTimeline")
+		tweets, err = a.tweets.UserTimeline(ctx, userID, user, until)
+		task.End()
+		if err != nil {
+			badRequest(w)
+			return
 		}
 	}
 
 	add := r.URL.Query().Get("append")
 	if add != "" {
-		re.HTML(w, http.StatusOK, "_tweets", struct {
+		a.render.HTML(w, http.StatusOK, "_tweets", struct {
 			Tweets []*Tweet
 		}{
 			tweets,
@@ -691,23 +792,37 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	re.HTML(w, http.StatusOK, "user", struct {
-		Name     string
-		User     string
-		Tweets   []*Tweet
-		IsFriend bool
-		Mypage   bool
+	following, followers, err := a.follows.CountFollows(ctx, user)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+
+	a.render.HTML(w, http.StatusOK, "user", struct {
+		Name        string
+		Flush       string
+		User        string
+		Tweets      []*Tweet
+		IsFriend    bool
+		IsMuted     bool
+		IsBlocked   bool
+		IsRequested bool
+		Protected   bool
+		Visible     bool
+		Mypage      bool
+		Following   int64
+		Followers   int64
 	}{
-		name, user, tweets, isFriend, mypage,
+		name, flush, user, tweets, isFriend, isMuted, isBlocked, isRequested, protected, visible, mypage, following, followers,
 	})
 }
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
+func (a *app) searchHandler(w http.ResponseWriter, r *http.Request) {
 	var name string
-	session := getSession(w, r)
+	session := a.getSession(w, r)
 	userID, ok := session.Values["user_id"]
 	if ok {
-		name = getUserName(userID.(int))
+		name = a.sessionUserName(r, userID.(int))
 	} else {
 		name = ""
 	}
@@ -718,49 +833,36 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	until := r.URL.Query().Get("until")
-	var rows *sql.Rows
-	var err error
-	if until == "" {
-		rows, err = db.Query(`SELECT * FROM tweets ORDER BY created_at DESC`)
-	} else {
-		rows, err = db.Query(`SELECT * FROM tweets WHERE created_at < ? ORDER BY created_at DESC`, until)
+
+	hidden, err := a.loadHiddenUsers(r.Context(), name)
+	if err != nil {
+		badRequest(w)
+		return
 	}
+	invisible, err := a.loadInvisibleUsers(r.Context(), name)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
-			return
-		}
 		badRequest(w)
 		return
 	}
-	defer rows.Close()
 
-	tweets := make([]*Tweet, 0)
-	for rows.Next() {
-		t := Tweet{}
-		err := rows.Scan(&t.ID, &t.UserID, &t.HTML, &t.CreatedAt)
-		if err != nil && err != sql.ErrNoRows {
-			badRequest(w)
-			return
-		}
-		t.Time = t.CreatedAt.Format("2006-01-02 15:04:05")
-		t.UserName = getUserName(t.UserID)
+	tweets, err := a.tweets.Scan(r.Context(), until, cfg.PerPage, func(t *Tweet) (bool, error) {
+		t.UserName = a.getUserName(t.UserID)
 		if t.UserName == "" {
-			badRequest(w)
-			return
+			return false, errInvalidUser
 		}
-		if strings.Index(t.HTML, query) != -1 {
-			tweets = append(tweets, &t)
-		}
-
-		if len(tweets) == perPage {
-			break
+		if hidden[t.UserName] || invisible[t.UserName] {
+			return false, nil
 		}
+		return strings.Index(t.HTML, query) != -1, nil
+	})
+	if err != nil {
+		badRequest(w)
+		return
 	}
 
 	add := r.URL.Query().Get("append")
 	if add != "" {
-		re.HTML(w, http.StatusOK, "_tweets", struct {
+		a.render.HTML(w, http.StatusOK, "_tweets", struct {
 			Tweets []*Tweet
 		}{
 			tweets,
@@ -768,7 +870,7 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	re.HTML(w, http.StatusOK, "search", struct {
+	a.render.HTML(w, http.StatusOK, "search", struct {
 		Name   string
 		Tweets []*Tweet
 		Query  string
@@ -813,85 +915,197 @@ func fileRead(fp string) []byte {
 	return buf
 }
 
-func main() {
-	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
-	}()
+// router wires the HTTP handlers of a.
+func (a *app) router() http.Handler {
+	r := mux.NewRouter()
+	r.Use(recordRoute)
+	r.HandleFunc("/initialize", a.initializeHandler).Methods("GET")
+	r.HandleFunc("/initialize_redis", initializeRedisHandler).Methods("GET")
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	l := r.PathPrefix("/login").Subrouter()
+	l.Methods("POST").HandlerFunc(a.loginHandler)
+	r.HandleFunc("/logout", a.logoutHandler)
 
-	host := os.Getenv("ISUWITTER_DB_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	port := os.Getenv("ISUWITTER_DB_PORT")
-	if port == "" {
-		port = "3306"
+	r.PathPrefix("/css/style.css").HandlerFunc(css)
+	r.PathPrefix("/js/script.js").HandlerFunc(js)
+
+	s := r.PathPrefix("/search").Subrouter()
+	s.Methods("GET").HandlerFunc(a.searchHandler)
+	t := r.PathPrefix("/hashtag/{tag}").Subrouter()
+	t.Methods("GET").HandlerFunc(a.searchHandler)
+
+	r.HandleFunc("/mute", a.muteHandler).Methods("POST")
+	r.HandleFunc("/unmute", a.unmuteHandler).Methods("POST")
+	r.HandleFunc("/block", a.blockHandler).Methods("POST")
+	r.HandleFunc("/unblock", a.unblockHandler).Methods("POST")
+	r.HandleFunc("/settings/protected", a.protectHandler).Methods("POST")
+	r.HandleFunc("/settings/{kind}", a.relationSettingsHandler).Methods("GET")
+	r.HandleFunc("/follow_requests", a.followRequestsHandler).Methods("GET")
+	r.HandleFunc("/follow_requests/approve", a.approveFollowRequestHandler).Methods("POST")
+	r.HandleFunc("/follow_requests/reject", a.rejectFollowRequestHandler).Methods("POST")
+
+	n := r.PathPrefix("/unfollow").Subrouter()
+	n.Methods("POST").HandlerFunc(a.unfollowHandler)
+	f := r.PathPrefix("/follow").Subrouter()
+	f.Methods("POST").HandlerFunc(a.followHandler)
+
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/users/{user}/following", a.apiFollowListHandler("following")).Methods("GET")
+	api.HandleFunc("/users/{user}/followers", a.apiFollowListHandler("followers")).Methods("GET")
+	api.HandleFunc("/recommendations", a.apiRecommendationsHandler).Methods("GET")
+
+	r.HandleFunc("/{user}/following", a.followListHandler("following")).Methods("GET")
+	r.HandleFunc("/{user}/followers", a.followListHandler("followers")).Methods("GET")
+
+	u := r.PathPrefix("/{user}").Subrouter()
+	u.Methods("GET").HandlerFunc(a.userHandler)
+
+	i := r.PathPrefix("/").Subrouter()
+	i.Methods("GET").HandlerFunc(a.topHandler)
+	i.Methods("POST").HandlerFunc(a.tweetPostHandler)
+
+	// outside of the router, so that requests matching no route are logged
+	// and counted too
+	return logRequests(instrumentHTTP(r))
+}
+
+func main() {
+	loader := config.New(flag.CommandLine, &cfg, settings.FileEnv)
+	reconcileMode := flag.Bool("reconcile", false, "compare follow state in isutomo, MariaDB and Redis, then exit")
+	repair := flag.Bool("repair", false, "with -reconcile, drain the outbox and rewrite MariaDB and Redis to match isutomo")
+	migrateUsernamesMode := flag.Bool("migrate-usernames", false, "rewrite user names in Redis and the outbox to their canonical form, then exit")
+	flag.Parse()
+
+	if err := loader.Load(); err != nil {
+		log.Fatalf("config: %s", err)
 	}
-	user := os.Getenv("ISUWITTER_DB_USER")
-	if user == "" {
-		user = "root"
+	err := cfg.Validate()
+	if loader.PrintRequested() {
+		// print even an invalid config, which is what it is for
+		loader.Print(os.Stdout)
+		if err == nil {
+			return
+		}
 	}
-	password := os.Getenv("ISUWITTER_DB_PASSWORD")
-	dbname := os.Getenv("ISUWITTER_DB_NAME")
-	if dbname == "" {
-		dbname = "isuwitter"
+	if err != nil {
+		log.Fatalf("config: %s", err)
 	}
 
-	var err error
-	db, err = sql.Open("mysql", fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&loc=Local&parseTime=true",
-		user, password, host, port, dbname,
-	))
+	logger, err = newLogger(cfg.Log)
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		log.Fatalf("logger: %s", err)
+	}
+	if cfg.Log.AccessLog != "" {
+		f, err := os.OpenFile(cfg.Log.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("access log: %s", err)
+		}
+		accessLog = f
 	}
 
-	store = sessions.NewFilesystemStore("", []byte(sessionSecret))
+	go func() {
+		log.Println(http.ListenAndServe(cfg.Internal, internalHandler(cfg.Pprof == cfg.Internal)))
+	}()
+	if cfg.Pprof != "" && cfg.Pprof != cfg.Internal {
+		go func() {
+			log.Println(http.ListenAndServe(cfg.Pprof, nil))
+		}()
+	}
 
-	re = render.New(render.Options{
-		Directory: "views",
-		Funcs: []template.FuncMap{
-			{
-				"raw": func(text string) template.HTML {
-					return template.HTML(text)
-				},
-				"add": func(a, b int) int { return a + b },
-			},
-		},
+	redisClient = redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
 	})
+	instrumentRedis(redisClient)
+	isutomoClient = client.New(cfg.Isutomo.Endpoint)
+	isutomoClient.Observe = observeIsutomo
+	isutomoClient.HTTPClient = &http.Client{Transport: tracing.Transport(http.DefaultTransport, "isutomo")}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/initialize", initializeHandler).Methods("GET")
-	r.HandleFunc("/initialize_redis", initializeRedisHandler).Methods("GET")
+	db, err = tracing.OpenDB("mysql", cfg.DB.DSN())
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+	}
+	instrumentDB(db)
 
-	l := r.PathPrefix("/login").Subrouter()
-	l.Methods("POST").HandlerFunc(loginHandler)
-	r.HandleFunc("/logout", logoutHandler)
+	if err := ensureOutbox(); err != nil {
+		log.Fatalf("Failed to create follow_outbox: %s.", err.Error())
+	}
 
-	r.PathPrefix("/css/style.css").HandlerFunc(css)
-	r.PathPrefix("/js/script.js").HandlerFunc(js)
+	if *reconcileMode {
+		diffs, err := reconcile(os.Stdout, *repair)
+		if err != nil {
+			log.Fatalf("reconcile: %s", err.Error())
+		}
+		log.Printf("reconcile: %d differences", diffs)
+		if diffs > 0 && !*repair {
+			os.Exit(1)
+		}
+		return
+	}
 
-	s := r.PathPrefix("/search").Subrouter()
-	s.Methods("GET").HandlerFunc(searchHandler)
-	t := r.PathPrefix("/hashtag/{tag}").Subrouter()
-	t.Methods("GET").HandlerFunc(searchHandler)
+	if *migrateUsernamesMode {
+		n, err := migrateUsernames(os.Stdout)
+		if err != nil {
+			log.Fatalf("migrate-usernames: %s", err.Error())
+		}
+		log.Printf("migrate-usernames: %d keys and entries rewritten", n)
+		return
+	}
 
-	n := r.PathPrefix("/unfollow").Subrouter()
-	n.Methods("POST").HandlerFunc(unfollowHandler)
-	f := r.PathPrefix("/follow").Subrouter()
-	f.Methods("POST").HandlerFunc(followHandler)
+	if err := loadDirectory(context.Background()); err != nil {
+		// the directory check of /readyz retries
+		logger.Error("loadDirectory", zap.Error(err))
+	}
 
-	u := r.PathPrefix("/{user}").Subrouter()
-	u.Methods("GET").HandlerFunc(userHandler)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Options("isuwitter"))
+	if err != nil {
+		log.Fatalf("tracing: %s", err)
+	}
 
-	i := r.PathPrefix("/").Subrouter()
-	i.Methods("GET").HandlerFunc(topHandler)
-	i.Methods("POST").HandlerFunc(tweetPostHandler)
+	a := newApp(sessions.NewFilesystemStore("", []byte(cfg.SessionSecret)))
+
+	ctx, stopLoops := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		a.recommendLoop(ctx)
+	}()
+	go func() {
+		defer loops.Done()
+		outboxLoop(ctx)
+	}()
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	srv := graceful.New(&http.Server{Addr: cfg.Listen, Handler: tracing.Handler(a.router(), "isuwitter")}, cfg.Shutdown.Delay, cfg.Shutdown.Timeout)
+	readiness.Add("server", func(ctx context.Context) error {
+		if !srv.Ready() {
+			return errShuttingDown
+		}
+		return nil
+	})
+	err = srv.ListenAndServe()
+	logger.Info("server stopped", zap.Error(err))
+
+	// the handlers are done; the loops may still write to MariaDB and Redis
+	stopLoops()
+	loops.Wait()
+	if err := redisClient.Close(); err != nil {
+		logger.Error("close Redis", zap.Error(err))
+	}
+	if err := db.Close(); err != nil {
+		logger.Error("close DB", zap.Error(err))
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Error("flush spans", zap.Error(err))
+	}
+	if c, ok := accessLog.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logger.Error("close access log", zap.Error(err))
+		}
+	}
+	logger.Sync()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
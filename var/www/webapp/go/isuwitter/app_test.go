@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// newTestApp serves an app backed by a memStore holding alice, bob and carol,
+// whose password is their name.
+func newTestApp(t *testing.T) (*memStore, *httptest.Server) {
+	t.Helper()
+
+	store := newMemStore()
+	for i, name := range []string{"alice", "bob", "carol"} {
+		store.AddUser(i+1, name, name)
+	}
+	a := &app{
+		tweets:   store,
+		users:    store,
+		follows:  store,
+		render:   newRender(store),
+		sessions: sessions.NewCookieStore([]byte(cfg.SessionSecret)),
+	}
+	server := httptest.NewServer(a.router())
+	t.Cleanup(server.Close)
+	return store, server
+}
+
+// testBrowser is a cookie-keeping client that does not follow redirects.
+type testBrowser struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+func newTestBrowser(t *testing.T, server *httptest.Server) *testBrowser {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testBrowser{
+		t:      t,
+		server: server,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func login(t *testing.T, server *httptest.Server, name string) *testBrowser {
+	t.Helper()
+
+	b := newTestBrowser(t, server)
+	if code, loc := b.post("/login", url.Values{"name": {name}, "password": {name}}); code != http.StatusFound || loc != "/" {
+		t.Fatalf("login %s: %d %q", name, code, loc)
+	}
+	return b
+}
+
+func (b *testBrowser) do(req *http.Request) *http.Response {
+	b.t.Helper()
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return res
+}
+
+// get returns the status and body of path.
+func (b *testBrowser) get(path string) (int, string) {
+	b.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, b.server.URL+path, nil)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	res := b.do(req)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// post submits form to path and returns the status and the redirect location.
+func (b *testBrowser) post(path string, form url.Values) (int, string) {
+	b.t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, b.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := b.do(req)
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("Location")
+}
+
+func (b *testBrowser) mustPost(path string, form url.Values) {
+	b.t.Helper()
+
+	if code, loc := b.post(path, form); code != http.StatusFound {
+		b.t.Fatalf("POST %s %v: %d %q", path, form, code, loc)
+	}
+}
+
+func (b *testBrowser) tweet(text string) {
+	b.t.Helper()
+	b.mustPost("/", url.Values{"text": {text}})
+}
+
+func TestLogin(t *testing.T) {
+	_, server := newTestApp(t)
+
+	b := newTestBrowser(t, server)
+	if code, loc := b.post("/login", url.Values{"name": {"alice"}, "password": {"wrong"}}); code != http.StatusFound || loc != "/" {
+		t.Fatalf("bad password: %d %q", code, loc)
+	}
+	if _, body := b.get("/"); !strings.Contains(body, "ログインエラー") {
+		t.Errorf("bad password: no flush in %s", body)
+	}
+
+	b = login(t, server, "alice")
+	if _, body := b.get("/"); strings.Contains(body, `action="/login"`) {
+		t.Errorf("logged in page shows the login form")
+	}
+	b.mustPost("/logout", nil)
+	if _, body := b.get("/"); !strings.Contains(body, `action="/login"`) {
+		t.Errorf("logged out page has no login form")
+	}
+}
+
+func TestPostAndHome(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := login(t, server, "alice")
+	bob := login(t, server, "bob")
+	carol := login(t, server, "carol")
+
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	bob.tweet("hello #golang")
+	carol.tweet("carol was here")
+
+	_, home := alice.get("/")
+	if !strings.Contains(home, `<a class="hashtag" href="/hashtag/golang">#golang</a>`) {
+		t.Errorf("home lacks bob's tweet: %s", home)
+	}
+	if strings.Contains(home, "carol was here") {
+		t.Errorf("home shows a tweet of an unfollowed user")
+	}
+
+	if code, _ := alice.post("/", url.Values{"text": {"mine"}}); code != http.StatusFound {
+		t.Fatalf("post: %d", code)
+	}
+	if _, home := alice.get("/"); strings.Contains(home, ">mine<") {
+		t.Errorf("home shows my own tweet")
+	}
+	if _, page := alice.get("/alice"); !strings.Contains(page, "mine") {
+		t.Errorf("my page lacks my tweet")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	store, server := newTestApp(t)
+	alice := login(t, server, "alice")
+
+	alice.mustPost("/follow", url.Values{"user": {"Bob"}})
+	if ok, _ := store.IsFollowing(context.Background(), "alice", "bob"); !ok {
+		t.Fatal("alice does not follow bob")
+	}
+
+	if _, loc := alice.post("/follow", url.Values{"user": {"bob"}}); loc != "/bob" {
+		t.Errorf("follow twice: redirected to %q", loc)
+	}
+	if _, page := alice.get("/bob"); !strings.Contains(page, "すでにフォローしています") {
+		t.Errorf("follow twice: no flush")
+	}
+	if _, page := alice.get("/bob"); !strings.Contains(page, "フォロワー 1") || strings.Contains(page, "すでにフォローしています") {
+		t.Errorf("flush is shown twice or counts are wrong: %s", page)
+	}
+
+	alice.mustPost("/unfollow", url.Values{"user": {"bob"}})
+	if _, page := alice.get("/bob"); !strings.Contains(page, "フォロワー 0") {
+		t.Errorf("unfollow: follower count not updated")
+	}
+	alice.mustPost("/unfollow", url.Values{"user": {"bob"}})
+	if _, page := alice.get("/bob"); !strings.Contains(page, "フォローしていません") {
+		t.Errorf("unfollow twice: no flush")
+	}
+
+	if code, _ := newTestBrowser(t, server).post("/follow", url.Values{"user": {"bob"}}); code != http.StatusFound {
+		t.Errorf("guest follow: %d", code)
+	}
+	if ok, _ := store.IsFollowing(context.Background(), "", "bob"); ok {
+		t.Errorf("guest follow was stored")
+	}
+}
+
+func TestUserTimelinePagination(t *testing.T) {
+	store, server := newTestApp(t)
+	now := time.Date(2019, 6, 29, 10, 0, 0, 0, time.Local)
+	store.now = func() time.Time { return now }
+
+	bob := login(t, server, "bob")
+	for i := 0; i < cfg.PerPage+5; i++ {
+		bob.tweet("tweet")
+		now = now.Add(time.Second)
+	}
+
+	guest := newTestBrowser(t, server)
+	_, page := guest.get("/bob")
+	if n := strings.Count(page, `class="tweet"`); n != cfg.PerPage {
+		t.Fatalf("first page has %d tweets", n)
+	}
+	last := now.Add(-time.Duration(cfg.PerPage) * time.Second).Format("2006-01-02 15:04:05")
+	if !strings.Contains(page, `data-time="`+last+`"`) {
+		t.Fatalf("first page does not end at %s", last)
+	}
+
+	_, more := guest.get("/bob?append=1&until=" + url.QueryEscape(last))
+	if n := strings.Count(more, `class="tweet"`); n != 5 {
+		t.Errorf("second page has %d tweets", n)
+	}
+
+	if code, _ := guest.get("/nobody"); code != http.StatusNotFound {
+		t.Errorf("unknown user: %d", code)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := login(t, server, "alice")
+	bob := login(t, server, "bob")
+	bob.tweet("ramen #lunch")
+	alice.tweet("sushi #lunch")
+	alice.tweet("coffee")
+
+	guest := newTestBrowser(t, server)
+	_, body := guest.get("/search?q=" + url.QueryEscape("ramen"))
+	if strings.Count(body, `class="tweet"`) != 1 || !strings.Contains(body, "ramen") {
+		t.Errorf("search ramen: %s", body)
+	}
+	_, body = guest.get("/hashtag/lunch")
+	if n := strings.Count(body, `class="tweet"`); n != 2 {
+		t.Errorf("hashtag lunch: %d tweets", n)
+	}
+
+	alice.mustPost("/mute", url.Values{"user": {"bob"}})
+	if _, body := alice.get("/hashtag/lunch"); strings.Contains(body, "ramen") {
+		t.Errorf("search shows a muted user")
+	}
+}
+
+func TestMuteAndBlock(t *testing.T) {
+	store, server := newTestApp(t)
+	alice := login(t, server, "alice")
+	bob := login(t, server, "bob")
+	bob.mustPost("/follow", url.Values{"user": {"alice"}})
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	bob.tweet("noisy")
+
+	alice.mustPost("/mute", url.Values{"user": {"bob"}})
+	if _, home := alice.get("/"); strings.Contains(home, "noisy") {
+		t.Errorf("home shows a muted user")
+	}
+	if _, body := alice.get("/settings/mutes"); !strings.Contains(body, "bob") {
+		t.Errorf("mutes settings lack bob")
+	}
+	alice.mustPost("/unmute", url.Values{"user": {"bob"}})
+	if _, home := alice.get("/"); !strings.Contains(home, "noisy") {
+		t.Errorf("home hides an unmuted user")
+	}
+
+	alice.mustPost("/block", url.Values{"user": {"bob"}})
+	for _, pair := range [][2]string{{"alice", "bob"}, {"bob", "alice"}} {
+		if ok, _ := store.IsFollowing(context.Background(), pair[0], pair[1]); ok {
+			t.Errorf("%s still follows %s after the block", pair[0], pair[1])
+		}
+	}
+	if code, _ := bob.get("/alice"); code != http.StatusForbidden {
+		t.Errorf("blocked user reads the timeline: %d", code)
+	}
+	if code, _ := bob.post("/follow", url.Values{"user": {"alice"}}); code != http.StatusForbidden {
+		t.Errorf("blocked user follows: %d", code)
+	}
+
+	if code, _ := alice.post("/mute", url.Values{"user": {"alice"}}); code != http.StatusBadRequest {
+		t.Errorf("mute myself: %d", code)
+	}
+}
+
+func TestProtected(t *testing.T) {
+	store, server := newTestApp(t)
+	alice := login(t, server, "alice")
+	bob := login(t, server, "bob")
+
+	alice.mustPost("/settings/protected", url.Values{"protected": {"on"}})
+	alice.tweet("secret")
+
+	if _, page := bob.get("/alice"); strings.Contains(page, "secret") || !strings.Contains(page, "非公開") {
+		t.Errorf("protected tweets are visible")
+	}
+	if _, body := newTestBrowser(t, server).get("/search?q=secret"); strings.Contains(body, `class="tweet"`) {
+		t.Errorf("protected tweets are searchable")
+	}
+
+	bob.mustPost("/follow", url.Values{"user": {"alice"}})
+	if ok, _ := store.IsFollowing(context.Background(), "bob", "alice"); ok {
+		t.Fatal("follow of a protected user did not wait for approval")
+	}
+	if _, page := bob.get("/alice"); !strings.Contains(page, "フォローリクエスト送信済み") {
+		t.Errorf("no pending request on the page")
+	}
+	if _, body := alice.get("/follow_requests"); !strings.Contains(body, "bob") {
+		t.Errorf("request not listed")
+	}
+
+	alice.mustPost("/follow_requests/approve", url.Values{"user": {"bob"}})
+	if _, page := bob.get("/alice"); !strings.Contains(page, "secret") {
+		t.Errorf("approved follower cannot read the tweets")
+	}
+	if code, _ := alice.post("/follow_requests/approve", url.Values{"user": {"bob"}}); code != http.StatusNotFound {
+		t.Errorf("approve twice: %d", code)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	store, server := newTestApp(t)
+	store.AddUser(4, "dave", "dave")
+	alice := login(t, server, "alice")
+	bob := login(t, server, "bob")
+	carol := login(t, server, "carol")
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	alice.mustPost("/follow", url.Values{"user": {"carol"}})
+	bob.mustPost("/follow", url.Values{"user": {"dave"}})
+	carol.mustPost("/follow", url.Values{"user": {"dave"}})
+	bob.mustPost("/follow", url.Values{"user": {"carol"}})
+
+	var list struct {
+		User  string   `json:"user"`
+		Users []string `json:"users"`
+		Count int      `json:"count"`
+	}
+	code, body := alice.get("/api/users/dave/followers")
+	if code != http.StatusOK {
+		t.Fatalf("followers: %d %s", code, body)
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Count != 2 || strings.Join(list.Users, ",") != "bob,carol" {
+		t.Errorf("followers of dave: %+v", list)
+	}
+	if code, _ := alice.get("/api/users/nobody/following"); code != http.StatusNotFound {
+		t.Errorf("unknown user: %d", code)
+	}
+	huge := "?page=9223372036854775807"
+	if code, body := alice.get("/api/users/dave/followers" + huge); code != http.StatusOK || !strings.Contains(body, `"users":[]`) {
+		t.Errorf("followers page past the end: %d %s", code, body)
+	}
+	if code, _ := alice.get("/dave/followers" + huge); code != http.StatusOK {
+		t.Errorf("followers page past the end: %d", code)
+	}
+
+	if code, _ := newTestBrowser(t, server).get("/api/recommendations"); code != http.StatusUnauthorized {
+		t.Errorf("guest recommendations: %d", code)
+	}
+	if _, home := alice.get("/"); strings.Contains(home, "おすすめユーザー") {
+		t.Errorf("home has recommendations before the job")
+	}
+	if err := store.RefreshRecommendations("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, home := alice.get("/"); !strings.Contains(home, `href="/dave" class="user-name"`) {
+		t.Errorf("cached home lacks the refreshed recommendations")
+	}
+	var recs struct {
+		Recommendations []Recommendation `json:"recommendations"`
+	}
+	_, body = alice.get("/api/recommendations")
+	if err := json.Unmarshal([]byte(body), &recs); err != nil {
+		t.Fatal(err)
+	}
+	if len(recs.Recommendations) != 1 || recs.Recommendations[0] != (Recommendation{Name: "dave", Score: 2}) {
+		t.Errorf("recommendations: %+v", recs.Recommendations)
+	}
+}
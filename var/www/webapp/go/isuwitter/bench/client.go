@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// session is a browser of one user, keeping its cookies. Redirects are not
+// followed so that they can be checked.
+type session struct {
+	name   string
+	client *http.Client
+}
+
+type benchmark struct {
+	target    string
+	transport *http.Transport
+	stats     *stats
+	model     *model
+}
+
+func newBenchmark(target string, concurrency int) *benchmark {
+	return &benchmark{
+		target: strings.TrimSuffix(target, "/"),
+		transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: concurrency * 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		stats: newStats(),
+		model: newModel(),
+	}
+}
+
+func (b *benchmark) newSession(name string) *session {
+	jar, _ := cookiejar.New(nil)
+	return &session{
+		name: name,
+		client: &http.Client{
+			Transport: b.transport,
+			Jar:       jar,
+			Timeout:   requestTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// response is what a request returned; Location is set on redirects.
+type response struct {
+	Status   int
+	Location string
+	Body     []byte
+}
+
+// do sends a request, recording its latency under label. A transport error
+// or a 5xx status is returned as an error.
+func (b *benchmark) do(s *session, label string, req *http.Request) (*response, error) {
+	start := time.Now()
+	res, err := s.client.Do(req)
+	if err == nil {
+		var body []byte
+		body, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err == nil && res.StatusCode >= 500 {
+			err = fmt.Errorf("%s %s: status %d", req.Method, req.URL.RequestURI(), res.StatusCode)
+		}
+		if err == nil {
+			b.stats.record(label, time.Since(start), nil)
+			return &response{res.StatusCode, res.Header.Get("Location"), body}, nil
+		}
+	}
+	b.stats.record(label, time.Since(start), err)
+	return nil, err
+}
+
+func (b *benchmark) get(s *session, label, path string) (*response, error) {
+	req, err := http.NewRequest(http.MethodGet, b.target+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.do(s, label, req)
+}
+
+func (b *benchmark) post(s *session, label, path string, form url.Values) (*response, error) {
+	req, err := http.NewRequest(http.MethodPost, b.target+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(s, label, req)
+}
+
+// expectRedirect checks that a form post redirected to one of locations.
+func (b *benchmark) expectRedirect(what string, res *response, locations ...string) bool {
+	if res.Status == http.StatusFound {
+		for _, loc := range locations {
+			if res.Location == loc {
+				return true
+			}
+		}
+	}
+	b.stats.fail("%s: got %d to %q, want a redirect to %q", what, res.Status, res.Location, locations)
+	return false
+}
+
+func (b *benchmark) initialize() error {
+	s := b.newSession("")
+	s.client.Timeout = 5 * time.Minute
+	res, err := b.get(s, "GET /initialize", "/initialize")
+	if err != nil {
+		return err
+	}
+	if res.Status != http.StatusOK {
+		return fmt.Errorf("status %d", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Command bench is a load generator for isuwitter modeled on the contest
+// benchmark. It seeds users, follows and tweets, then lets concurrent users
+// log in, post, follow, read the home, user and search pages and page through
+// them with until, checking that the responses are consistent with what they
+// did. It reports the throughput, the latency percentiles and the errors.
+//
+// Users are inserted straight into MariaDB with IDs above 1000, so that the
+// next /initialize removes them. MariaDB is found with the settings of
+// isuwitter, taken from the same config file, environment and flags.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/config"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/settings"
+)
+
+func main() {
+	cfg := settings.Default()
+	loader := config.New(flag.CommandLine, &cfg, settings.FileEnv)
+	target := flag.String("target", "", "base URL of isuwitter (default http://localhost and the port of listen)")
+	initialize := flag.Bool("initialize", true, "call /initialize before seeding")
+	users := flag.Int("users", 50, "number of users to create")
+	friends := flag.Int("friends", 10, "number of users each user follows")
+	tweets := flag.Int("tweets", 5, "number of tweets each user posts while seeding")
+	concurrency := flag.Int("c", 16, "number of concurrent users")
+	duration := flag.Duration("d", 30*time.Second, "duration of the load")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	flag.Parse()
+
+	if err := loader.Load(); err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	err := cfg.Validate()
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		if err == nil {
+			return
+		}
+	}
+	if err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	if *target == "" {
+		*target = cfg.LocalURL()
+	}
+	perPage = cfg.PerPage
+
+	if *users < 2 || *friends >= *users || *concurrency < 1 {
+		log.Fatal("need -users >= 2, -friends < -users and -c >= 1")
+	}
+
+	b := newBenchmark(*target, *concurrency)
+	rand.Seed(*seed)
+
+	start := time.Now()
+	if *initialize {
+		log.Print("initializing")
+		if err := b.initialize(); err != nil {
+			log.Fatalf("initialize: %s", err)
+		}
+	}
+	log.Printf("seeding %d users", *users)
+	if err := b.seed(cfg.DB.DSN(), *users, *friends, *tweets, *concurrency); err != nil {
+		log.Fatalf("seed: %s", err)
+	}
+	log.Printf("seeded in %s", time.Since(start).Round(time.Millisecond))
+	b.stats.reset()
+
+	log.Printf("running %d users for %s", *concurrency, *duration)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			b.run(ctx, r)
+		}(rand.New(rand.NewSource(*seed + int64(i))))
+	}
+	wg.Wait()
+
+	if !b.stats.report(os.Stdout, *duration) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/settings"
+)
+
+// perPage is the number of tweets isuwitter puts on a page, set by main from
+// the settings.
+var perPage = settings.Default().PerPage
+
+// run plays random actions of random users until ctx is done.
+func (b *benchmark) run(ctx context.Context, r *rand.Rand) {
+	users := b.model.users
+	for ctx.Err() == nil {
+		s := users[r.Intn(len(users))]
+		switch n := r.Intn(10); {
+		case n < 2:
+			b.tweet(s, r)
+		case n < 5:
+			b.readHome(s)
+		case n < 7:
+			b.readUser(s, users[r.Intn(len(users))].name)
+		case n < 9:
+			b.searchTag(s, r.Intn(tags))
+		default:
+			b.churnFollow(s, users[r.Intn(len(users))].name)
+		}
+	}
+}
+
+// tweet posts a tweet, then expects it on the user page and on the home of a
+// follower.
+func (b *benchmark) tweet(s *session, r *rand.Rand) {
+	token := randomHex(6)
+	res, err := b.post(s, "POST /", "/", url.Values{"text": {tweetText(s.name, token)}})
+	if err != nil || !b.expectRedirect("tweet of "+s.name, res, "/") {
+		return
+	}
+
+	res, err = b.get(s, "GET /{user}", "/"+url.PathEscape(s.name))
+	if err != nil {
+		return
+	}
+	// another worker may be posting as s too, so the tweet need not be on top
+	if !containsToken(page.Tweets(res.Body), s.name, token) {
+		b.stats.fail("user page of %s lacks the tweet %s just posted", s.name, token)
+	}
+
+	followers := b.model.seededFollowers(s.name)
+	if len(followers) == 0 {
+		return
+	}
+	f := followers[r.Intn(len(followers))]
+	res, err = b.get(f, "GET /", "/")
+	if err != nil {
+		return
+	}
+	if !containsToken(page.Tweets(res.Body), s.name, token) {
+		b.stats.fail("home of %s lacks the tweet %s of followee %s just posted", f.name, token, s.name)
+	}
+}
+
+func containsToken(tweets []page.Tweet, user, token string) bool {
+	for _, t := range tweets {
+		if t.User == user && strings.Contains(t.HTML, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHome reads the home and its second page, expecting only tweets of
+// followees, newest first.
+func (b *benchmark) readHome(s *session) {
+	check := func(what string, tweets []page.Tweet, until string) {
+		if err := page.CheckOrder(tweets, until); err != nil {
+			b.stats.fail("%s of %s: %s", what, s.name, err)
+		}
+		for _, t := range tweets {
+			if !b.model.hasFollowed(s.name, t.User) {
+				b.stats.fail("%s of %s shows a tweet of %s, who was never followed", what, s.name, t.User)
+				return
+			}
+		}
+	}
+
+	res, err := b.get(s, "GET /", "/")
+	if err != nil {
+		return
+	}
+	if got := page.LoggedIn(res.Body); got != s.name {
+		b.stats.fail("home of %s greets %q", s.name, got)
+		return
+	}
+	tweets := page.Tweets(res.Body)
+	check("home", tweets, "")
+	if len(tweets) < perPage {
+		return
+	}
+
+	until := page.Oldest(tweets)
+	res, err = b.get(s, "GET /?until", "/?append=1&until="+url.QueryEscape(until))
+	if err != nil {
+		return
+	}
+	check("home after "+until, page.Tweets(res.Body), until)
+}
+
+// readUser reads the page of user and its second page, expecting only tweets
+// of user, newest first.
+func (b *benchmark) readUser(s *session, user string) {
+	check := func(what string, tweets []page.Tweet, until string) {
+		if err := page.CheckOrder(tweets, until); err != nil {
+			b.stats.fail("%s: %s", what, err)
+		}
+		for _, t := range tweets {
+			if t.User != user {
+				b.stats.fail("%s shows a tweet of %s", what, t.User)
+				return
+			}
+		}
+	}
+
+	path := "/" + url.PathEscape(user)
+	res, err := b.get(s, "GET /{user}", path)
+	if err != nil {
+		return
+	}
+	if res.Status != http.StatusOK {
+		b.stats.fail("page of %s: status %d", user, res.Status)
+		return
+	}
+	tweets := page.Tweets(res.Body)
+	check("page of "+user, tweets, "")
+	if len(tweets) < perPage {
+		return
+	}
+
+	until := page.Oldest(tweets)
+	res, err = b.get(s, "GET /{user}?until", path+"?append=1&until="+url.QueryEscape(until))
+	if err != nil {
+		return
+	}
+	check("page of "+user+" after "+until, page.Tweets(res.Body), until)
+}
+
+// searchTag reads the results of #benchN, expecting only tweets tagged so.
+func (b *benchmark) searchTag(s *session, n int) {
+	tag := "bench" + strconv.Itoa(n)
+	res, err := b.get(s, "GET /hashtag/{tag}", "/hashtag/"+tag)
+	if err != nil {
+		return
+	}
+	tweets := page.Tweets(res.Body)
+	if err := page.CheckOrder(tweets, ""); err != nil {
+		b.stats.fail("hashtag %s: %s", tag, err)
+	}
+	for _, t := range tweets {
+		if !strings.Contains(t.HTML, `href="/hashtag/`+tag+`"`) {
+			b.stats.fail("hashtag %s shows %q", tag, t.HTML)
+			return
+		}
+	}
+}
+
+// churnFollow follows user, checks their page offers to unfollow and unfollows
+// again. The seeded follows are left alone.
+func (b *benchmark) churnFollow(s *session, user string) {
+	if user == s.name || b.model.isSeededFollow(s.name, user) || !b.model.startChurn(s.name) {
+		return
+	}
+	defer b.model.endChurn(s.name)
+
+	b.model.addFollow(s.name, user, false)
+	res, err := b.post(s, "POST /follow", "/follow", url.Values{"user": {user}})
+	if err != nil || !b.expectRedirect(s.name+" follows "+user, res, "/") {
+		return
+	}
+
+	res, err = b.get(s, "GET /{user}", "/"+url.PathEscape(user))
+	if err != nil {
+		return
+	}
+	if !strings.Contains(string(res.Body), `id="user-unfollow-button"`) {
+		b.stats.fail("page of %s does not offer %s to unfollow right after the follow", user, s.name)
+	}
+
+	res, err = b.post(s, "POST /unfollow", "/unfollow", url.Values{"user": {user}})
+	if err != nil {
+		return
+	}
+	b.expectRedirect(s.name+" unfollows "+user, res, "/")
+}
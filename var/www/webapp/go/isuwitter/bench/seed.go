@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	mrand "math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// firstUserID is above the users /initialize keeps.
+const firstUserID = 1001
+
+// tags is the number of #benchN hashtags the tweets are spread on.
+const tags = 10
+
+// model is what the benchmark knows the server state must be.
+type model struct {
+	mu    sync.Mutex
+	users []*session
+	// follows holds the seeded follows, which are never undone.
+	follows map[string]map[string]bool
+	// followed holds everyone a user ever followed, the only ones whose
+	// tweets may show up on their home.
+	followed map[string]map[string]bool
+	// churning holds the users following and unfollowing someone right now.
+	churning map[string]bool
+}
+
+func newModel() *model {
+	return &model{
+		follows:  map[string]map[string]bool{},
+		followed: map[string]map[string]bool{},
+		churning: map[string]bool{},
+	}
+}
+
+func (m *model) addFollow(me, user string, seeded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if seeded {
+		if m.follows[me] == nil {
+			m.follows[me] = map[string]bool{}
+		}
+		m.follows[me][user] = true
+	}
+	if m.followed[me] == nil {
+		m.followed[me] = map[string]bool{}
+	}
+	m.followed[me][user] = true
+}
+
+func (m *model) hasFollowed(me, user string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.followed[me][user]
+}
+
+func (m *model) isSeededFollow(me, user string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.follows[me][user]
+}
+
+// seededFollowers returns who follows user since the seeding.
+func (m *model) seededFollowers(user string) []*session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	followers := []*session{}
+	for _, s := range m.users {
+		if m.follows[s.name][user] {
+			followers = append(followers, s)
+		}
+	}
+	return followers
+}
+
+// startChurn reports whether me may follow and unfollow, which only one
+// worker does at a time for a user.
+func (m *model) startChurn(me string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.churning[me] {
+		return false
+	}
+	m.churning[me] = true
+	return true
+}
+
+func (m *model) endChurn(me string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.churning, me)
+}
+
+// seed creates users whose password is their name, logs them in, makes each
+// follow friends others and post tweets tweets.
+func (b *benchmark) seed(dsn string, users, friends, tweets, concurrency int) error {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id := firstUserID
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM users`).Scan(&id); err != nil {
+		return err
+	}
+	if id < firstUserID {
+		id = firstUserID
+	}
+	prefix := "b" + strconv.FormatInt(time.Now().Unix()%(36*36*36*36), 36) + "_"
+
+	for i := 0; i < users; i++ {
+		name := fmt.Sprintf("%s%03d", prefix, i)
+		salt := randomHex(8)
+		_, err := db.Exec(
+			`INSERT INTO users (id, name, salt, password) VALUES (?, ?, ?, ?)`,
+			id+i, name, salt, fmt.Sprintf("%x", sha1.Sum([]byte(salt+name))),
+		)
+		if err != nil {
+			return err
+		}
+		b.model.users = append(b.model.users, b.newSession(name))
+	}
+
+	err = parallel(concurrency, b.model.users, func(s *session) error {
+		return b.login(s)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = parallel(concurrency, b.model.users, func(s *session) error {
+		n := 0
+		for _, i := range mrand.Perm(len(b.model.users)) {
+			friend := b.model.users[i].name
+			if friend == s.name {
+				continue
+			}
+			if n == friends {
+				break
+			}
+			n++
+			b.model.addFollow(s.name, friend, true)
+			res, err := b.post(s, "POST /follow", "/follow", url.Values{"user": {friend}})
+			if err != nil {
+				return err
+			}
+			if !b.expectRedirect("seed follow", res, "/") {
+				return fmt.Errorf("%s cannot follow %s", s.name, friend)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return parallel(concurrency, b.model.users, func(s *session) error {
+		for i := 0; i < tweets; i++ {
+			res, err := b.post(s, "POST /", "/", url.Values{"text": {tweetText(s.name, randomHex(6))}})
+			if err != nil {
+				return err
+			}
+			if !b.expectRedirect("seed tweet", res, "/") {
+				return fmt.Errorf("%s cannot tweet", s.name)
+			}
+		}
+		return nil
+	})
+}
+
+func (b *benchmark) login(s *session) error {
+	res, err := b.post(s, "POST /login", "/login", url.Values{"name": {s.name}, "password": {s.name}})
+	if err != nil {
+		return err
+	}
+	b.expectRedirect("login", res, "/")
+	res, err = b.get(s, "GET /{user}", "/"+url.PathEscape(s.name))
+	if err != nil {
+		return err
+	}
+	if got := page.LoggedIn(res.Body); got != s.name {
+		return fmt.Errorf("logged in as %q, not %q", got, s.name)
+	}
+	return nil
+}
+
+// tweetText returns a tweet of name carrying token and a #benchN tag.
+func tweetText(name, token string) string {
+	return fmt.Sprintf("%s says %s #bench%d", name, token, mrand.Intn(tags))
+}
+
+// parallel runs f on sessions with at most n at a time and returns the
+// first error.
+func parallel(n int, sessions []*session, f func(*session) error) error {
+	sem := make(chan struct{}, n)
+	errs := make(chan error, len(sessions))
+	for _, s := range sessions {
+		sem <- struct{}{}
+		go func(s *session) {
+			defer func() { <-sem }()
+			errs <- f(s)
+		}(s)
+	}
+	for range sessions {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return fmt.Sprintf("%x", buf)
+}
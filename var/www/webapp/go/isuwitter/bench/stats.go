@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMessages is the number of error and failure messages kept for the
+// report.
+const maxMessages = 20
+
+// stats collects the latency of every request by label, the requests that
+// failed at the HTTP level (errors) and the responses that failed a check
+// (failures).
+type stats struct {
+	mu       sync.Mutex
+	series   map[string]*series
+	messages []string
+	failed   int
+}
+
+type series struct {
+	errors    int
+	latencies []time.Duration
+}
+
+func newStats() *stats {
+	return &stats{series: map[string]*series{}}
+}
+
+func (s *stats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.series = map[string]*series{}
+	s.messages = nil
+	s.failed = 0
+}
+
+// record adds a request; err is a transport error or a 5xx status.
+func (s *stats) record(label string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ser, ok := s.series[label]
+	if !ok {
+		ser = &series{}
+		s.series[label] = ser
+	}
+	ser.latencies = append(ser.latencies, d)
+	if err != nil {
+		ser.errors++
+		s.addMessage(fmt.Sprintf("%s: %s", label, err))
+	}
+}
+
+// fail records a response that is not what the scenario expects.
+func (s *stats) fail(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed++
+	s.addMessage(fmt.Sprintf(format, args...))
+}
+
+func (s *stats) addMessage(msg string) {
+	if len(s.messages) < maxMessages {
+		s.messages = append(s.messages, msg)
+	}
+}
+
+// report writes the summary and reports whether nothing failed.
+func (s *stats) report(w io.Writer, elapsed time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	labels := make([]string, 0, len(s.series))
+	total, errors := 0, 0
+	for label, ser := range s.series {
+		labels = append(labels, label)
+		total += len(ser.latencies)
+		errors += ser.errors
+	}
+	sort.Strings(labels)
+
+	fmt.Fprintf(w, "requests: %d (%.1f/s), errors: %d, failures: %d\n",
+		total, float64(total)/elapsed.Seconds(), errors, s.failed)
+	fmt.Fprintf(w, "%-24s %8s %7s %9s %9s %9s %9s\n", "", "count", "errors", "p50", "p90", "p99", "max")
+	for _, label := range labels {
+		ser := s.series[label]
+		sorted := append([]time.Duration(nil), ser.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		fmt.Fprintf(w, "%-24s %8d %7d %9s %9s %9s %9s\n", label, len(sorted), ser.errors,
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), percentile(sorted, 100))
+	}
+	if len(s.messages) > 0 {
+		fmt.Fprintf(w, "first %d errors and failures:\n", len(s.messages))
+		for _, msg := range s.messages {
+			fmt.Fprintf(w, "  %s\n", msg)
+		}
+	}
+	return errors == 0 && s.failed == 0
+}
+
+// percentile returns the p-th percentile of sorted by the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(100 * time.Microsecond)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// A mute hides the tweets of a user. A block implies a mute and also keeps
+// the blocked user from following name or reading name's timeline.
+
+// loadHiddenUsers returns the set of users whose tweets must not be shown to
+// name. It is empty for guests.
+func (a *app) loadHiddenUsers(ctx context.Context, name string) (map[string]bool, error) {
+	if name == "" {
+		return map[string]bool{}, nil
+	}
+	return a.follows.Hidden(ctx, name)
+}
+
+// isBlocking reports whether owner has blocked user.
+func (a *app) isBlocking(ctx context.Context, owner, user string) (bool, error) {
+	if owner == "" || user == "" {
+		return false, nil
+	}
+	return a.follows.IsBlocking(ctx, owner, user)
+}
+
+func (a *app) muteHandler(w http.ResponseWriter, r *http.Request) {
+	a.updateRelation(w, r, a.follows.Mute)
+}
+
+func (a *app) unmuteHandler(w http.ResponseWriter, r *http.Request) {
+	a.updateRelation(w, r, a.follows.Unmute)
+}
+
+func (a *app) blockHandler(w http.ResponseWriter, r *http.Request) {
+	a.updateRelation(w, r, func(ctx context.Context, me, user string) error {
+		if err := a.follows.Block(ctx, me, user); err != nil {
+			return err
+		}
+		// a block breaks the follow relationship in both directions
+		for _, pair := range [][2]string{{user, me}, {me, user}} {
+			follower, followee := pair[0], pair[1]
+			ok, err := a.follows.IsFollowing(ctx, follower, followee)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			// a pending unfollow is applied by the outbox
+			if err := a.follows.Unfollow(ctx, follower, followee); err != nil && err != errFollowPending && client.ErrorCode(err) != client.CodeNotFollowing {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *app) unblockHandler(w http.ResponseWriter, r *http.Request) {
+	a.updateRelation(w, r, a.follows.Unblock)
+}
+
+// updateRelation applies f to the logged-in user and the "user" form value,
+// then drops the home cache since the visible tweets may have changed.
+func (a *app) updateRelation(w http.ResponseWriter, r *http.Request, f func(ctx context.Context, me, user string) error) {
+	var name string
+	session := a.getSession(w, r)
+	userID, ok := session.Values["user_id"]
+	if ok {
+		name = a.sessionUserName(r, userID.(int))
+	}
+	if name == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user := username.Canonical(r.FormValue("user"))
+	if user == "" || user == name || a.getuserID(user) == 0 {
+		badRequest(w)
+		return
+	}
+
+	if err := f(r.Context(), name, user); err != nil {
+		logger.Error("updateRelation", zap.Error(err), zap.String("name", name), zap.String("user", user))
+		badRequest(w)
+		return
+	}
+
+	if err := a.tweets.ClearHomeCache(r.Context(), name); err != nil {
+		logger.Error(
+			"clearHomeCache",
+			zap.Error(err),
+			zap.String("name", name),
+		)
+		badRequest(w)
+		return
+	}
+
+	http.Redirect(w, r, "/"+user, http.StatusFound)
+}
+
+func (a *app) relationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var name string
+	session := a.getSession(w, r)
+	userID, ok := session.Values["user_id"]
+	if ok {
+		name = a.sessionUserName(r, userID.(int))
+	}
+	if name == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	kind := mux.Vars(r)["kind"]
+	var users []string
+	var err error
+	switch kind {
+	case "mutes":
+		users, err = a.follows.Mutes(r.Context(), name)
+	case "blocks":
+		users, err = a.follows.Blocks(r.Context(), name)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	sort.Strings(users)
+
+	a.render.HTML(w, http.StatusOK, "relations", struct {
+		Name  string
+		Kind  string
+		Users []string
+	}{
+		name, kind, users,
+	})
+}
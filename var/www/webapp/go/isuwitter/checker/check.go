@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+)
+
+// session is a browser of one user, or of a guest when name is "".
+type session struct {
+	name   string
+	client *http.Client
+}
+
+type checker struct {
+	target string
+	src    *source
+	out    io.Writer
+
+	pages int
+	diffs int
+}
+
+func newChecker(target string, src *source, out io.Writer) *checker {
+	return &checker{target: strings.TrimSuffix(target, "/"), src: src, out: out}
+}
+
+func (c *checker) newSession(name string) *session {
+	jar, _ := cookiejar.New(nil)
+	return &session{
+		name: name,
+		client: &http.Client{
+			Jar:     jar,
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Pages show the names as users signed up, while source works with the
+// canonical names. loggedIn and pageTweets canonicalize the names they read.
+
+func loggedIn(body []byte) string {
+	return username.Canonical(page.LoggedIn(body))
+}
+
+func pageTweets(body []byte) []page.Tweet {
+	tweets := page.Tweets(body)
+	for i := range tweets {
+		tweets[i].User = username.Canonical(tweets[i].User)
+	}
+	return tweets
+}
+
+// report writes the differences found on path as viewer saw it.
+func (c *checker) report(viewer, path string, diffs ...string) {
+	if viewer == "" {
+		viewer = "-"
+	}
+	for _, d := range diffs {
+		c.diffs++
+		fmt.Fprintf(c.out, "%s\t%s\t%s\n", viewer, path, d)
+	}
+}
+
+func (c *checker) login(s *session, name, password string) error {
+	res, err := s.client.PostForm(c.target+"/login", url.Values{"name": {name}, "password": {password}})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/" {
+		return fmt.Errorf("got %d to %q, want a redirect to /", res.StatusCode, res.Header.Get("Location"))
+	}
+	return nil
+}
+
+func (c *checker) get(s *session, path string) (int, []byte, error) {
+	res, err := s.client.Get(c.target + path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, body, err
+}
+
+// checkPages checks the page at path and, when it is full, the page after
+// it, computing each with want. It returns the expected first page, or nil
+// if it could not be computed.
+func (c *checker) checkPages(s *session, path string, want func(until string) (*expected, error)) *expected {
+	first, until := (*expected)(nil), ""
+	for n := 0; n < 2; n++ {
+		p := path
+		if until != "" {
+			sep := "?"
+			if strings.Contains(path, "?") {
+				sep = "&"
+			}
+			p += sep + "append=1&until=" + url.QueryEscape(until)
+		}
+
+		w, err := want(until)
+		if err != nil {
+			c.report(s.name, p, "cannot compute the expected page: "+err.Error())
+			return first
+		}
+		if first == nil {
+			first = w
+		}
+
+		c.pages++
+		status, body, err := c.get(s, p)
+		if err != nil {
+			c.report(s.name, p, err.Error())
+			return first
+		}
+		if status != w.Status {
+			c.report(s.name, p, fmt.Sprintf("status %d, want %d", status, w.Status))
+			return first
+		}
+		if status != http.StatusOK {
+			return first
+		}
+		if until == "" && s.name != "" {
+			if got := loggedIn(body); got != s.name {
+				c.report(s.name, p, fmt.Sprintf("logged in as %q", got))
+				return first
+			}
+		}
+
+		got := pageTweets(body)
+		c.report(s.name, p, diff(w, got, until)...)
+		if len(got) < perPage {
+			return first
+		}
+		until = page.Oldest(got)
+	}
+	return first
+}
+
+func (c *checker) checkHome(s *session) *expected {
+	return c.checkPages(s, "/", func(until string) (*expected, error) {
+		return c.src.home(s.name, until)
+	})
+}
+
+func (c *checker) checkUser(s *session, owner string) {
+	c.checkPages(s, "/"+url.PathEscape(owner), func(until string) (*expected, error) {
+		return c.src.userTimeline(s.name, owner, until)
+	})
+}
+
+func (c *checker) checkSearch(s *session, path, query string) {
+	c.checkPages(s, path, func(until string) (*expected, error) {
+		return c.src.search(s.name, query, until)
+	})
+}
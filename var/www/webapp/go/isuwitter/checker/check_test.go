@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+)
+
+// body is a home of Alice, who signed up with a capital, showing a tweet of
+// hers.
+const body = `<header class="header">
+      <form class="logout" action="/logout" method="post">
+        <button type="submit">ログアウト</button>
+      </form>
+      <span class="name">こんにちは Aliceさん</span>
+</header>
+  <div class="tweet" data-time="2019-06-29 10:00:01">
+    <p><a href="/alice" class="tweet-user-name">Alice</a></p>
+    <p>hello</p>
+    <p class="time">2019-06-29 10:00:01</p>
+  </div>
+`
+
+func TestCanonicalPageNames(t *testing.T) {
+	if got := loggedIn([]byte(body)); got != "alice" {
+		t.Errorf("logged in as %q, want alice", got)
+	}
+	want := []page.Tweet{{Time: "2019-06-29 10:00:01", User: "alice", HTML: "hello"}}
+	if diffs := diff(&expected{Status: 200, Tweets: want}, pageTweets([]byte(body)), ""); len(diffs) != 0 {
+		t.Errorf("got diffs %q", diffs)
+	}
+}
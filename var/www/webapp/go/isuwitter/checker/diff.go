@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+)
+
+// maxShown is the number of missing or extra tweets listed for a page.
+const maxShown = 5
+
+// diff compares the tweets a page shows to the expected ones and describes
+// every difference. until is the until the page was requested with.
+func diff(want *expected, got []page.Tweet, until string) []string {
+	var diffs []string
+
+	n := len(want.Tweets)
+	if n > perPage {
+		n = perPage
+	}
+	if len(got) != n {
+		diffs = append(diffs, fmt.Sprintf("%d tweets, want %d", len(got), n))
+	}
+	if err := page.CheckOrder(got, until); err != nil {
+		diffs = append(diffs, err.Error())
+	}
+
+	// The tweets posted in the second of the last one on a full page may be
+	// cut anywhere: all the older ones are required, and any of them allowed.
+	required, allowed := want.Tweets, want.Tweets
+	if len(want.Tweets) > perPage {
+		last := want.Tweets[perPage-1].Time
+		i := 0
+		for i < len(want.Tweets) && want.Tweets[i].Time != last {
+			i++
+		}
+		required = want.Tweets[:i]
+	}
+
+	shown := count(got)
+	var missing []page.Tweet
+	for _, t := range required {
+		if shown[t] > 0 {
+			shown[t]--
+		} else {
+			missing = append(missing, t)
+		}
+	}
+	left := count(allowed)
+	var extra []page.Tweet
+	for _, t := range got {
+		if left[t] > 0 {
+			left[t]--
+		} else {
+			extra = append(extra, t)
+		}
+	}
+	diffs = append(diffs, describe("missing", missing)...)
+	diffs = append(diffs, describe("extra", extra)...)
+	return diffs
+}
+
+func count(tweets []page.Tweet) map[page.Tweet]int {
+	counts := map[page.Tweet]int{}
+	for _, t := range tweets {
+		counts[t]++
+	}
+	return counts
+}
+
+func describe(kind string, tweets []page.Tweet) []string {
+	var lines []string
+	for i, t := range tweets {
+		if i == maxShown {
+			lines = append(lines, fmt.Sprintf("%s: %d more", kind, len(tweets)-maxShown))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s %s %q", kind, t.Time, t.User, abbreviate(t.HTML, 60)))
+	}
+	return lines
+}
+
+// abbreviate shortens s to at most n runes.
+func abbreviate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
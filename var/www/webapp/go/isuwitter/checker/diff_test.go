@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+)
+
+func tweet(sec int, user, html string) page.Tweet {
+	return page.Tweet{Time: fmt.Sprintf("2019-06-29 12:%02d:%02d", sec/60, sec%60), User: user, HTML: html}
+}
+
+// timeline returns n tweets of alice, one a second, newest first.
+func timeline(n int) []page.Tweet {
+	tweets := make([]page.Tweet, n)
+	for i := range tweets {
+		tweets[i] = tweet(1000-i, "alice", fmt.Sprint("tweet ", i))
+	}
+	return tweets
+}
+
+func TestDiff(t *testing.T) {
+	a, b, c := tweet(3, "alice", "a"), tweet(2, "bob", "b"), tweet(1, "carol", "c")
+
+	tests := []struct {
+		name  string
+		want  []page.Tweet
+		got   []page.Tweet
+		until string
+		diffs []string
+	}{
+		{"same", []page.Tweet{a, b, c}, []page.Tweet{a, b, c}, "", nil},
+		{"empty", nil, []page.Tweet{}, "", nil},
+		{
+			"missing",
+			[]page.Tweet{a, b, c},
+			[]page.Tweet{a, c},
+			"",
+			[]string{
+				"2 tweets, want 3",
+				`missing: 2019-06-29 12:00:02 bob "b"`,
+			},
+		},
+		{
+			"extra",
+			[]page.Tweet{a, c},
+			[]page.Tweet{a, b, c},
+			"",
+			[]string{
+				"3 tweets, want 2",
+				`extra: 2019-06-29 12:00:02 bob "b"`,
+			},
+		},
+		{
+			"order",
+			[]page.Tweet{a, b, c},
+			[]page.Tweet{b, a, c},
+			"",
+			[]string{"tweet 1 at 2019-06-29 12:00:03 is newer than tweet 0 at 2019-06-29 12:00:02"},
+		},
+		{
+			"until",
+			[]page.Tweet{b, c},
+			[]page.Tweet{a, b},
+			"2019-06-29 12:00:03",
+			[]string{
+				"tweet 0 at 2019-06-29 12:00:03 is not before until=2019-06-29 12:00:03",
+				`missing: 2019-06-29 12:00:01 carol "c"`,
+				`extra: 2019-06-29 12:00:03 alice "a"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diff(&expected{Status: 200, Tweets: tt.want}, tt.got, tt.until)
+			if !reflect.DeepEqual(got, tt.diffs) {
+				t.Errorf("diff = %q, want %q", got, tt.diffs)
+			}
+		})
+	}
+}
+
+func TestDiffSameSecondAtTheEndOfAPage(t *testing.T) {
+	// the last 2 tweets of the page and the 2 after it share a second
+	want := timeline(perPage + 2)
+	last := want[perPage-2].Time
+	for i := perPage - 2; i < len(want); i++ {
+		want[i].Time = last
+	}
+
+	got := append(append([]page.Tweet{}, want[:perPage-2]...), want[perPage+1], want[perPage-2])
+	if diffs := diff(&expected{Status: 200, Tweets: want}, got, ""); diffs != nil {
+		t.Errorf("any tweets of the last second may end the page, got %q", diffs)
+	}
+
+	got[perPage-3] = want[perPage]
+	diffs := diff(&expected{Status: 200, Tweets: want}, got, "")
+	if want := []string{`missing: 2019-06-29 12:15:53 alice "tweet 47"`}; !reflect.DeepEqual(diffs, want) {
+		t.Errorf("a tweet of the last second cannot replace an older one, got %q, want %q", diffs, want)
+	}
+}
+
+func TestDiffAbbreviates(t *testing.T) {
+	want := timeline(perPage)
+	got := timeline(perPage + 20)[20:]
+	diffs := diff(&expected{Status: 200, Tweets: want}, got, "")
+	if len(diffs) != 2*(maxShown+1) {
+		t.Fatalf("got %d lines, want %d: %q", len(diffs), 2*(maxShown+1), diffs)
+	}
+	if diffs[maxShown] != "missing: 15 more" || diffs[2*maxShown+1] != "extra: 15 more" {
+		t.Errorf("got %q", diffs)
+	}
+}
+
+func TestParsePasswords(t *testing.T) {
+	got, err := parsePasswords(strings.NewReader("alice s3cret\n\n  bob\thunter2  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"alice": "s3cret", "bob": "hunter2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := parsePasswords(strings.NewReader("alice\n")); err == nil {
+		t.Error("a line without password is accepted")
+	}
+}
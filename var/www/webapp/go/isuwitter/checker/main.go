@@ -0,0 +1,210 @@
+// Command checker verifies the timelines a running isuwitter serves. For a
+// sample of users, it computes their home, their user page, the page of
+// another user and the hashtag searches of the tags on their home straight
+// from MariaDB, isutomo and the relations in Redis, and diffs them against
+// what the server returns, first pages and second pages alike. The same
+// pages are checked for guests. Every difference is written as a line of
+// viewer, path and description, and the command exits with 1 if there is
+// any.
+//
+// Logging in takes the password of a user: either the one -passwords lists
+// for them, or their name. Users whose password is unknown are only checked
+// as guests see them.
+//
+// The follows are read from isutomo, which isuwitter caches in Redis; run
+// isuwitter -reconcile to tell a stale cache from a wrong page.
+//
+// MariaDB, Redis and isutomo are found with the settings of isuwitter, taken
+// from the same config file, environment and flags.
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/config"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/settings"
+	"github.com/go-redis/redis"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func main() {
+	cfg := settings.Default()
+	loader := config.New(flag.CommandLine, &cfg, settings.FileEnv)
+	target := flag.String("target", "", "base URL of isuwitter (default http://localhost and the port of listen)")
+	users := flag.Int("users", 20, "number of users to check")
+	passwords := flag.String("passwords", "", "file of \"name password\" lines")
+	query := flag.String("query", "", "free text search to check as well")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	flag.Parse()
+
+	if err := loader.Load(); err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	err := cfg.Validate()
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		if err == nil {
+			return
+		}
+	}
+	if err != nil {
+		log.Fatalf("config: %s", err)
+	}
+	if *target == "" {
+		*target = cfg.LocalURL()
+	}
+	perPage = cfg.PerPage
+
+	db, err := sql.Open("mysql", cfg.DB.DSN())
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %s.", err)
+	}
+	defer db.Close()
+
+	src := &source{
+		db: db,
+		redis: redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		}),
+		isutomo: client.New(cfg.Isutomo.Endpoint),
+	}
+	if err := src.loadUsers(); err != nil {
+		log.Fatalf("load users: %s", err)
+	}
+	known := map[string]string{}
+	if *passwords != "" {
+		if known, err = loadPasswords(*passwords); err != nil {
+			log.Fatalf("load passwords: %s", err)
+		}
+	}
+
+	c := newChecker(*target, src, os.Stdout)
+	r := rand.New(rand.NewSource(*seed))
+	sample := r.Perm(len(src.users))
+
+	viewers := 0
+	var tags []string
+	for _, i := range sample {
+		if viewers == *users {
+			break
+		}
+		u := src.users[i]
+		name := username.Canonical(u.Name)
+		if src.ids[name] != u.ID {
+			continue
+		}
+		password, ok := passwordOf(u, known)
+		if !ok {
+			continue
+		}
+		viewers++
+
+		s := c.newSession(name)
+		if err := c.login(s, u.Name, password); err != nil {
+			c.report(name, "/login", err.Error())
+			continue
+		}
+		home := c.checkHome(s)
+		c.checkUser(s, name)
+		c.checkUser(s, src.names[src.users[r.Intn(len(src.users))].ID])
+		if tag := pickTag(home, r); tag != "" {
+			tags = append(tags, tag)
+			c.checkSearch(s, "/hashtag/"+url.PathEscape(tag), "#"+tag)
+		}
+		if *query != "" {
+			c.checkSearch(s, "/search?q="+url.QueryEscape(*query), *query)
+		}
+	}
+
+	guest := c.newSession("")
+	for i, j := range sample {
+		if i == *users {
+			break
+		}
+		c.checkUser(guest, src.names[src.users[j].ID])
+	}
+	for _, tag := range tags {
+		c.checkSearch(guest, "/hashtag/"+url.PathEscape(tag), "#"+tag)
+	}
+	if *query != "" {
+		c.checkSearch(guest, "/search?q="+url.QueryEscape(*query), *query)
+	}
+
+	log.Printf("checked %d pages for %d users and guests: %d differences", c.pages, viewers, c.diffs)
+	if viewers == 0 {
+		log.Print("no user could log in; pass their passwords with -passwords")
+	}
+	if c.diffs > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadPasswords reads a file of "name password" lines.
+func loadPasswords(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePasswords(f)
+}
+
+func parsePasswords(r io.Reader) (map[string]string, error) {
+	passwords := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"name password\"", line)
+		}
+		passwords[fields[0]] = fields[1]
+	}
+	return passwords, scanner.Err()
+}
+
+// passwordOf returns the password of u, trying the listed one, then the name.
+func passwordOf(u *user, known map[string]string) (string, bool) {
+	for _, password := range []string{known[u.Name], u.Name} {
+		if password != "" && checkPassword(u, password) {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+var hashtagPattern = regexp.MustCompile(`<a class="hashtag" href="/hashtag/([^"/?]+)">`)
+
+// pickTag returns a hashtag of one of tweets, or "" if they have none.
+func pickTag(tweets *expected, r *rand.Rand) string {
+	if tweets == nil {
+		return ""
+	}
+	var tags []string
+	for _, t := range tweets.Tweets {
+		for _, m := range hashtagPattern.FindAllStringSubmatch(t.HTML, -1) {
+			tags = append(tags, m[1])
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return tags[r.Intn(len(tags))]
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/page"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isuwitter/settings"
+	"github.com/go-redis/redis"
+)
+
+// perPage is the number of tweets isuwitter puts on a page, set by main from
+// the settings.
+var perPage = settings.Default().PerPage
+
+type user struct {
+	ID       int
+	Name     string
+	Salt     string
+	Password string
+}
+
+// source computes what isuwitter should return from the tweets and users in
+// MariaDB, the follows in isutomo and the mutes, blocks and protected
+// accounts in Redis, without going through any of isuwitter's caches.
+type source struct {
+	db      *sql.DB
+	redis   *redis.Client
+	isutomo *client.Client
+
+	users []*user
+	// names maps the IDs to canonical names and ids the canonical names to
+	// the IDs, the smallest ID owning a name shared by several users.
+	names map[int]string
+	ids   map[string]int
+}
+
+func (s *source) loadUsers() error {
+	rows, err := s.db.Query(`SELECT id, name, salt, password FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.users = nil
+	s.names = map[int]string{}
+	s.ids = map[string]int{}
+	for rows.Next() {
+		u := &user{}
+		if err := rows.Scan(&u.ID, &u.Name, &u.Salt, &u.Password); err != nil {
+			return err
+		}
+		name := username.Canonical(u.Name)
+		s.users = append(s.users, u)
+		s.names[u.ID] = name
+		if _, ok := s.ids[name]; !ok {
+			s.ids[name] = u.ID
+		}
+	}
+	return rows.Err()
+}
+
+// checkPassword reports whether password is the one of u.
+func checkPassword(u *user, password string) bool {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(u.Salt+password))) == u.Password
+}
+
+func (s *source) friends(name string) (map[string]bool, error) {
+	friends, err := s.isutomo.GetFriends(context.Background(), name)
+	if err != nil && client.ErrorCode(err) != client.CodeNotFound {
+		return nil, err
+	}
+	return toSet(friends), nil
+}
+
+// hidden returns the users viewer muted or blocked.
+func (s *source) hidden(viewer string) (map[string]bool, error) {
+	if viewer == "" {
+		return map[string]bool{}, nil
+	}
+	users, err := s.redis.SUnion("mutes-"+viewer, "blocks-"+viewer).Result()
+	return toSet(users), err
+}
+
+func (s *source) isBlocking(owner, viewer string) (bool, error) {
+	if viewer == "" {
+		return false, nil
+	}
+	return s.redis.SIsMember("blocks-"+owner, viewer).Result()
+}
+
+func (s *source) protected() (map[string]bool, error) {
+	users, err := s.redis.SMembers("protected").Result()
+	return toSet(users), err
+}
+
+// expected is a timeline page as it should be. Tweets may run past the page
+// by the tweets posted in the same second as the last one, since the order
+// among those is up to MariaDB.
+type expected struct {
+	Status int
+	Tweets []page.Tweet
+}
+
+// home returns the home of viewer: the tweets of the users viewer follows,
+// but those viewer muted or blocked.
+func (s *source) home(viewer, until string) (*expected, error) {
+	friends, err := s.friends(viewer)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := s.hidden(viewer)
+	if err != nil {
+		return nil, err
+	}
+	var ids []interface{}
+	for id, name := range s.names {
+		if friends[name] && !hidden[name] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return &expected{Status: 200}, nil
+	}
+
+	query := `SELECT user_id, text, created_at FROM tweets WHERE user_id IN (?` +
+		strings.Repeat(`, ?`, len(ids)-1) + `)`
+	tweets, err := s.timeline(query, ids, until, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &expected{Status: 200, Tweets: tweets}, nil
+}
+
+// userTimeline returns the page of owner as viewer, "" for a guest, sees
+// it. Protected accounts only show their tweets to their followers, and
+// owner's mutes and blocks do not apply there.
+func (s *source) userTimeline(viewer, owner, until string) (*expected, error) {
+	id, ok := s.ids[owner]
+	if !ok {
+		return &expected{Status: 404}, nil
+	}
+	if blocked, err := s.isBlocking(owner, viewer); err != nil {
+		return nil, err
+	} else if blocked {
+		return &expected{Status: 403}, nil
+	}
+
+	if viewer != owner {
+		protected, err := s.protected()
+		if err != nil {
+			return nil, err
+		}
+		if protected[owner] {
+			if viewer == "" {
+				return &expected{Status: 200}, nil
+			}
+			friends, err := s.friends(viewer)
+			if err != nil {
+				return nil, err
+			}
+			if !friends[owner] {
+				return &expected{Status: 200}, nil
+			}
+		}
+	}
+
+	tweets, err := s.timeline(`SELECT user_id, text, created_at FROM tweets WHERE user_id = ?`,
+		[]interface{}{id}, until, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tweets {
+		tweets[i].User = owner
+	}
+	return &expected{Status: 200, Tweets: tweets}, nil
+}
+
+// search returns the tweets whose HTML contains query, but those of the
+// users viewer muted or blocked and of the protected users viewer does not
+// follow.
+func (s *source) search(viewer, query, until string) (*expected, error) {
+	hidden, err := s.hidden(viewer)
+	if err != nil {
+		return nil, err
+	}
+	invisible, err := s.protected()
+	if err != nil {
+		return nil, err
+	}
+	delete(invisible, viewer)
+	if viewer != "" && len(invisible) > 0 {
+		friends, err := s.friends(viewer)
+		if err != nil {
+			return nil, err
+		}
+		for f := range friends {
+			delete(invisible, f)
+		}
+	}
+
+	// LIKE ignores the case, so it only narrows down the tweets
+	// strings.Contains then decides on.
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query) + "%"
+	tweets, err := s.timeline(`SELECT user_id, text, created_at FROM tweets WHERE text LIKE ?`,
+		[]interface{}{pattern}, until, func(t *page.Tweet) bool {
+			return !hidden[t.User] && !invisible[t.User] && strings.Contains(t.HTML, query)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return &expected{Status: 200, Tweets: tweets}, nil
+}
+
+// timeline runs query, a SELECT of user_id, text and created_at, for the
+// tweets older than until, newest first. It returns the first perPage tweets
+// keep accepts, followed by those posted in the same second as the last one.
+func (s *source) timeline(query string, args []interface{}, until string, keep func(*page.Tweet) bool) ([]page.Tweet, error) {
+	if until != "" {
+		query += ` AND created_at < ?`
+		args = append(args, until)
+	}
+	rows, err := s.db.Query(query+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tweets := []page.Tweet{}
+	for rows.Next() {
+		var (
+			userID    int
+			t         page.Tweet
+			createdAt time.Time
+		)
+		if err := rows.Scan(&userID, &t.HTML, &createdAt); err != nil {
+			return nil, err
+		}
+		t.Time = createdAt.Format(page.TimeFormat)
+		if len(tweets) >= perPage && t.Time != tweets[perPage-1].Time {
+			break
+		}
+		t.User = s.names[userID]
+		if keep != nil && !keep(&t) {
+			continue
+		}
+		tweets = append(tweets, t)
+	}
+	return tweets, rows.Err()
+}
+
+func toSet(a []string) map[string]bool {
+	set := make(map[string]bool, len(a))
+	for _, x := range a {
+		set[x] = true
+	}
+	return set
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// These scenarios go through the production stores; see harness.
+
+func countTweets(body string) int {
+	return strings.Count(body, `class="tweet"`)
+}
+
+func TestE2ELogin(t *testing.T) {
+	h := newHarness(t)
+
+	b := h.guest()
+	b.mustPost("/login", url.Values{"name": {"alice"}, "password": {"bob"}})
+	if _, body := b.get("/"); !strings.Contains(body, "ログインエラー") {
+		t.Errorf("bad password: no flush")
+	}
+	b.mustPost("/login", url.Values{"name": {"nobody"}, "password": {"nobody"}})
+	if _, body := b.get("/"); !strings.Contains(body, "ログインエラー") {
+		t.Errorf("unknown user: no flush")
+	}
+
+	b.mustPost("/login", url.Values{"name": {"ALICE"}, "password": {"alice"}})
+	if _, body := b.get("/alice"); !strings.Contains(body, "あなたのページです") {
+		t.Errorf("login with another case did not log in alice")
+	}
+}
+
+func TestE2EPostAndUserTimeline(t *testing.T) {
+	h := newHarness(t)
+	bob := h.login("bob")
+
+	bob.tweet("hello #isucon")
+	if code, loc := h.guest().post("/", url.Values{"text": {"guest"}}); code != http.StatusFound || loc != "/" {
+		t.Errorf("guest post: %d %q", code, loc)
+	}
+
+	if n := len(h.sql.Tweets()); n != 1 {
+		t.Fatalf("%d rows in tweets", n)
+	}
+	if entries, _ := h.redis.List("tweet-bob"); len(entries) != 1 || !strings.HasSuffix(entries[0], "\t"+htmlify("hello #isucon")) {
+		t.Errorf("tweet-bob = %q", entries)
+	}
+
+	_, page := h.guest().get("/bob")
+	if countTweets(page) != 1 || !strings.Contains(page, `href="/hashtag/isucon"`) {
+		t.Errorf("user page: %s", page)
+	}
+}
+
+func TestE2EFollowAndHome(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	bob := h.login("bob")
+	carol := h.login("carol")
+
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	if friends := h.isutomo.Friends("alice"); len(friends) != 1 || friends[0] != "bob" {
+		t.Errorf("isutomo friends of alice = %q", friends)
+	}
+	if ok, _ := h.redis.SIsMember("friends-alice", "bob"); !ok {
+		t.Errorf("friends-alice lacks bob")
+	}
+	if ok, _ := h.redis.SIsMember("followers-bob", "alice"); !ok {
+		t.Errorf("followers-bob lacks alice")
+	}
+
+	bob.tweet("from bob")
+	carol.tweet("from carol")
+	_, home := alice.get("/")
+	if !strings.Contains(home, "from bob") || strings.Contains(home, "from carol") {
+		t.Errorf("home: %s", home)
+	}
+
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	if _, page := alice.get("/bob"); !strings.Contains(page, "すでにフォローしています") {
+		t.Errorf("follow twice: no flush")
+	}
+
+	alice.mustPost("/unfollow", url.Values{"user": {"bob"}})
+	if friends := h.isutomo.Friends("alice"); len(friends) != 0 {
+		t.Errorf("isutomo friends of alice after unfollow = %q", friends)
+	}
+	if _, home := alice.get("/"); strings.Contains(home, "from bob") {
+		t.Errorf("home shows an unfollowed user")
+	}
+	for _, row := range h.sql.Outbox() {
+		if row.DoneAt == nil {
+			t.Errorf("outbox entry %d is pending", row.ID)
+		}
+	}
+}
+
+func TestE2EFollowWhileIsutomoIsDown(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+
+	h.isutomo.setDown(true)
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	if ok, _ := h.redis.SIsMember("friends-alice", "bob"); ok {
+		t.Fatal("friends-alice has bob before isutomo accepted the follow")
+	}
+	rows := h.sql.Outbox()
+	if len(rows) != 1 || rows[0].DoneAt != nil || rows[0].Attempts != 1 || rows[0].LastError == nil {
+		t.Fatalf("outbox = %+v", rows)
+	}
+	if _, page := alice.get("/bob"); !strings.Contains(page, followPendingMessage) {
+		t.Errorf("the pending follow is not shown")
+	}
+
+	h.isutomo.setDown(false)
+	if err := drainOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if friends := h.isutomo.Friends("alice"); len(friends) != 1 {
+		t.Errorf("isutomo friends of alice = %q", friends)
+	}
+	if ok, _ := h.redis.SIsMember("friends-alice", "bob"); !ok {
+		t.Errorf("friends-alice lacks bob after the retry")
+	}
+	if rows := h.sql.Outbox(); rows[0].DoneAt == nil {
+		t.Errorf("outbox entry is still pending")
+	}
+}
+
+// postEverySecond posts n tweets as b, one second apart, and returns the
+// time of the last one.
+func postEverySecond(h *harness, b *testBrowser, n int, text string) time.Time {
+	now := time.Date(2019, 6, 29, 10, 0, 0, 0, time.Local)
+	h.setClock(&now)
+	for i := 0; i < n; i++ {
+		b.tweet(text)
+		now = now.Add(time.Second)
+	}
+	return now.Add(-time.Second)
+}
+
+// oldest returns the data-time of the last tweet in body.
+func oldest(body string) string {
+	i := strings.LastIndex(body, `data-time="`)
+	if i < 0 {
+		return ""
+	}
+	s := body[i+len(`data-time="`):]
+	return s[:strings.Index(s, `"`)]
+}
+
+func TestE2EUserTimelinePagination(t *testing.T) {
+	h := newHarness(t)
+	bob := h.login("bob")
+	last := postEverySecond(h, bob, cfg.PerPage+5, "tweet")
+
+	guest := h.guest()
+	_, page := guest.get("/bob")
+	if n := countTweets(page); n != cfg.PerPage {
+		t.Fatalf("first page has %d tweets", n)
+	}
+	until := oldest(page)
+	if want := last.Add(-time.Duration(cfg.PerPage-1) * time.Second).Format("2006-01-02 15:04:05"); until != want {
+		t.Errorf("first page ends at %s, want %s", until, want)
+	}
+
+	_, more := guest.get("/bob?append=1&until=" + url.QueryEscape(until))
+	if n := countTweets(more); n != 5 {
+		t.Errorf("second page has %d tweets", n)
+	}
+	if strings.Contains(more, "<html") {
+		t.Errorf("append returned a full page")
+	}
+}
+
+func TestE2EHomePagination(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	bob := h.login("bob")
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	postEverySecond(h, bob, cfg.PerPage+5, "tweet")
+
+	_, home := alice.get("/")
+	if n := countTweets(home); n != cfg.PerPage {
+		t.Fatalf("home has %d tweets", n)
+	}
+	if ok := h.redis.Exists("home-alice"); !ok {
+		t.Errorf("home-alice is not cached")
+	}
+
+	// the next page must not be served from the home cache
+	_, more := alice.get("/?append=1&until=" + url.QueryEscape(oldest(home)))
+	if n := countTweets(more); n != 5 {
+		t.Errorf("second page has %d tweets", n)
+	}
+	if _, again := alice.get("/"); again != home {
+		t.Errorf("home changed after reading the second page")
+	}
+}
+
+func TestE2ESearch(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	bob := h.login("bob")
+
+	postEverySecond(h, bob, cfg.PerPage+3, "ramen #lunch")
+	alice.tweet("sushi #dinner")
+
+	guest := h.guest()
+	_, body := guest.get("/search?q=sushi")
+	if countTweets(body) != 1 {
+		t.Errorf("search sushi: %d tweets", countTweets(body))
+	}
+
+	_, body = guest.get("/hashtag/lunch")
+	if n := countTweets(body); n != cfg.PerPage {
+		t.Fatalf("hashtag lunch: %d tweets", n)
+	}
+	if strings.Contains(body, "sushi") {
+		t.Errorf("hashtag lunch matches #dinner")
+	}
+	_, more := guest.get("/hashtag/lunch?append=1&until=" + url.QueryEscape(oldest(body)))
+	if n := countTweets(more); n != 3 {
+		t.Errorf("hashtag lunch, second page: %d tweets", n)
+	}
+
+	alice.mustPost("/mute", url.Values{"user": {"bob"}})
+	if _, body := alice.get("/search?q=ramen"); countTweets(body) != 0 {
+		t.Errorf("search shows a muted user")
+	}
+}
+
+func TestE2EHomeIsRefreshedByFolloweeTweets(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	bob := h.login("bob")
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+
+	if _, home := alice.get("/"); countTweets(home) != 0 {
+		t.Fatalf("home is not empty")
+	}
+	bob.tweet("fresh")
+	if _, home := alice.get("/"); !strings.Contains(home, "fresh") {
+		t.Errorf("home served from the cache lacks the new tweet of a followee")
+	}
+}
+
+func TestE2EUserCreatedAfterInitialize(t *testing.T) {
+	h := newHarness(t)
+	h.sql.AddUser(1001, "dave", "dave")
+
+	dave := h.login("dave")
+	dave.tweet("hi")
+	if code, page := h.guest().get("/dave"); code != http.StatusOK || countTweets(page) != 1 {
+		t.Errorf("user page: %d %s", code, page)
+	}
+}
+
+func TestE2EFollowersBackfill(t *testing.T) {
+	h := newHarness(t)
+	// an init.rdb from before the followers index
+	h.redis.SAdd("friends-alice", "bob", "carol")
+	h.redis.SAdd("friends-carol", "bob")
+
+	if err := backfillFollowers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := h.redis.Members("followers-bob"); strings.Join(got, ",") != "alice,carol" {
+		t.Errorf("got followers of bob %v", got)
+	}
+	if _, page := h.guest().get("/bob"); !strings.Contains(page, "フォロワー 2") {
+		t.Errorf("follower count of bob not backfilled")
+	}
+}
+
+func TestE2EApproveFollowRequestFailure(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	bob := h.login("bob")
+	alice.mustPost("/settings/protected", url.Values{"protected": {"on"}})
+	bob.mustPost("/follow", url.Values{"user": {"alice"}})
+
+	h.isutomo.setRefuse(true)
+	if code, _ := alice.post("/follow_requests/approve", url.Values{"user": {"bob"}}); code != http.StatusBadRequest {
+		t.Errorf("approve while isutomo refuses: %d", code)
+	}
+	if _, body := alice.get("/follow_requests"); !strings.Contains(body, "bob") {
+		t.Fatal("the request is lost after a failed approval")
+	}
+
+	h.isutomo.setRefuse(false)
+	alice.mustPost("/follow_requests/approve", url.Values{"user": {"bob"}})
+	if friends := h.isutomo.Friends("bob"); len(friends) != 1 {
+		t.Errorf("isutomo friends of bob = %q", friends)
+	}
+}
+
+func TestE2EOutboxAbandonAndPrune(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	alice.mustPost("/follow", url.Values{"user": {"carol"}})
+
+	h.isutomo.setDown(true)
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	before := testutil.ToFloat64(outboxAbandoned)
+	for i := 1; i < outboxMaxAttempts+2; i++ {
+		if err := drainOutbox(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(outboxAbandoned) - before; got != 1 {
+		t.Errorf("got %v abandoned entries, want 1", got)
+	}
+
+	now := time.Now().Add(outboxRetention + time.Hour)
+	h.setClock(&now)
+	if err := pruneOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	rows := h.sql.Outbox()
+	if len(rows) != 1 || rows[0].Friend != "bob" || rows[0].Attempts != outboxMaxAttempts {
+		t.Errorf("outbox after prune = %+v", rows)
+	}
+}
+
+func TestE2EReconcileRepair(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	h.redis.SRem("friends-alice", "bob")
+	h.redis.SAdd("followers-carol", "alice")
+	h.sql.AddFriendship("alice", "carol")
+
+	var out bytes.Buffer
+	if _, err := reconcile(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.sql.Friendships(); len(got) != 1 || got[0] != (Friendship{Me: "alice", Friend: "bob"}) {
+		t.Errorf("friendships after repair = %+v", got)
+	}
+	if ok, _ := h.redis.SIsMember("friends-alice", "bob"); !ok {
+		t.Errorf("friends-alice lacks bob after repair")
+	}
+	if ok, _ := h.redis.SIsMember("followers-carol", "alice"); ok {
+		t.Errorf("followers-carol has alice after repair")
+	}
+
+	out.Reset()
+	if diffs, err := reconcile(&out, false); err != nil || diffs != 0 {
+		t.Errorf("reconcile after repair: %d differences, %v\n%s", diffs, err, out.String())
+	}
+}
+
+func TestE2EDisplayName(t *testing.T) {
+	h := newHarness(t)
+	h.sql.AddUser(1001, "Dave", "Dave")
+
+	dave := h.login("Dave")
+	dave.tweet("hi")
+	_, page := dave.get("/dave")
+	for _, want := range []string{"こんにちは Daveさん", "<h3>Dave さんのツイート</h3>", `<a href="/dave" class="tweet-user-name">Dave</a>`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("user page lacks %q", want)
+		}
+	}
+}
+
+func TestE2ERefreshKeepsHomeCache(t *testing.T) {
+	h := newHarness(t)
+	alice := h.login("alice")
+	bob := h.login("bob")
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	bob.mustPost("/follow", url.Values{"user": {"carol"}})
+	store := redisFollowStore{users: sqlUserStore{}}
+
+	alice.get("/")
+	if err := store.RefreshRecommendations("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if h.redis.Exists("home-alice") {
+		t.Error("home-alice is kept after new recommendations")
+	}
+	if _, home := alice.get("/"); !strings.Contains(home, `href="/carol" class="user-name"`) {
+		t.Error("home lacks the new recommendations")
+	}
+
+	if err := store.RefreshRecommendations("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !h.redis.Exists("home-alice") {
+		t.Error("home-alice is dropped although the recommendations did not change")
+	}
+}
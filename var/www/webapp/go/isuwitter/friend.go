@@ -2,22 +2,29 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
-type Friend struct {
-	ID      int64  `db:"id"`
-	Me      string `db:"me"`
-	Friends string `db:"friends"`
+// Friendship is a row of isutomo's friendships table: me follows Friend.
+type Friendship struct {
+	Me     string `db:"me"`
+	Friend string `db:"friend"`
 }
 
 func loadFriends(pctx context.Context, name string) (context.Context, []string, error) {
 	ctx, task := trace.NewTask(pctx, "loadFriends")
 	defer task.End()
 
-	friends, err := redisClient.SMembers("friends-" + name).Result()
+	friends, err := redisFor(ctx).SMembers("friends-" + name).Result()
 	if err != nil {
 		logger.Error("redis.SMembers", zap.Error(err))
 		return ctx, nil, err
@@ -30,18 +37,181 @@ func loadFriends(pctx context.Context, name string) (context.Context, []string,
 	return ctx, friends, nil
 }
 
-func addFriend(me, friend string) error {
-	err := redisClient.SAdd("friends-"+me, friend).Err()
+// addFriend stores the follow in both friends-<me> and the reverse index
+// followers-<friend> so that the two sets never disagree.
+func addFriend(ctx context.Context, me, friend string) error {
+	return addFriends(ctx, me, []string{friend})
+}
+
+// addFriends is addFriend for all the friends of me in a single MULTI/EXEC.
+func addFriends(ctx context.Context, me string, friends []string) error {
+	if len(friends) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(friends))
+	for i, f := range friends {
+		members[i] = f
+	}
+	_, err := redisFor(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd("friends-"+me, members...)
+		for _, f := range friends {
+			pipe.SAdd("followers-"+f, me)
+		}
+		return nil
+	})
 	if err != nil {
 		logger.Error("redis.SAdd", zap.Error(err))
 	}
 	return err
 }
 
-func removeFriend(me, friend string) error {
-	err := redisClient.SRem("friends-"+me, friend).Err()
+// backfillFollowers derives the followers-<name> index from the
+// friends-<name> sets when Redis has none, as in an init.rdb created before
+// the index existed.
+func backfillFollowers(ctx context.Context) error {
+	rc := redisFor(ctx)
+	found := rc.Scan(0, "followers-*", 1000).Iterator()
+	if found.Next() {
+		return nil
+	}
+	if err := found.Err(); err != nil {
+		logger.Error("redis.Scan", zap.Error(err))
+		return err
+	}
+
+	iter := rc.Scan(0, "friends-*", 1000).Iterator()
+	for iter.Next() {
+		me := strings.TrimPrefix(iter.Val(), "friends-")
+		friends, err := rc.SMembers(iter.Val()).Result()
+		if err != nil {
+			logger.Error("redis.SMembers", zap.Error(err))
+			return err
+		}
+		if err := addFriends(ctx, me, friends); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		logger.Error("redis.Scan", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func removeFriend(ctx context.Context, me, friend string) error {
+	_, err := redisFor(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem("friends-"+me, friend)
+		pipe.SRem("followers-"+friend, me)
+		return nil
+	})
 	if err != nil {
 		logger.Error("redis.SRem", zap.Error(err))
 	}
 	return err
 }
+
+// paginateNames sorts names and returns the page-th (1-origin) slice of size
+// cfg.PerPage, and the next page number or 0 when there is no more page.
+func paginateNames(names []string, page int) ([]string, int) {
+	sort.Strings(names)
+	// compare pages before multiplying, which overflows for huge pages
+	if page-1 >= (len(names)+cfg.PerPage-1)/cfg.PerPage {
+		return []string{}, 0
+	}
+	start := (page - 1) * cfg.PerPage
+	end := start + cfg.PerPage
+	if end >= len(names) {
+		return names[start:], 0
+	}
+	return names[start:end], page + 1
+}
+
+// loadFollowList returns the following or followers list of user depending on
+// kind ("following" or "followers").
+func (a *app) loadFollowList(ctx context.Context, user, kind string) ([]string, error) {
+	if kind == "followers" {
+		return a.follows.Followers(ctx, user)
+	}
+	return a.follows.Friends(ctx, user)
+}
+
+func parsePage(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+func (a *app) followListHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		session := a.getSession(w, r)
+		userID, ok := session.Values["user_id"]
+		if ok {
+			name = a.sessionUserName(r, userID.(int))
+		}
+
+		user := username.Canonical(mux.Vars(r)["user"])
+		if a.getuserID(user) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		names, err := a.loadFollowList(r.Context(), user, kind)
+		if err != nil {
+			badRequest(w)
+			return
+		}
+		following, followers, err := a.follows.CountFollows(r.Context(), user)
+		if err != nil {
+			badRequest(w)
+			return
+		}
+		page := parsePage(r)
+		users, next := paginateNames(names, page)
+
+		a.render.HTML(w, http.StatusOK, "follows", struct {
+			Name      string
+			User      string
+			Kind      string
+			Users     []string
+			Following int64
+			Followers int64
+			Page      int
+			NextPage  int
+		}{
+			name, user, kind, users, following, followers, page, next,
+		})
+	}
+}
+
+func (a *app) apiFollowListHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := username.Canonical(mux.Vars(r)["user"])
+		if a.getuserID(user) == 0 {
+			a.render.JSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+			return
+		}
+
+		names, err := a.loadFollowList(r.Context(), user, kind)
+		if err != nil {
+			logger.Error("loadFollowList", zap.Error(err), zap.String("user", user), zap.String("kind", kind))
+			a.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+			return
+		}
+		page := parsePage(r)
+		total := len(names)
+		users, next := paginateNames(names, page)
+
+		a.render.JSON(w, http.StatusOK, struct {
+			User     string   `json:"user"`
+			Users    []string `json:"users"`
+			Count    int      `json:"count"`
+			Page     int      `json:"page"`
+			NextPage int      `json:"next_page,omitempty"`
+		}{
+			user, users, total, page, next,
+		})
+	}
+}
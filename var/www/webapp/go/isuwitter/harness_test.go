@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/sessions"
+)
+
+// harness runs the production app (sqlTweetStore, sqlUserStore and
+// redisFollowStore) with miniredis in place of Redis, fakeSQL in place of
+// MariaDB and stubIsutomo in place of isutomo. Since the app talks to them
+// through package globals, tests using a harness must not run in parallel.
+type harness struct {
+	t       *testing.T
+	redis   *miniredis.Miniredis
+	sql     *fakeSQL
+	isutomo *stubIsutomo
+	server  *httptest.Server
+	// internal serves internalHandler, as the internal listener does.
+	internal *httptest.Server
+}
+
+// newHarness starts a harness holding alice, bob and carol, whose password
+// is their name.
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+
+	stub := newStubIsutomo()
+	isutomoServer := httptest.NewServer(stub)
+	t.Cleanup(isutomoServer.Close)
+
+	h := &harness{t: t, redis: mr, sql: newFakeSQL(), isutomo: stub}
+
+	savedDB, savedRedis, savedIsutomo := db, redisClient, isutomoClient
+	savedIDs, savedKeys, savedNames, savedLoaded, savedClock := userIDuserName, userIDcanonicalName, userNameuserID, directoryLoaded, clock
+	t.Cleanup(func() {
+		db, redisClient, isutomoClient = savedDB, savedRedis, savedIsutomo
+		userIDuserName, userIDcanonicalName, userNameuserID, directoryLoaded, clock = savedIDs, savedKeys, savedNames, savedLoaded, savedClock
+	})
+
+	db = sql.OpenDB(h.sql)
+	redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	isutomoClient = client.New(isutomoServer.URL)
+	userIDuserName = make(map[int]string)
+	userIDcanonicalName = make(map[int]string)
+	userNameuserID = make(map[string]int)
+	directoryLoaded = false
+
+	if err := ensureOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		h.addUser(i+1, name)
+	}
+
+	h.server = httptest.NewServer(newApp(sessions.NewCookieStore([]byte(cfg.SessionSecret))).router())
+	t.Cleanup(h.server.Close)
+	h.internal = httptest.NewServer(internalHandler(false))
+	t.Cleanup(h.internal.Close)
+	return h
+}
+
+// addUser registers a user whose password is name.
+func (h *harness) addUser(id int, name string) {
+	h.sql.AddUser(id, name, name)
+	addUserToDirectory(id, name)
+}
+
+// setClock makes NOW() and clock return the time now points to.
+func (h *harness) setClock(now *time.Time) {
+	h.sql.mu.Lock()
+	defer h.sql.mu.Unlock()
+
+	h.sql.now = func() time.Time { return *now }
+	clock = h.sql.now
+}
+
+// login returns a browser logged in as name.
+func (h *harness) login(name string) *testBrowser {
+	h.t.Helper()
+	return login(h.t, h.server, name)
+}
+
+func (h *harness) guest() *testBrowser {
+	return newTestBrowser(h.t, h.server)
+}
+
+// probe returns a client of the internal listener.
+func (h *harness) probe() *testBrowser {
+	return newTestBrowser(h.t, h.internal)
+}
+
+// stubIsutomo serves the part of the isutomo API isuwitter uses, keeping the
+// friendships in memory. Set down to make it answer 503, and refuse to make it
+// answer 422 to every follow change.
+type stubIsutomo struct {
+	mu      sync.Mutex
+	friends map[string]map[string]bool
+	down    bool
+	refuse  bool
+}
+
+func newStubIsutomo() *stubIsutomo {
+	return &stubIsutomo{friends: map[string]map[string]bool{}}
+}
+
+func (s *stubIsutomo) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.down = down
+}
+
+func (s *stubIsutomo) setRefuse(refuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refuse = refuse
+}
+
+// Friends returns whom me follows in isutomo.
+func (s *stubIsutomo) Friends(me string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(me)
+}
+
+func (s *stubIsutomo) list(me string) []string {
+	friends := []string{}
+	for f := range s.friends[me] {
+		friends = append(friends, f)
+	}
+	sort.Strings(friends)
+	return friends
+}
+
+func (s *stubIsutomo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeError := func(status int, code, message string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"code": code, "error": message})
+	}
+	if s.down {
+		writeError(http.StatusServiceUnavailable, "internal", "isutomo is down")
+		return
+	}
+
+	if r.URL.Path == "/_/healthz" {
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		return
+	}
+	if r.URL.Path == "/initialize" {
+		s.friends = map[string]map[string]bool{}
+		json.NewEncoder(w).Encode(map[string][]string{"result": {"ok"}})
+		return
+	}
+
+	me := strings.TrimPrefix(r.URL.Path, "/")
+	if me == "" || strings.Contains(me, "/") {
+		writeError(http.StatusNotFound, client.CodeNotFound, "no such endpoint")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPut:
+	case http.MethodPost, http.MethodDelete:
+		var body struct {
+			User string `json:"user"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.User == "" {
+			writeError(http.StatusUnprocessableEntity, client.CodeInvalidBody, "user is required")
+			return
+		}
+		if s.refuse {
+			writeError(http.StatusUnprocessableEntity, client.CodeInvalidParameter, "refused")
+			return
+		}
+		if r.Method == http.MethodPost {
+			if s.friends[me][body.User] {
+				writeError(http.StatusConflict, client.CodeAlreadyFollowing, body.User+" is already your friend.")
+				return
+			}
+			if s.friends[me] == nil {
+				s.friends[me] = map[string]bool{}
+			}
+			s.friends[me][body.User] = true
+		} else {
+			if !s.friends[me][body.User] {
+				writeError(http.StatusConflict, client.CodeNotFollowing, body.User+" is not your friend.")
+				return
+			}
+			delete(s.friends[me], body.User)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"friends": s.list(me)})
+}
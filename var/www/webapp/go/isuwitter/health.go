@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/health"
+)
+
+// /healthz and /readyz, served with /metrics on the internal listener only, so that they neither are public through nginx nor
+// shadow the pages of users named after them. readiness checks what isuwitter
+// needs to serve pages; main adds the server check, which fails once shutdown
+// started.
+
+const readyTimeout = 2 * time.Second
+
+var (
+	readiness       = newReadiness()
+	errShuttingDown = errors.New("shutting down")
+)
+
+// internalHandler serves the cfg.Internal listener, with net/http/pprof
+// when pprof is set.
+func internalHandler(pprof bool) http.Handler {
+	mux := http.NewServeMux()
+	if pprof {
+		// net/http/pprof registers itself on http.DefaultServeMux
+		mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	}
+	mux.HandleFunc("/healthz", health.LiveHandler)
+	mux.HandleFunc("/readyz", readiness.ReadyHandler)
+	mux.Handle("/metrics", metricsHandler())
+	return mux
+}
+
+func newReadiness() *health.Checker {
+	c := health.New(readyTimeout)
+	c.Add("mysql", func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+	c.Add("redis", func(ctx context.Context) error {
+		return redisClient.WithContext(ctx).Ping().Err()
+	})
+	c.Add("isutomo", func(ctx context.Context) error {
+		return isutomoClient.Ping(ctx)
+	})
+	c.Add("directory", checkDirectory)
+	return c
+}
+
+// checkDirectory loads the user directory if it failed to load at startup.
+func checkDirectory(ctx context.Context) error {
+	directoryMu.RLock()
+	loaded := directoryLoaded
+	directoryMu.RUnlock()
+	if loaded {
+		return nil
+	}
+	if err := loadDirectory(ctx); err != nil {
+		return errors.New("not loaded: " + err.Error())
+	}
+	return nil
+}
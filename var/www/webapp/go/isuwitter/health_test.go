@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/health"
+)
+
+func readyz(t *testing.T, h *harness) (int, health.Report) {
+	t.Helper()
+	status, body := h.probe().get("/readyz")
+	var report health.Report
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("readyz: %v in %q", err, body)
+	}
+	return status, report
+}
+
+func TestHealthz(t *testing.T) {
+	h := newHarness(t)
+	if status, body := h.probe().get("/healthz"); status != http.StatusOK || body != `{"status":"ok"}`+"\n" {
+		t.Errorf("got %d %q", status, body)
+	}
+	// without pprof, whose listener may be turned off on its own
+	if status, _ := h.probe().get("/debug/pprof/"); status != http.StatusNotFound {
+		t.Errorf("pprof: got %d", status)
+	}
+	// the public router leaves the name to a user
+	h.addUser(4, "healthz")
+	if status, body := h.guest().get("/healthz"); status != http.StatusOK || !strings.Contains(body, "healthz さんのツイート") {
+		t.Errorf("public /healthz: got %d %q", status, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := newHarness(t)
+
+	status, report := readyz(t, h)
+	if status != http.StatusOK || report.Status != health.StatusOK {
+		t.Fatalf("got %d %+v", status, report)
+	}
+	for _, name := range []string{"mysql", "redis", "isutomo", "directory"} {
+		if got := report.Checks[name]; got.Status != health.StatusOK {
+			t.Errorf("%s: got %+v", name, got)
+		}
+	}
+	// the directory check loaded the users
+	if !directoryLoaded {
+		t.Error("the directory is not loaded")
+	}
+}
+
+func TestReadyzDependencyDown(t *testing.T) {
+	h := newHarness(t)
+
+	h.isutomo.setDown(true)
+	status, report := readyz(t, h)
+	if status != http.StatusServiceUnavailable || report.Status != health.StatusFail {
+		t.Errorf("isutomo down: got %d %q", status, report.Status)
+	}
+	if got := report.Checks["isutomo"]; got.Status != health.StatusFail || got.Error == "" {
+		t.Errorf("isutomo down: got %+v", got)
+	}
+	if got := report.Checks["redis"]; got.Status != health.StatusOK {
+		t.Errorf("isutomo down: redis got %+v", got)
+	}
+	h.isutomo.setDown(false)
+
+	h.redis.Close()
+	status, report = readyz(t, h)
+	if status != http.StatusServiceUnavailable || report.Checks["redis"].Status != health.StatusFail {
+		t.Errorf("Redis down: got %d %+v", status, report.Checks["redis"])
+	}
+	if got := report.Checks["isutomo"]; got.Status != health.StatusOK {
+		t.Errorf("Redis down: isutomo got %+v", got)
+	}
+}
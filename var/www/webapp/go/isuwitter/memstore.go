@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+)
+
+// memStore keeps tweets, users and the social graph in memory. It implements
+// TweetStore, UserStore and FollowStore so that the handlers can run without
+// MariaDB, Redis or isutomo.
+type memStore struct {
+	mu sync.Mutex
+
+	// now is the clock stamped on posted tweets.
+	now func() time.Time
+
+	tweets []*Tweet // ordered by CreatedAt, then ID
+	homes  map[string]string
+
+	users map[int]*User
+	ids   map[string]int
+
+	friends   map[string]map[string]bool
+	mutes     map[string]map[string]bool
+	blocks    map[string]map[string]bool
+	requests  map[string]map[string]bool
+	protected map[string]bool
+	recommend map[string][]Recommendation
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		now:       time.Now,
+		homes:     map[string]string{},
+		users:     map[int]*User{},
+		ids:       map[string]int{},
+		friends:   map[string]map[string]bool{},
+		mutes:     map[string]map[string]bool{},
+		blocks:    map[string]map[string]bool{},
+		requests:  map[string]map[string]bool{},
+		protected: map[string]bool{},
+		recommend: map[string][]Recommendation{},
+	}
+}
+
+// AddUser registers a user who logs in with password.
+func (s *memStore) AddUser(id int, name, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	salt := name
+	s.users[id] = &User{ID: id, Name: name, Salt: salt, Password: hashPassword(salt, password)}
+	s.ids[name] = id
+}
+
+func (s *memStore) Post(ctx context.Context, userID int, name, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := &Tweet{
+		ID:        len(s.tweets) + 1,
+		UserID:    userID,
+		HTML:      text,
+		CreatedAt: s.now().Truncate(time.Second),
+	}
+	t.Time = t.CreatedAt.Format("2006-01-02 15:04:05")
+	s.tweets = append(s.tweets, t)
+	sort.SliceStable(s.tweets, func(i, j int) bool {
+		if !s.tweets[i].CreatedAt.Equal(s.tweets[j].CreatedAt) {
+			return s.tweets[i].CreatedAt.Before(s.tweets[j].CreatedAt)
+		}
+		return s.tweets[i].ID < s.tweets[j].ID
+	})
+	return nil
+}
+
+// before returns copies of the tweets created before until, newest first.
+func (s *memStore) before(until string) ([]Tweet, error) {
+	var bound time.Time
+	if until != "" {
+		var err error
+		bound, err = time.ParseInLocation("2006-01-02 15:04:05", until, time.Local)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tweets := make([]Tweet, 0, len(s.tweets))
+	for i := len(s.tweets) - 1; i >= 0; i-- {
+		if until != "" && !s.tweets[i].CreatedAt.Before(bound) {
+			continue
+		}
+		tweets = append(tweets, *s.tweets[i])
+	}
+	return tweets, nil
+}
+
+func (s *memStore) Scan(ctx context.Context, until string, limit int, keep func(*Tweet) (bool, error)) ([]*Tweet, error) {
+	candidates, err := s.before(until)
+	if err != nil {
+		return nil, err
+	}
+
+	tweets := make([]*Tweet, 0)
+	for i := range candidates {
+		t := &candidates[i]
+		ok, err := keep(t)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tweets = append(tweets, t)
+		}
+		if len(tweets) == limit {
+			break
+		}
+	}
+	return tweets, nil
+}
+
+func (s *memStore) UserTimeline(ctx context.Context, userID int, name, until string) ([]*Tweet, error) {
+	return s.Scan(ctx, until, cfg.PerPage, func(t *Tweet) (bool, error) {
+		t.UserName = name
+		return t.UserID == userID, nil
+	})
+}
+
+func (s *memStore) HomeCache(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	home, ok := s.homes[name]
+	if !ok {
+		return "", errCacheMiss
+	}
+	return home, nil
+}
+
+func (s *memStore) SetHomeCache(ctx context.Context, name, home string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.homes[name] = home
+	return nil
+}
+
+func (s *memStore) ClearHomeCache(ctx context.Context, names ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		delete(s.homes, name)
+	}
+	return nil
+}
+
+func (s *memStore) Authenticate(name, password string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[s.ids[name]]
+	if !ok || user.Password != hashPassword(user.Salt, password) {
+		return nil, nil
+	}
+	u := *user
+	return &u, nil
+}
+
+func (s *memStore) Name(id int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		return user.Name
+	}
+	return ""
+}
+
+func (s *memStore) DisplayName(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[s.ids[name]]; ok {
+		return user.Name
+	}
+	return name
+}
+
+func (s *memStore) ID(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ids[name]
+}
+
+func (s *memStore) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.ids))
+	for name := range s.ids {
+		names = append(names, name)
+	}
+	return names
+}
+
+// members returns the elements of set[key] in order.
+func members(set map[string]map[string]bool, key string) []string {
+	result := make([]string, 0, len(set[key]))
+	for m := range set[key] {
+		result = append(result, m)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func addMember(set map[string]map[string]bool, key, member string) bool {
+	if set[key] == nil {
+		set[key] = map[string]bool{}
+	}
+	if set[key][member] {
+		return false
+	}
+	set[key][member] = true
+	return true
+}
+
+func removeMember(set map[string]map[string]bool, key, member string) bool {
+	if !set[key][member] {
+		return false
+	}
+	delete(set[key], member)
+	return true
+}
+
+func (s *memStore) Friends(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return members(s.friends, name), nil
+}
+
+func (s *memStore) Followers(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.followers(name), nil
+}
+
+func (s *memStore) followers(name string) []string {
+	result := []string{}
+	for me, friends := range s.friends {
+		if friends[name] {
+			result = append(result, me)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *memStore) CountFollows(ctx context.Context, name string) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int64(len(s.friends[name])), int64(len(s.followers(name))), nil
+}
+
+func (s *memStore) IsFollowing(ctx context.Context, me, user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.friends[me][user], nil
+}
+
+// Follow fails the way isutomo does.
+func (s *memStore) Follow(ctx context.Context, me, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user == "" {
+		return &client.Error{Method: http.MethodPost, Path: "/" + me, StatusCode: http.StatusUnprocessableEntity, Code: client.CodeInvalidBody, Message: "user is required"}
+	}
+	if !addMember(s.friends, me, user) {
+		return &client.Error{Method: http.MethodPost, Path: "/" + me, StatusCode: http.StatusConflict, Code: client.CodeAlreadyFollowing, Message: user + " is already your friend."}
+	}
+	return nil
+}
+
+func (s *memStore) Unfollow(ctx context.Context, me, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user == "" {
+		return &client.Error{Method: http.MethodDelete, Path: "/" + me, StatusCode: http.StatusUnprocessableEntity, Code: client.CodeInvalidBody, Message: "user is required"}
+	}
+	if !removeMember(s.friends, me, user) {
+		return &client.Error{Method: http.MethodDelete, Path: "/" + me, StatusCode: http.StatusConflict, Code: client.CodeNotFollowing, Message: user + " is not your friend."}
+	}
+	return nil
+}
+
+func (s *memStore) Mutes(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return members(s.mutes, name), nil
+}
+
+func (s *memStore) Blocks(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return members(s.blocks, name), nil
+}
+
+func (s *memStore) Hidden(ctx context.Context, name string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hidden(name), nil
+}
+
+func (s *memStore) hidden(name string) map[string]bool {
+	hidden := map[string]bool{}
+	for u := range s.mutes[name] {
+		hidden[u] = true
+	}
+	for u := range s.blocks[name] {
+		hidden[u] = true
+	}
+	return hidden
+}
+
+func (s *memStore) IsMuting(ctx context.Context, me, user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mutes[me][user], nil
+}
+
+func (s *memStore) IsBlocking(ctx context.Context, owner, user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.blocks[owner][user], nil
+}
+
+func (s *memStore) Mute(ctx context.Context, me, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addMember(s.mutes, me, user)
+	return nil
+}
+
+func (s *memStore) Unmute(ctx context.Context, me, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removeMember(s.mutes, me, user)
+	return nil
+}
+
+func (s *memStore) Block(ctx context.Context, me, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addMember(s.blocks, me, user)
+	removeMember(s.requests, me, user)
+	return nil
+}
+
+func (s *memStore) Unblock(ctx context.Context, me, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removeMember(s.blocks, me, user)
+	return nil
+}
+
+func (s *memStore) IsProtected(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.protected[name], nil
+}
+
+func (s *memStore) SetProtected(ctx context.Context, name string, protected bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if protected {
+		s.protected[name] = true
+		return nil
+	}
+	delete(s.protected, name)
+	delete(s.requests, name)
+	return nil
+}
+
+func (s *memStore) Protected(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]string, 0, len(s.protected))
+	for name := range s.protected {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (s *memStore) FollowRequests(ctx context.Context, owner string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return members(s.requests, owner), nil
+}
+
+func (s *memStore) HasRequestedFollow(ctx context.Context, me, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[owner][me], nil
+}
+
+func (s *memStore) RequestFollow(ctx context.Context, me, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addMember(s.requests, owner, me)
+	return nil
+}
+
+func (s *memStore) RemoveFollowRequest(ctx context.Context, owner, me string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return removeMember(s.requests, owner, me), nil
+}
+
+func (s *memStore) Recommendations(ctx context.Context, name string) ([]Recommendation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skip := s.hidden(name)
+	for u := range s.friends[name] {
+		skip[u] = true
+	}
+	result := make([]Recommendation, 0, len(s.recommend[name]))
+	for _, rec := range s.recommend[name] {
+		if !skip[rec.Name] {
+			result = append(result, rec)
+		}
+	}
+	return result, nil
+}
+
+// RefreshRecommendations scores candidates the same way as
+// redisFollowStore.computeRecommendations.
+func (s *memStore) RefreshRecommendations(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skip := s.hidden(name)
+	skip[name] = true
+	for u := range s.friends[name] {
+		skip[u] = true
+	}
+
+	scores := map[string]float64{}
+	for f := range s.friends[name] {
+		for c := range s.friends[f] {
+			if !skip[c] && s.ids[c] != 0 {
+				scores[c]++
+			}
+		}
+	}
+	recent := map[string]bool{}
+	now := s.now()
+	for i := len(s.tweets) - 1; i >= 0; i-- {
+		t := s.tweets[i]
+		if now.Sub(t.CreatedAt) >= recommendActiveWindow {
+			break
+		}
+		if user, ok := s.users[t.UserID]; ok {
+			recent[user.Name] = true
+		}
+	}
+	for c := range scores {
+		if recent[c] {
+			scores[c] += recommendActiveBonus
+		}
+	}
+
+	recommendations := topRecommendations(scores)
+	if sameRecommendations(s.recommend[name], recommendations) {
+		return nil
+	}
+	s.recommend[name] = recommendations
+	delete(s.homes, name)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served on /metrics of the internal listener. Routes are
+// labeled by their mux template, so /alice and /bob both count as /{user}.
+
+const metricsNamespace = "isuwitter"
+
+var (
+	metrics = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve HTTP requests by method and route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	homeCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "home_cache_lookups_total",
+		Help:      "Lookups of the cached home page of a user by result: hit, miss or error.",
+	}, []string{"result"})
+
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Time Redis commands took by command, pipelines counting as one.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	}, []string{"command"})
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_command_errors_total",
+		Help:      "Redis commands that failed by command; a missing key is not a failure.",
+	}, []string{"command"})
+
+	isutomoCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "isutomo_calls_total",
+		Help:      "Calls to isutomo by client method and outcome: ok, timeout, error or the isutomo error code.",
+	}, []string{"op", "outcome"})
+	isutomoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "isutomo_call_duration_seconds",
+		Help:      "Time calls to isutomo took by client method, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	outboxAbandoned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "follow_outbox_abandoned_total",
+		Help:      "Follow changes given up on after too many failed attempts.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		homeCacheLookups,
+		redisDuration, redisErrors,
+		isutomoCalls, isutomoDuration,
+		outboxAbandoned,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+// instrumentDB exports the connection pool stats of db.
+func instrumentDB(db *sql.DB) {
+	metrics.MustRegister(collectors.NewDBStatsCollector(db, "isuwitter"))
+}
+
+// statusRecorder remembers the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// routeName returns the template of the route mux matched r with.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// recordRoute is the mux middleware telling logRequests and instrumentHTTP,
+// which wrap the router, the route r matched, and naming the request span
+// after it. Requests matching no route keep the route "unknown".
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(r)
+		requestLogOf(r).route = route
+		tracing.SetRoute(r.Context(), r.Method, route)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrumentHTTP counts requests and their latency by the route recordRoute
+// found.
+func instrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := requestLogOf(r).route
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeHomeCache counts a lookup of the home cache by its result.
+func observeHomeCache(err error) {
+	homeCacheLookups.WithLabelValues(homeCacheResult(err)).Inc()
+}
+
+// homeCacheResult returns "hit", "miss" or "error" depending on the error of
+// a home cache lookup.
+func homeCacheResult(err error) string {
+	switch {
+	case err == nil:
+		return "hit"
+	case err == errCacheMiss:
+		return "miss"
+	default:
+		return "error"
+	}
+}
+
+// instrumentRedis times the commands and pipelines c sends.
+func instrumentRedis(c *redis.Client) {
+	c.WrapProcess(func(process func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			start := time.Now()
+			err := process(cmd)
+			observeRedis(cmd.Name(), time.Since(start), err)
+			return err
+		}
+	})
+	c.WrapProcessPipeline(func(process func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			start := time.Now()
+			err := process(cmds)
+			observeRedis("pipeline", time.Since(start), err)
+			return err
+		}
+	})
+}
+
+func observeRedis(command string, elapsed time.Duration, err error) {
+	redisDuration.WithLabelValues(command).Observe(elapsed.Seconds())
+	if err != nil && err != redis.Nil {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// observeIsutomo is the client.Client Observe hook.
+func observeIsutomo(op string, elapsed time.Duration, err error) {
+	isutomoCalls.WithLabelValues(op, isutomoOutcome(err)).Inc()
+	isutomoDuration.WithLabelValues(op).Observe(elapsed.Seconds())
+}
+
+func isutomoOutcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if code := client.ErrorCode(err); code != "" {
+		return code
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "error"
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	h := newHarness(t)
+	instrumentRedis(redisClient)
+	isutomoClient.Observe = observeIsutomo
+
+	userPage := httpRequests.WithLabelValues("GET", "/{user}", "200")
+	hits, misses := homeCacheLookups.WithLabelValues("hit"), homeCacheLookups.WithLabelValues("miss")
+	follows := isutomoCalls.WithLabelValues("Follow", "ok")
+	unknown := httpRequests.WithLabelValues("DELETE", "unknown", "405")
+	before := []float64{testutil.ToFloat64(userPage), testutil.ToFloat64(hits), testutil.ToFloat64(misses), testutil.ToFloat64(follows), testutil.ToFloat64(unknown)}
+
+	alice := h.login("alice")
+	alice.get("/bob")
+	alice.get("/carol")
+	alice.get("/")
+	alice.get("/")
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	req, err := http.NewRequest(http.MethodDelete, h.server.URL+"/bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.do(req).Body.Close()
+
+	after := []float64{testutil.ToFloat64(userPage), testutil.ToFloat64(hits), testutil.ToFloat64(misses), testutil.ToFloat64(follows), testutil.ToFloat64(unknown)}
+	for i, name := range []string{"GET /{user} 200", "home cache hits", "home cache misses", "isutomo Follow ok", "DELETE unknown 405"} {
+		want := []float64{2, 1, 1, 1, 1}[i]
+		if got := after[i] - before[i]; got != want {
+			t.Errorf("%s: got %v more, want %v", name, got, want)
+		}
+	}
+
+	if status, _ := h.guest().get("/metrics"); status != http.StatusNotFound {
+		t.Errorf("public /metrics: got %d", status)
+	}
+	status, body := h.probe().get("/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("/metrics: got %d", status)
+	}
+	for _, want := range []string{
+		`isuwitter_http_request_duration_seconds_count{method="GET",route="/{user}"}`,
+		`isuwitter_redis_command_duration_seconds_count{command="get"}`,
+		`isuwitter_isutomo_call_duration_seconds_count{op="Follow"}`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+}
+
+func TestIsutomoOutcome(t *testing.T) {
+	h := newHarness(t)
+	h.isutomo.setDown(true)
+	_, err := isutomoClient.GetFriends(context.Background(), "alice")
+	if got := isutomoOutcome(err); got != "internal" {
+		t.Errorf("isutomo down: got %q", got)
+	}
+	if got := isutomoOutcome(nil); got != "ok" {
+		t.Errorf("no error: got %q", got)
+	}
+}
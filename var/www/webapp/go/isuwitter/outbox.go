@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"go.uber.org/zap"
+)
+
+// Follow state is owned by isutomo (its friendships table in MariaDB). The Redis
+// friends-<name>/followers-<name> sets are a cache of it. Every follow change
+// is first recorded in the follow_outbox table and then propagated to isutomo
+// and Redis; entries that fail are retried by outboxLoop, so a crash or a
+// Redis error between the two writes no longer leaves them out of sync.
+
+const (
+	outboxFollow   = "follow"
+	outboxUnfollow = "unfollow"
+
+	outboxInterval    = 5 * time.Second
+	outboxBatchSize   = 100
+	outboxMaxAttempts = 10
+	// outboxRetention is how long done entries are kept
+	outboxRetention = 24 * time.Hour
+	// outboxLockTimeout bounds the wait for the lock of a pair of users
+	outboxLockTimeout = 10 * time.Second
+)
+
+// errFollowPending tells that a follow change is recorded but could not be
+// applied yet; outboxLoop retries it.
+var errFollowPending = errors.New("follow change pending")
+
+type outboxEntry struct {
+	ID       int64
+	Op       string
+	Me       string
+	Friend   string
+	Attempts int
+
+	// Result is the isutomo error telling that the change was already
+	// applied, if any.
+	Result *client.Error
+}
+
+func ensureOutbox() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS follow_outbox (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		op VARCHAR(8) NOT NULL,
+		me VARCHAR(20) NOT NULL,
+		friend VARCHAR(20) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at DATETIME NOT NULL,
+		done_at DATETIME,
+		INDEX pending (done_at, id)
+	)`)
+	return err
+}
+
+// follow records that me follows friend and applies it right away. On a
+// temporary failure errFollowPending is returned and outboxLoop retries. When
+// me already followed friend, the state is still synced and a *client.Error
+// with client.CodeAlreadyFollowing is returned.
+func follow(ctx context.Context, me, friend string) error {
+	return enqueueFollowChange(ctx, outboxFollow, me, friend)
+}
+
+// unfollow is the counterpart of follow.
+func unfollow(ctx context.Context, me, friend string) error {
+	return enqueueFollowChange(ctx, outboxUnfollow, me, friend)
+}
+
+func enqueueFollowChange(ctx context.Context, op, me, friend string) error {
+	// a change once recorded is applied even if the client goes away
+	ctx = detach(ctx)
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO follow_outbox (op, me, friend, created_at) VALUES (?, ?, ?, NOW())`,
+		op, me, friend,
+	)
+	if err != nil {
+		logger.Error("enqueueFollowChange", zap.Error(err), zap.String("op", op), zap.String("me", me))
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	// the entries recorded before id come first
+	result := errFollowPending
+	err = syncPair(ctx, me, friend, func(e *outboxEntry, err error) {
+		if e.ID != id {
+			return
+		}
+		switch {
+		case isPermanent(err):
+			result = err
+		case err != nil:
+		case e.Result != nil:
+			result = e.Result
+		default:
+			result = nil
+		}
+	})
+	if err != nil {
+		logger.Warn("syncPair", zap.Error(err), zap.String("me", me), zap.String("friend", friend))
+	}
+	return result
+}
+
+// lockPair takes the MariaDB lock on the follow state of me to friend, shared
+// by every isuwitter process, and returns the function releasing it.
+func lockPair(ctx context.Context, me, friend string) (func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := "follow:" + me + ":" + friend
+	var got sql.NullInt64
+	err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, name, int(outboxLockTimeout/time.Second)).Scan(&got)
+	if err == nil && got.Int64 != 1 {
+		err = fmt.Errorf("lock %s: timed out", name)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `DO RELEASE_LOCK(?)`, name); err != nil {
+			logger.Error("RELEASE_LOCK", zap.Error(err), zap.String("name", name))
+		}
+		conn.Close()
+	}, nil
+}
+
+// syncPair applies the pending changes of me to friend in the order they were
+// recorded, holding the lock of the pair, and calls done with each of them and
+// its error. It stops at the first temporary failure so that a later change
+// does not overtake it.
+func syncPair(ctx context.Context, me, friend string, done func(*outboxEntry, error)) error {
+	unlock, err := lockPair(ctx, me, friend)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := pendingOutbox(ctx, `AND me = ? AND friend = ?`, me, friend)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err := processOutboxEntry(ctx, e)
+		done(e, err)
+		if err != nil && !isPermanent(err) {
+			break
+		}
+	}
+	return nil
+}
+
+func pendingOutbox(ctx context.Context, cond string, args ...interface{}) ([]*outboxEntry, error) {
+	args = append([]interface{}{outboxMaxAttempts}, args...)
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, op, me, friend, attempts FROM follow_outbox
+		WHERE done_at IS NULL AND attempts < ? `+cond+` ORDER BY id LIMIT `+fmt.Sprint(outboxBatchSize),
+		args...,
+	)
+	if err != nil {
+		logger.Error("pendingOutbox", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*outboxEntry{}
+	for rows.Next() {
+		e := outboxEntry{}
+		if err := rows.Scan(&e.ID, &e.Op, &e.Me, &e.Friend, &e.Attempts); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// processOutboxEntry applies e to isutomo and Redis and marks it done. On
+// failure the attempt is recorded; a permanent isutomo error gives up on the
+// entry immediately.
+func processOutboxEntry(ctx context.Context, e *outboxEntry) error {
+	err := applyFollowChange(ctx, e)
+	if err == nil {
+		_, err := db.ExecContext(ctx, `UPDATE follow_outbox SET attempts = attempts + 1, last_error = NULL, done_at = NOW() WHERE id = ?`, e.ID)
+		return err
+	}
+
+	logger.Warn(
+		"outbox entry failed",
+		zap.Error(err),
+		zap.Int64("id", e.ID),
+		zap.String("op", e.Op),
+		zap.String("me", e.Me),
+		zap.String("friend", e.Friend),
+	)
+	query := `UPDATE follow_outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?`
+	if isPermanent(err) {
+		query = `UPDATE follow_outbox SET attempts = attempts + 1, last_error = ?, done_at = NOW() WHERE id = ?`
+	}
+	if _, uerr := db.ExecContext(ctx, query, err.Error(), e.ID); uerr != nil {
+		logger.Error("outbox update", zap.Error(uerr), zap.Int64("id", e.ID))
+	} else if !isPermanent(err) && e.Attempts+1 >= outboxMaxAttempts {
+		// the entry is no longer retried; reconcile -repair fixes the pair
+		outboxAbandoned.Inc()
+		logger.Error(
+			"outbox entry abandoned",
+			zap.Error(err),
+			zap.Int64("id", e.ID),
+			zap.String("op", e.Op),
+			zap.String("me", e.Me),
+			zap.String("friend", e.Friend),
+			zap.Int("attempts", e.Attempts+1),
+		)
+	}
+	return err
+}
+
+// isPermanent reports whether err is an isutomo error that a retry cannot fix.
+func isPermanent(err error) bool {
+	ierr, ok := err.(*client.Error)
+	return ok && !ierr.Temporary()
+}
+
+func applyFollowChange(ctx context.Context, e *outboxEntry) error {
+	var err error
+	if e.Op == outboxUnfollow {
+		_, err = isutomoClient.Unfollow(ctx, e.Me, e.Friend)
+	} else {
+		_, err = isutomoClient.Follow(ctx, e.Me, e.Friend)
+	}
+	if err != nil {
+		if !isIdempotentResult(e, err) {
+			return err
+		}
+		e.Result = err.(*client.Error)
+	}
+
+	if e.Op == outboxUnfollow {
+		err = removeFriend(ctx, e.Me, e.Friend)
+	} else {
+		err = addFriend(ctx, e.Me, e.Friend)
+	}
+	if err != nil {
+		return err
+	}
+	return clearHomeCache(ctx, e.Me)
+}
+
+// isIdempotentResult reports whether err only says that isutomo is already in
+// the state e asks for, which happens when an entry is retried.
+func isIdempotentResult(e *outboxEntry, err error) bool {
+	if e.Op == outboxUnfollow {
+		return client.ErrorCode(err) == client.CodeNotFollowing
+	}
+	return client.ErrorCode(err) == client.CodeAlreadyFollowing
+}
+
+// drainOutbox retries the pending entries, a pair of users at a time.
+func drainOutbox() error {
+	ctx := context.Background()
+	entries, err := pendingOutbox(ctx, "")
+	if err != nil {
+		return err
+	}
+	seen := map[[2]string]bool{}
+	for _, e := range entries {
+		pair := [2]string{e.Me, e.Friend}
+		if seen[pair] {
+			continue
+		}
+		seen[pair] = true
+		if err := syncPair(ctx, e.Me, e.Friend, func(*outboxEntry, error) {}); err != nil {
+			logger.Warn("syncPair", zap.Error(err), zap.String("me", e.Me), zap.String("friend", e.Friend))
+		}
+	}
+	return nil
+}
+
+// pruneOutbox deletes the entries done for longer than outboxRetention.
+func pruneOutbox() error {
+	_, err := db.Exec(`DELETE FROM follow_outbox WHERE done_at < NOW() - INTERVAL ? SECOND`, int(outboxRetention/time.Second))
+	return err
+}
+
+// outboxLoop drains and prunes the outbox every outboxInterval until ctx is
+// done. A drain in progress is finished first.
+func outboxLoop(ctx context.Context) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := drainOutbox(); err != nil {
+			logger.Error("drainOutbox", zap.Error(err))
+		}
+		if err := pruneOutbox(); err != nil {
+			logger.Error("pruneOutbox", zap.Error(err))
+		}
+	}
+}
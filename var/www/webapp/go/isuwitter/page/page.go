@@ -0,0 +1,78 @@
+// Package page reads the timelines out of the HTML isuwitter renders, for the
+// tools that drive a running server.
+package page
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+)
+
+// TimeFormat is the layout of Tweet.Time and of the until parameter.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// Tweet is a tweet as rendered by the _tweets template.
+type Tweet struct {
+	Time string
+	User string
+	// HTML is the body of the tweet, hashtags already turned into links.
+	HTML string
+}
+
+var tweetPattern = regexp.MustCompile(`(?s)<div class="tweet" data-time="([^"]*)">\s*` +
+	`<p><a href="[^"]*" class="tweet-user-name">([^<]*)</a></p>\s*` +
+	`<p>(.*?)</p>\s*` +
+	`<p class="time">[^<]*</p>\s*</div>`)
+
+var namePattern = regexp.MustCompile(`<span class="name">こんにちは (.*?)さん</span>`)
+
+// LoggedIn returns the name of the logged-in user the page greets, or "" on
+// a page for guests.
+func LoggedIn(body []byte) string {
+	if !bytes.Contains(body, []byte(`action="/logout"`)) {
+		return ""
+	}
+	m := namePattern.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return html.UnescapeString(string(m[1]))
+}
+
+// Tweets returns the tweets of a page or of an append=1 fragment, in order.
+func Tweets(body []byte) []Tweet {
+	matches := tweetPattern.FindAllSubmatch(body, -1)
+	tweets := make([]Tweet, len(matches))
+	for i, m := range matches {
+		tweets[i] = Tweet{
+			Time: html.UnescapeString(string(m[1])),
+			User: html.UnescapeString(string(m[2])),
+			HTML: string(m[3]),
+		}
+	}
+	return tweets
+}
+
+// CheckOrder returns an error unless tweets are newest first and, when until
+// is not empty, all older than until.
+func CheckOrder(tweets []Tweet, until string) error {
+	for i, t := range tweets {
+		if until != "" && t.Time >= until {
+			return fmt.Errorf("tweet %d at %s is not before until=%s", i, t.Time, until)
+		}
+		if i > 0 && tweets[i-1].Time < t.Time {
+			return fmt.Errorf("tweet %d at %s is newer than tweet %d at %s", i, t.Time, i-1, tweets[i-1].Time)
+		}
+	}
+	return nil
+}
+
+// Oldest returns the time of the last tweet, which is the until of the next
+// page, or "" if there is none.
+func Oldest(tweets []Tweet) string {
+	if len(tweets) == 0 {
+		return ""
+	}
+	return tweets[len(tweets)-1].Time
+}
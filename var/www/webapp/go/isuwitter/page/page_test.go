@@ -0,0 +1,70 @@
+package page
+
+import (
+	"testing"
+)
+
+const body = `<header class="header">
+      <a class="title" href="/">Isuwitter</a>
+      <form class="logout" action="/logout" method="post">
+        <button type="submit">ログアウト</button>
+      </form>
+      <span class="name">こんにちは alice&amp;bobさん</span>
+</header>
+  <div class="tweet" data-time="2019-06-29 10:00:02">
+    <p><a href="/bob" class="tweet-user-name">bob</a></p>
+    <p>ramen <a class="hashtag" href="/hashtag/lunch">#lunch</a></p>
+    <p class="time">2019-06-29 10:00:02</p>
+  </div>
+  <div class="tweet" data-time="2019-06-29 10:00:01">
+    <p><a href="/carol" class="tweet-user-name">carol</a></p>
+    <p>a &lt;b&gt;</p>
+    <p class="time">2019-06-29 10:00:01</p>
+  </div>
+`
+
+func TestTweets(t *testing.T) {
+	tweets := Tweets([]byte(body))
+	want := []Tweet{
+		{"2019-06-29 10:00:02", "bob", `ramen <a class="hashtag" href="/hashtag/lunch">#lunch</a>`},
+		{"2019-06-29 10:00:01", "carol", "a &lt;b&gt;"},
+	}
+	if len(tweets) != len(want) {
+		t.Fatalf("got %d tweets: %+v", len(tweets), tweets)
+	}
+	for i := range want {
+		if tweets[i] != want[i] {
+			t.Errorf("tweet %d = %+v, want %+v", i, tweets[i], want[i])
+		}
+	}
+	if got := Oldest(tweets); got != "2019-06-29 10:00:01" {
+		t.Errorf("Oldest = %q", got)
+	}
+}
+
+func TestCheckOrder(t *testing.T) {
+	tweets := Tweets([]byte(body))
+	if err := CheckOrder(tweets, ""); err != nil {
+		t.Error(err)
+	}
+	if err := CheckOrder(tweets, "2019-06-29 10:00:03"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckOrder(tweets, "2019-06-29 10:00:02"); err == nil {
+		t.Error("a tweet at until is accepted")
+	}
+	tweets[0], tweets[1] = tweets[1], tweets[0]
+	if err := CheckOrder(tweets, ""); err == nil {
+		t.Error("oldest first is accepted")
+	}
+}
+
+func TestLoggedIn(t *testing.T) {
+	if got := LoggedIn([]byte(body)); got != "alice&bob" {
+		t.Errorf("LoggedIn = %q", got)
+	}
+	guest := `<span class="name">こんにちは ゲストさん</span>`
+	if got := LoggedIn([]byte(guest)); got != "" {
+		t.Errorf("LoggedIn of a guest page = %q", got)
+	}
+}
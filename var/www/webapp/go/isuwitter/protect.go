@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/client"
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"go.uber.org/zap"
+)
+
+// Protected users only show their tweets to the followers they approved;
+// following them creates a request the owner answers.
+
+// canView reports whether viewer is allowed to read owner's tweets.
+func (a *app) canView(ctx context.Context, viewer, owner string) (bool, error) {
+	if viewer == owner {
+		return true, nil
+	}
+	protected, err := a.follows.IsProtected(ctx, owner)
+	if err != nil {
+		return false, err
+	}
+	if !protected {
+		return true, nil
+	}
+	if viewer == "" {
+		return false, nil
+	}
+	return a.follows.IsFollowing(ctx, viewer, owner)
+}
+
+// loadInvisibleUsers returns the protected users whose tweets viewer must not
+// see in search and hashtag results.
+func (a *app) loadInvisibleUsers(ctx context.Context, viewer string) (map[string]bool, error) {
+	protected, err := a.follows.Protected(ctx)
+	if err != nil {
+		logger.Error("loadInvisibleUsers", zap.Error(err), zap.String("viewer", viewer))
+		return nil, err
+	}
+	invisible := map[string]bool{}
+	for _, u := range protected {
+		if u != viewer {
+			invisible[u] = true
+		}
+	}
+	if len(invisible) == 0 || viewer == "" {
+		return invisible, nil
+	}
+	friends, err := a.follows.Friends(ctx, viewer)
+	if err != nil {
+		logger.Error("loadInvisibleUsers", zap.Error(err), zap.String("viewer", viewer))
+		return nil, err
+	}
+	for _, u := range friends {
+		delete(invisible, u)
+	}
+	return invisible, nil
+}
+
+func (a *app) protectHandler(w http.ResponseWriter, r *http.Request) {
+	var name string
+	session := a.getSession(w, r)
+	userID, ok := session.Values["user_id"]
+	if ok {
+		name = a.sessionUserName(r, userID.(int))
+	}
+	if name == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	if err := a.follows.SetProtected(r.Context(), name, r.FormValue("protected") != ""); err != nil {
+		logger.Error("setProtected", zap.Error(err), zap.String("name", name))
+		badRequest(w)
+		return
+	}
+
+	http.Redirect(w, r, "/"+name, http.StatusFound)
+}
+
+func (a *app) followRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	var name string
+	session := a.getSession(w, r)
+	userID, ok := session.Values["user_id"]
+	if ok {
+		name = a.sessionUserName(r, userID.(int))
+	}
+	if name == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	users, err := a.follows.FollowRequests(r.Context(), name)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	sort.Strings(users)
+
+	a.render.HTML(w, http.StatusOK, "follow_requests", struct {
+		Name  string
+		Users []string
+	}{
+		name, users,
+	})
+}
+
+func (a *app) approveFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
+	a.answerFollowRequest(w, r, true)
+}
+
+func (a *app) rejectFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
+	a.answerFollowRequest(w, r, false)
+}
+
+func (a *app) answerFollowRequest(w http.ResponseWriter, r *http.Request, approve bool) {
+	var name string
+	session := a.getSession(w, r)
+	userID, ok := session.Values["user_id"]
+	if ok {
+		name = a.sessionUserName(r, userID.(int))
+	}
+	if name == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user := username.Canonical(r.FormValue("user"))
+	removed, err := a.follows.RemoveFollowRequest(r.Context(), name, user)
+	if err != nil {
+		badRequest(w)
+		return
+	}
+	if !removed {
+		http.NotFound(w, r)
+		return
+	}
+
+	if approve {
+		// a pending follow is applied by the outbox
+		if err := a.follows.Follow(r.Context(), user, name); err != nil && err != errFollowPending && client.ErrorCode(err) != client.CodeAlreadyFollowing {
+			logger.Error("follow", zap.Error(err), zap.String("user", user))
+			// keep the request so that it can be approved again
+			if err := a.follows.RequestFollow(r.Context(), user, name); err != nil {
+				logger.Error("RequestFollow", zap.Error(err), zap.String("user", user))
+			}
+			badRequest(w)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/follow_requests", http.StatusFound)
+}
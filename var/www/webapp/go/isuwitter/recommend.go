@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	recommendCount    = 10
+	recommendInterval = 10 * time.Minute
+	// recommendWaitInterval is how often the job retries loading the user
+	// directory it needs before the first run
+	recommendWaitInterval = time.Second
+	// users who tweeted within recommendActiveWindow get recommendActiveBonus
+	// on top of the number of my friends following them
+	recommendActiveWindow = 7 * 24 * time.Hour
+	recommendActiveBonus  = 0.5
+)
+
+type Recommendation struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// isRecentTweet reports whether a tweet-<user> entry is within
+// recommendActiveWindow.
+func isRecentTweet(entry string) bool {
+	if len(entry) < len("2006-01-02 15:04:05") {
+		return false
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", entry[:len("2006-01-02 15:04:05")], time.Local)
+	if err != nil {
+		return false
+	}
+	return time.Since(t) < recommendActiveWindow
+}
+
+// sameRecommendations reports whether a and b hold the same suggestions with
+// the same scores, in any order.
+func sameRecommendations(a, b []Recommendation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	scores := make(map[string]float64, len(a))
+	for _, rec := range a {
+		scores[rec.Name] = rec.Score
+	}
+	for _, rec := range b {
+		if score, ok := scores[rec.Name]; !ok || score != rec.Score {
+			return false
+		}
+	}
+	return true
+}
+
+// runRecommendJob refreshes the recommendations of every user, stopping early
+// when ctx is done.
+func (a *app) runRecommendJob(ctx context.Context) {
+	start := time.Now()
+	names := a.users.Names()
+	for i, name := range names {
+		if ctx.Err() != nil {
+			logger.Info("recommend job stopped", zap.Int("users", i), zap.Duration("elapsed", time.Since(start)))
+			return
+		}
+		if err := a.follows.RefreshRecommendations(name); err != nil {
+			logger.Error("RefreshRecommendations", zap.Error(err), zap.String("name", name))
+		}
+	}
+	logger.Info("recommend job finished", zap.Int("users", len(names)), zap.Duration("elapsed", time.Since(start)))
+}
+
+// recommendLoop runs the job every recommendInterval until ctx is done,
+// starting once the user directory is loaded.
+func (a *app) recommendLoop(ctx context.Context) {
+	for checkDirectory(ctx) != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(recommendWaitInterval):
+		}
+	}
+	for {
+		a.runRecommendJob(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(recommendInterval):
+		}
+	}
+}
+
+// loadRecommendations returns the suggestions for name, which are empty for
+// guests.
+func (a *app) loadRecommendations(ctx context.Context, name string) ([]Recommendation, error) {
+	if name == "" {
+		return []Recommendation{}, nil
+	}
+	return a.follows.Recommendations(ctx, name)
+}
+
+func (a *app) apiRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	var name string
+	session := a.getSession(w, r)
+	userID, ok := session.Values["user_id"]
+	if ok {
+		name = a.sessionUserName(r, userID.(int))
+	}
+	if name == "" {
+		a.render.JSON(w, http.StatusUnauthorized, map[string]string{"error": "login required"})
+		return
+	}
+
+	recommendations, err := a.loadRecommendations(r.Context(), name)
+	if err != nil {
+		logger.Error("loadRecommendations", zap.Error(err), zap.String("name", name))
+		a.render.JSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	a.render.JSON(w, http.StatusOK, struct {
+		User            string           `json:"user"`
+		Recommendations []Recommendation `json:"recommendations"`
+	}{
+		name, recommendations,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+)
+
+// reconcile compares the follow state held by isutomo, the friendships table
+// in MariaDB and the Redis friends-<name>/followers-<name> sets, and writes
+// every difference to out. isutomo is the source of truth: with repair set, the
+// outbox is drained first and every pair of users found different is then
+// rewritten in the table and in Redis to match isutomo.
+func reconcile(out io.Writer, repair bool) (int, error) {
+	if repair {
+		if err := drainOutbox(); err != nil {
+			return 0, err
+		}
+	}
+
+	names, err := loadUserNames()
+	if err != nil {
+		return 0, err
+	}
+	table, err := loadFriendsTable()
+	if err != nil {
+		return 0, err
+	}
+
+	diffs := 0
+	var pairs [][2]string
+	seen := map[[2]string]bool{}
+	report := func(user, store, kind, friend string, pair [2]string) {
+		diffs++
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", user, store, kind, friend)
+		if !seen[pair] {
+			seen[pair] = true
+			pairs = append(pairs, pair)
+		}
+	}
+
+	expectedFollowers := map[string]map[string]bool{}
+	for _, name := range names {
+		truth, err := fetchIsutomoFriends(name)
+		if err != nil {
+			return diffs, err
+		}
+		for f := range truth {
+			if expectedFollowers[f] == nil {
+				expectedFollowers[f] = map[string]bool{}
+			}
+			expectedFollowers[f][name] = true
+		}
+
+		missing, extra := diffSets(truth, table[name])
+		for _, f := range missing {
+			report(name, "mariadb", "missing", f, [2]string{name, f})
+		}
+		for _, f := range extra {
+			report(name, "mariadb", "extra", f, [2]string{name, f})
+		}
+
+		cached, err := redisClient.SMembers("friends-" + name).Result()
+		if err != nil {
+			return diffs, err
+		}
+		missing, extra = diffSets(truth, toSet(cached))
+		for _, f := range missing {
+			report(name, "redis", "missing", f, [2]string{name, f})
+		}
+		for _, f := range extra {
+			report(name, "redis", "extra", f, [2]string{name, f})
+		}
+	}
+
+	for _, name := range names {
+		cached, err := redisClient.SMembers("followers-" + name).Result()
+		if err != nil {
+			return diffs, err
+		}
+		missing, extra := diffSets(expectedFollowers[name], toSet(cached))
+		for _, f := range missing {
+			report(name, "redis-followers", "missing", f, [2]string{f, name})
+		}
+		for _, f := range extra {
+			report(name, "redis-followers", "extra", f, [2]string{f, name})
+		}
+	}
+
+	if repair {
+		for _, pair := range pairs {
+			if err := repairPair(context.Background(), pair[0], pair[1]); err != nil {
+				return diffs, err
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// repairPair makes the friendships table and Redis agree with isutomo on
+// whether me follows friend. isutomo is asked again under the lock of the
+// pair, so that a change the outbox applied since the comparison is kept.
+func repairPair(ctx context.Context, me, friend string) error {
+	unlock, err := lockPair(ctx, me, friend)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	truth, err := fetchIsutomoFriends(me)
+	if err != nil {
+		return err
+	}
+	if truth[friend] {
+		_, err = db.ExecContext(ctx, `INSERT IGNORE INTO friendships (me, friend, created_at) VALUES (?, ?, NOW(6))`, me, friend)
+		if err == nil {
+			err = addFriend(ctx, me, friend)
+		}
+	} else {
+		_, err = db.ExecContext(ctx, `DELETE FROM friendships WHERE me = ? AND friend = ?`, me, friend)
+		if err == nil {
+			err = removeFriend(ctx, me, friend)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return clearHomeCache(ctx, me)
+}
+
+func loadUserNames() ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		name = username.Canonical(name)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+func loadFriendsTable() (map[string]map[string]bool, error) {
+	rows, err := db.Query(`SELECT me, friend FROM friendships`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	table := map[string]map[string]bool{}
+	for rows.Next() {
+		f := Friendship{}
+		if err := rows.Scan(&f.Me, &f.Friend); err != nil {
+			return nil, err
+		}
+		if table[f.Me] == nil {
+			table[f.Me] = map[string]bool{}
+		}
+		table[f.Me][f.Friend] = true
+	}
+	return table, rows.Err()
+}
+
+// fetchIsutomoFriends returns the users me follows according to isutomo.
+func fetchIsutomoFriends(me string) (map[string]bool, error) {
+	friends, err := isutomoClient.GetFriends(context.Background(), me)
+	if err != nil {
+		return nil, err
+	}
+	return toSet(friends), nil
+}
+
+func toSet(a []string) map[string]bool {
+	set := map[string]bool{}
+	for _, s := range a {
+		if s != "" {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+// diffSets returns the sorted members of want missing from got, and of got
+// missing from want.
+func diffSets(want, got map[string]bool) ([]string, []string) {
+	missing := []string{}
+	extra := []string{}
+	for s := range want {
+		if !got[s] {
+			missing = append(missing, s)
+		}
+	}
+	for s := range got {
+		if !want[s] {
+			extra = append(extra, s)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
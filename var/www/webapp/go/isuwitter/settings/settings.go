@@ -0,0 +1,243 @@
+// Package settings holds the settings of isuwitter, which bench and checker
+// load as well so that one config file sets up all of them.
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+	"go.uber.org/zap/zapcore"
+)
+
+// FileEnv is the environment variable naming the config file, when -config
+// is not given.
+const FileEnv = "ISUWITTER_CONFIG"
+
+// Config holds the settings of isuwitter, loaded by package config.
+type Config struct {
+	Listen        string         `json:"listen" env:"ISUWITTER_LISTEN" flag:"listen" usage:"address to serve HTTP on"`
+	Internal      string         `json:"internal" env:"ISUWITTER_INTERNAL" flag:"internal" usage:"internal address to serve /healthz, /readyz and /metrics on"`
+	Pprof         string         `json:"pprof" env:"ISUWITTER_PPROF" flag:"pprof" usage:"address to serve net/http/pprof on, sharing the internal listener when the same, none when empty"`
+	PerPage       int            `json:"per_page" env:"ISUWITTER_PER_PAGE" flag:"per-page" usage:"number of tweets on a timeline page"`
+	SessionSecret string         `json:"session_secret" env:"ISUWITTER_SESSION_SECRET" secret:"true"`
+	DB            DBConfig       `json:"db"`
+	Redis         RedisConfig    `json:"redis"`
+	Isutomo       IsutomoConfig  `json:"isutomo"`
+	Shutdown      ShutdownConfig `json:"shutdown"`
+	Tracing       TracingConfig  `json:"tracing"`
+	Log           LogConfig      `json:"log"`
+}
+
+// DBConfig locates the MariaDB database holding the users and tweets.
+type DBConfig struct {
+	Host     string `json:"host" env:"ISUWITTER_DB_HOST" flag:"db-host" usage:"MariaDB host"`
+	Port     int    `json:"port" env:"ISUWITTER_DB_PORT" flag:"db-port" usage:"MariaDB port"`
+	User     string `json:"user" env:"ISUWITTER_DB_USER" flag:"db-user" usage:"MariaDB user"`
+	Password string `json:"password" env:"ISUWITTER_DB_PASSWORD" secret:"true"`
+	Name     string `json:"name" env:"ISUWITTER_DB_NAME" flag:"db-name" usage:"MariaDB database"`
+}
+
+// RedisConfig locates Redis and the snapshots /initialize swaps.
+type RedisConfig struct {
+	Addr     string `json:"addr" env:"ISUWITTER_REDIS_ADDR" flag:"redis-addr" usage:"Redis address"`
+	Password string `json:"password" env:"ISUWITTER_REDIS_PASSWORD" secret:"true"`
+	DB       int    `json:"db" env:"ISUWITTER_REDIS_DB" flag:"redis-db" usage:"Redis database number"`
+	// InitRDB is the snapshot of the initial data, DumpRDB where Redis saves.
+	InitRDB string `json:"init_rdb" env:"ISUWITTER_REDIS_INIT_RDB"`
+	DumpRDB string `json:"dump_rdb" env:"ISUWITTER_REDIS_DUMP_RDB"`
+}
+
+// IsutomoConfig locates the isutomo API.
+type IsutomoConfig struct {
+	Endpoint string `json:"endpoint" env:"ISUWITTER_ISUTOMO_ENDPOINT" flag:"isutomo" usage:"base URL of isutomo"`
+}
+
+// ShutdownConfig times the draining on SIGTERM, see package graceful.
+type ShutdownConfig struct {
+	Delay   time.Duration `json:"delay" env:"ISUWITTER_SHUTDOWN_DELAY" flag:"shutdown-delay" usage:"time to keep serving once unready on SIGTERM"`
+	Timeout time.Duration `json:"timeout" env:"ISUWITTER_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"time to wait for the requests in flight on SIGTERM"`
+}
+
+// TracingConfig selects where the OpenTelemetry spans go, see package
+// tracing.
+type TracingConfig struct {
+	Exporter string `json:"exporter" env:"ISUWITTER_TRACING_EXPORTER" flag:"tracing" usage:"span exporter: none, otlp or file"`
+	Endpoint string `json:"endpoint" env:"ISUWITTER_TRACING_ENDPOINT" flag:"tracing-endpoint" usage:"host:port of the OTLP/HTTP collector"`
+	File     string `json:"file" env:"ISUWITTER_TRACING_FILE" flag:"tracing-file" usage:"file the file exporter appends JSON spans to"`
+}
+
+// LogConfig sets up the application log and the access log.
+type LogConfig struct {
+	Level       string `json:"level" env:"ISUWITTER_LOG_LEVEL" flag:"log-level" usage:"minimum level logged: debug, info, warn or error"`
+	Development bool   `json:"development" env:"ISUWITTER_LOG_DEVELOPMENT" flag:"log-development" usage:"log human-readable lines instead of JSON"`
+	// AccessLog is the file to append the with_time access log of nginx to,
+	// none when empty.
+	AccessLog string `json:"access_log" env:"ISUWITTER_ACCESS_LOG" flag:"access-log" usage:"file to append an nginx with_time access log to, none when empty"`
+}
+
+// Default returns the settings used when nothing overrides them.
+func Default() Config {
+	return Config{
+		Listen:        ":8080",
+		Internal:      "localhost:6060",
+		Pprof:         "localhost:6060",
+		PerPage:       50,
+		SessionSecret: "isuwitter",
+		DB: DBConfig{
+			Host: "localhost",
+			Port: 3306,
+			User: "root",
+			Name: "isuwitter",
+		},
+		Redis: RedisConfig{
+			Addr:    "localhost:6379",
+			InitRDB: "/var/lib/redis/init.rdb",
+			DumpRDB: "/var/lib/redis/dump.rdb",
+		},
+		Isutomo: IsutomoConfig{
+			Endpoint: "http://localhost:8081",
+		},
+		Shutdown: ShutdownConfig{
+			Delay:   time.Second,
+			Timeout: 10 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter: tracing.ExporterNone,
+			Endpoint: "localhost:4318",
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+	}
+}
+
+// Validate reports the first setting isuwitter cannot start with.
+func (c *Config) Validate() error {
+	switch {
+	case c.Listen == "":
+		return errors.New("listen is empty")
+	case c.Internal == "":
+		return errors.New("internal is empty")
+	case c.PerPage < 1:
+		return fmt.Errorf("per_page %d is not positive", c.PerPage)
+	case c.SessionSecret == "":
+		return errors.New("session_secret is empty")
+	}
+	if err := c.DB.Validate(); err != nil {
+		return err
+	}
+	if err := c.Redis.Validate(); err != nil {
+		return err
+	}
+	if err := c.Isutomo.Validate(); err != nil {
+		return err
+	}
+	if err := c.Shutdown.Validate(); err != nil {
+		return err
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	return c.Log.Validate()
+}
+
+// LocalURL returns the base URL of isuwitter on the host it runs on.
+func (c *Config) LocalURL() string {
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return "http://" + c.Listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func (c *DBConfig) Validate() error {
+	switch {
+	case c.Host == "":
+		return errors.New("db.host is empty")
+	case c.Port < 1 || c.Port > 65535:
+		return fmt.Errorf("db.port %d is not a port", c.Port)
+	case c.User == "":
+		return errors.New("db.user is empty")
+	case c.Name == "":
+		return errors.New("db.name is empty")
+	}
+	return nil
+}
+
+// DSN returns the data source name to open the database with.
+func (c *DBConfig) DSN() string {
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&loc=Local&parseTime=true",
+		c.User, c.Password, c.Host, c.Port, c.Name,
+	)
+}
+
+func (c *RedisConfig) Validate() error {
+	switch {
+	case c.Addr == "":
+		return errors.New("redis.addr is empty")
+	case c.DB < 0:
+		return fmt.Errorf("redis.db %d is negative", c.DB)
+	case c.InitRDB == "" || c.DumpRDB == "":
+		return errors.New("redis.init_rdb and redis.dump_rdb must be set")
+	}
+	return nil
+}
+
+func (c *IsutomoConfig) Validate() error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("isutomo.endpoint: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("isutomo.endpoint %q is not an http(s) URL", c.Endpoint)
+	}
+	return nil
+}
+
+func (c *ShutdownConfig) Validate() error {
+	switch {
+	case c.Delay < 0:
+		return fmt.Errorf("shutdown.delay %s is negative", c.Delay)
+	case c.Timeout <= 0:
+		return fmt.Errorf("shutdown.timeout %s is not positive", c.Timeout)
+	}
+	return nil
+}
+
+func (c *TracingConfig) Validate() error {
+	switch c.Exporter {
+	case tracing.ExporterNone:
+	case tracing.ExporterOTLP:
+		if c.Endpoint == "" {
+			return errors.New("tracing.endpoint is empty")
+		}
+	case tracing.ExporterFile:
+		if c.File == "" {
+			return errors.New("tracing.file is empty")
+		}
+	default:
+		return fmt.Errorf("tracing.exporter %q is not none, otlp or file", c.Exporter)
+	}
+	return nil
+}
+
+// Options returns the tracing.Options of service.
+func (c *TracingConfig) Options(service string) tracing.Options {
+	return tracing.Options{Service: service, Exporter: c.Exporter, Endpoint: c.Endpoint, File: c.File}
+}
+
+func (c *LogConfig) Validate() error {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("log.level %q is not debug, info, warn or error", c.Level)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package settings
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if c := Default(); c.Validate() != nil {
+		t.Fatalf("the defaults are invalid: %v", c.Validate())
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"listen", func(c *Config) { c.Listen = "" }, "listen is empty"},
+		{"internal", func(c *Config) { c.Internal = "" }, "internal is empty"},
+		{"per page", func(c *Config) { c.PerPage = 0 }, "per_page 0 is not positive"},
+		{"session secret", func(c *Config) { c.SessionSecret = "" }, "session_secret is empty"},
+		{"db port", func(c *Config) { c.DB.Port = 70000 }, "db.port 70000 is not a port"},
+		{"db name", func(c *Config) { c.DB.Name = "" }, "db.name is empty"},
+		{"redis addr", func(c *Config) { c.Redis.Addr = "" }, "redis.addr is empty"},
+		{"redis snapshot", func(c *Config) { c.Redis.InitRDB = "" }, "redis.init_rdb"},
+		{"isutomo scheme", func(c *Config) { c.Isutomo.Endpoint = "localhost:8081" }, "not an http(s) URL"},
+		{"isutomo host", func(c *Config) { c.Isutomo.Endpoint = "http://" }, "not an http(s) URL"},
+		{"shutdown delay", func(c *Config) { c.Shutdown.Delay = -time.Second }, "shutdown.delay -1s is negative"},
+		{"shutdown timeout", func(c *Config) { c.Shutdown.Timeout = 0 }, "shutdown.timeout 0s is not positive"},
+		{"tracing exporter", func(c *Config) { c.Tracing.Exporter = "zipkin" }, `tracing.exporter "zipkin" is not none, otlp or file`},
+		{"tracing file", func(c *Config) { c.Tracing.Exporter = "file" }, "tracing.file is empty"},
+		{"log level", func(c *Config) { c.Log.Level = "verbose" }, `log.level "verbose" is not debug, info, warn or error`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.change(&c)
+			if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDSN(t *testing.T) {
+	c := Default().DB
+	c.Password = "secret"
+	want := "root:secret@tcp(localhost:3306)/isuwitter?charset=utf8mb4&loc=Local&parseTime=true"
+	if got := c.DSN(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	for listen, want := range map[string]string{
+		":8080":          "http://localhost:8080",
+		"0.0.0.0:8080":   "http://localhost:8080",
+		"[::]:8080":      "http://localhost:8080",
+		"127.0.0.1:8080": "http://127.0.0.1:8080",
+	} {
+		c := Config{Listen: listen}
+		if got := c.LocalURL(); got != want {
+			t.Errorf("%s: got %q, want %q", listen, got, want)
+		}
+	}
+}
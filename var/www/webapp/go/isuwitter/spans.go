@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+	"github.com/go-redis/redis"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redisFor returns redisClient, with a span for every command and pipeline
+// when ctx carries the span of a request.
+func redisFor(ctx context.Context) *redis.Client {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return redisClient
+	}
+	c := redisClient.WithContext(ctx)
+	c.WrapProcess(func(process func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			_, span := tracing.Start(ctx, "redis "+cmd.Name(), semconv.DBSystemRedis)
+			err := process(cmd)
+			tracing.End(span, redisError(err))
+			return err
+		}
+	})
+	c.WrapProcessPipeline(func(process func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			_, span := tracing.Start(ctx, "redis pipeline", semconv.DBSystemRedis)
+			err := process(cmds)
+			tracing.End(span, redisError(err))
+			return err
+		}
+	})
+	return c
+}
+
+// detach returns a context carrying the span of ctx but not its deadline
+// nor its cancellation.
+func detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// redisError hides redis.Nil, which only says a key is missing, from the
+// span.
+func redisError(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/tracing"
+	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// tracedHarness is a harness whose server, MariaDB and isutomo client are
+// traced as in main, recording the spans.
+func tracedHarness(t *testing.T) (*harness, *tracetest.SpanRecorder) {
+	h := newHarness(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	saved, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(saved)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+
+	db = sql.OpenDB(tracing.Connector(h.sql, "mysql"))
+	isutomoClient.HTTPClient = &http.Client{Transport: tracing.Transport(http.DefaultTransport, "isutomo")}
+	h.server = httptest.NewServer(tracing.Handler(newApp(sessions.NewCookieStore([]byte(cfg.SessionSecret))).router(), "isuwitter"))
+	t.Cleanup(h.server.Close)
+	return h, recorder
+}
+
+// requestSpans returns the children of the last request span named root, by
+// name.
+func requestSpans(t *testing.T, recorder *tracetest.SpanRecorder, root string) map[string][]sdktrace.ReadOnlySpan {
+	t.Helper()
+	var request sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == root {
+			request = s
+		}
+	}
+	if request == nil {
+		t.Fatalf("no %q span", root)
+	}
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		if s.Parent().SpanID() == request.SpanContext().SpanID() {
+			spans[s.Name()] = append(spans[s.Name()], s)
+		}
+	}
+	return spans
+}
+
+func TestSpans(t *testing.T) {
+	h, recorder := tracedHarness(t)
+	alice := h.login("alice")
+
+	alice.mustPost("/follow", url.Values{"user": {"bob"}})
+	follow := requestSpans(t, recorder, "POST /follow")
+	for _, name := range []string{"sql exec", "sql query", "isutomo POST", "redis pipeline", "redis del"} {
+		if len(follow[name]) == 0 {
+			t.Errorf("POST /follow has no %q span", name)
+		}
+	}
+
+	alice.get("/")
+	home := requestSpans(t, recorder, "GET /")
+	for _, name := range []string{"redis get", "redis smembers", "sql query", "redis set"} {
+		if len(home[name]) == 0 {
+			t.Errorf("GET / has no %q span", name)
+		}
+	}
+
+	alice.mustPost("/mute", url.Values{"user": {"carol"}})
+	if mute := requestSpans(t, recorder, "POST /mute"); len(mute["redis sadd"]) == 0 {
+		t.Error("POST /mute has no \"redis sadd\" span")
+	}
+	alice.get("/carol")
+	user := requestSpans(t, recorder, "GET /{user}")
+	for _, name := range []string{"redis sismember", "redis pipeline"} {
+		if len(user[name]) == 0 {
+			t.Errorf("GET /{user} has no %q span", name)
+		}
+	}
+
+	// the outbox loop runs outside of any request
+	before := len(recorder.Ended())
+	if err := drainOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.Ended()[before:]; len(got) != 0 {
+		t.Errorf("drainOutbox recorded %d spans", len(got))
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeSQL is a database/sql driver keeping the isuwitter tables in memory.
+// It is not a SQL engine: it knows exactly the statements isuwitter issues,
+// matched by their text with whitespace collapsed, and fails anything else so
+// that a new query cannot silently go untested.
+type fakeSQL struct {
+	mu sync.Mutex
+
+	// now is the clock behind NOW().
+	now func() time.Time
+
+	users       []User
+	tweets      []Tweet
+	friendships []Friendship
+	outbox      []*fakeOutboxRow
+	// outboxID is the last AUTO_INCREMENT id of follow_outbox.
+	outboxID int64
+
+	// locks are the named locks of GET_LOCK, taken outside of mu.
+	locksMu sync.Mutex
+	locks   map[string]chan struct{}
+}
+
+type fakeOutboxRow struct {
+	outboxEntry
+	LastError *string
+	CreatedAt time.Time
+	DoneAt    *time.Time
+}
+
+func newFakeSQL() *fakeSQL {
+	return &fakeSQL{now: time.Now, locks: map[string]chan struct{}{}}
+}
+
+// AddFriendship inserts a friendships row.
+func (f *fakeSQL) AddFriendship(me, friend string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.friendships = append(f.friendships, Friendship{Me: me, Friend: friend})
+}
+
+// Friendships returns a copy of the friendships rows.
+func (f *fakeSQL) Friendships() []Friendship {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Friendship(nil), f.friendships...)
+}
+
+// AddUser inserts a users row whose password is password.
+func (f *fakeSQL) AddUser(id int, name, password string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	salt := name
+	f.users = append(f.users, User{ID: id, Name: name, Salt: salt, Password: hashPassword(salt, password)})
+}
+
+// Tweets returns a copy of the tweets rows.
+func (f *fakeSQL) Tweets() []Tweet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Tweet(nil), f.tweets...)
+}
+
+// Outbox returns a copy of the follow_outbox rows.
+func (f *fakeSQL) Outbox() []fakeOutboxRow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rows := make([]fakeOutboxRow, len(f.outbox))
+	for i, row := range f.outbox {
+		rows[i] = *row
+	}
+	return rows
+}
+
+func (f *fakeSQL) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeSQL) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ f *fakeSQL }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.f}, nil }
+
+type fakeConn struct{ f *fakeSQL }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.f, strings.Join(strings.Fields(query), " ")}, nil
+}
+func (c fakeConn) Close() error { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("fakesql: transactions are not supported")
+}
+
+type fakeStmt struct {
+	f     *fakeSQL
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res, _, err := s.f.run(s.query, args)
+	return res, err
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	_, rows, err := s.f.run(s.query, args)
+	if err == nil && rows == nil {
+		err = fmt.Errorf("fakesql: %q returns no rows", s.query)
+	}
+	return rows, err
+}
+
+type fakeResult struct{ lastID, affected int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// lock returns the channel holding the named lock name.
+func (f *fakeSQL) lock(name string) chan struct{} {
+	f.locksMu.Lock()
+	defer f.locksMu.Unlock()
+
+	if f.locks[name] == nil {
+		f.locks[name] = make(chan struct{}, 1)
+	}
+	return f.locks[name]
+}
+
+// run executes query, which has its whitespace collapsed.
+func (f *fakeSQL) run(query string, args []driver.Value) (driver.Result, driver.Rows, error) {
+	// named locks block, so they are not taken under mu; unlike MariaDB they
+	// are not owned by a connection
+	switch query {
+	case `SELECT GET_LOCK(?, ?)`:
+		got := int64(0)
+		select {
+		case f.lock(asString(args[0])) <- struct{}{}:
+			got = 1
+		case <-time.After(time.Duration(asInt(args[1])) * time.Second):
+		}
+		return nil, &fakeRows{columns: []string{"lock"}, values: [][]driver.Value{{got}}}, nil
+	case `DO RELEASE_LOCK(?)`:
+		select {
+		case <-f.lock(asString(args[0])):
+		default:
+		}
+		return fakeResult{}, nil, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// DATETIME columns have a precision of one second
+	now := f.now().Truncate(time.Second)
+
+	switch query {
+	case `INSERT INTO tweets (user_id, text, created_at) VALUES (?, ?, NOW())`:
+		id := len(f.tweets) + 1
+		f.tweets = append(f.tweets, Tweet{ID: id, UserID: int(asInt(args[0])), Text: asString(args[1]), CreatedAt: now})
+		return fakeResult{int64(id), 1}, nil, nil
+
+	case `SELECT * FROM tweets ORDER BY created_at DESC`:
+		return nil, f.selectTweets(func(Tweet) bool { return true }), nil
+
+	case `SELECT * FROM tweets WHERE created_at < ? ORDER BY created_at DESC`:
+		until, err := asTime(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, f.selectTweets(func(t Tweet) bool { return t.CreatedAt.Before(until) }), nil
+
+	case `SELECT * FROM tweets WHERE user_id = ? AND created_at < ? ORDER BY created_at DESC`:
+		userID := int(asInt(args[0]))
+		until, err := asTime(args[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, f.selectTweets(func(t Tweet) bool { return t.UserID == userID && t.CreatedAt.Before(until) }), nil
+
+	case `DELETE FROM tweets WHERE id > 100000`:
+		kept := f.tweets[:0]
+		for _, t := range f.tweets {
+			if t.ID <= 100000 {
+				kept = append(kept, t)
+			}
+		}
+		affected := len(f.tweets) - len(kept)
+		f.tweets = kept
+		return fakeResult{0, int64(affected)}, nil, nil
+
+	case `SELECT * FROM users`, `SELECT * FROM users WHERE name = ?`, `SELECT * FROM users WHERE id = ?`:
+		rows := &fakeRows{columns: []string{"id", "name", "salt", "password"}}
+		for _, u := range f.users {
+			// the users table has a case-insensitive collation
+			if strings.HasSuffix(query, "name = ?") && !strings.EqualFold(u.Name, asString(args[0])) {
+				continue
+			}
+			if strings.HasSuffix(query, "id = ?") && int64(u.ID) != asInt(args[0]) {
+				continue
+			}
+			rows.values = append(rows.values, []driver.Value{int64(u.ID), u.Name, u.Salt, u.Password})
+		}
+		return nil, rows, nil
+
+	case `SELECT name FROM users ORDER BY id`:
+		users := append([]User(nil), f.users...)
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+		rows := &fakeRows{columns: []string{"name"}}
+		for _, u := range users {
+			rows.values = append(rows.values, []driver.Value{u.Name})
+		}
+		return nil, rows, nil
+
+	case `DELETE FROM users WHERE id > 1000`:
+		kept := f.users[:0]
+		for _, u := range f.users {
+			if u.ID <= 1000 {
+				kept = append(kept, u)
+			}
+		}
+		affected := len(f.users) - len(kept)
+		f.users = kept
+		return fakeResult{0, int64(affected)}, nil, nil
+
+	case `SELECT me, friend FROM friendships`:
+		rows := &fakeRows{columns: []string{"me", "friend"}}
+		for _, fr := range f.friendships {
+			rows.values = append(rows.values, []driver.Value{fr.Me, fr.Friend})
+		}
+		return nil, rows, nil
+
+	case `INSERT IGNORE INTO friendships (me, friend, created_at) VALUES (?, ?, NOW(6))`:
+		me, friend := asString(args[0]), asString(args[1])
+		for _, fr := range f.friendships {
+			if fr.Me == me && fr.Friend == friend {
+				return fakeResult{0, 0}, nil, nil
+			}
+		}
+		f.friendships = append(f.friendships, Friendship{Me: me, Friend: friend})
+		return fakeResult{0, 1}, nil, nil
+
+	case `DELETE FROM friendships WHERE me = ? AND friend = ?`:
+		me, friend := asString(args[0]), asString(args[1])
+		kept := f.friendships[:0]
+		for _, fr := range f.friendships {
+			if fr.Me != me || fr.Friend != friend {
+				kept = append(kept, fr)
+			}
+		}
+		affected := len(f.friendships) - len(kept)
+		f.friendships = kept
+		return fakeResult{0, int64(affected)}, nil, nil
+
+	case `INSERT INTO follow_outbox (op, me, friend, created_at) VALUES (?, ?, ?, NOW())`:
+		row := &fakeOutboxRow{CreatedAt: now}
+		f.outboxID++
+		row.ID = f.outboxID
+		row.Op, row.Me, row.Friend = asString(args[0]), asString(args[1]), asString(args[2])
+		f.outbox = append(f.outbox, row)
+		return fakeResult{row.ID, 1}, nil, nil
+
+	case `SELECT id, op, me, friend, attempts FROM follow_outbox WHERE done_at IS NULL AND attempts < ? ORDER BY id LIMIT 100`,
+		`SELECT id, op, me, friend, attempts FROM follow_outbox WHERE done_at IS NULL AND attempts < ? AND me = ? AND friend = ? ORDER BY id LIMIT 100`:
+		rows := &fakeRows{columns: []string{"id", "op", "me", "friend", "attempts"}}
+		for _, row := range f.outbox {
+			if row.DoneAt != nil || int64(row.Attempts) >= asInt(args[0]) {
+				continue
+			}
+			if len(args) == 3 && (row.Me != asString(args[1]) || row.Friend != asString(args[2])) {
+				continue
+			}
+			if len(rows.values) == 100 {
+				break
+			}
+			rows.values = append(rows.values, []driver.Value{row.ID, row.Op, row.Me, row.Friend, int64(row.Attempts)})
+		}
+		return nil, rows, nil
+
+	case `SELECT id, me, friend FROM follow_outbox WHERE done_at IS NULL`:
+		rows := &fakeRows{columns: []string{"id", "me", "friend"}}
+		for _, row := range f.outbox {
+			if row.DoneAt == nil {
+				rows.values = append(rows.values, []driver.Value{row.ID, row.Me, row.Friend})
+			}
+		}
+		return nil, rows, nil
+
+	case `UPDATE follow_outbox SET attempts = attempts + 1, last_error = NULL, done_at = NOW() WHERE id = ?`:
+		return f.updateOutbox(asInt(args[0]), func(row *fakeOutboxRow) {
+			row.Attempts++
+			row.LastError = nil
+			row.DoneAt = &now
+		}), nil, nil
+
+	case `UPDATE follow_outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?`:
+		msg := asString(args[0])
+		return f.updateOutbox(asInt(args[1]), func(row *fakeOutboxRow) {
+			row.Attempts++
+			row.LastError = &msg
+		}), nil, nil
+
+	case `UPDATE follow_outbox SET attempts = attempts + 1, last_error = ?, done_at = NOW() WHERE id = ?`:
+		msg := asString(args[0])
+		return f.updateOutbox(asInt(args[1]), func(row *fakeOutboxRow) {
+			row.Attempts++
+			row.LastError = &msg
+			row.DoneAt = &now
+		}), nil, nil
+
+	case `DELETE FROM follow_outbox WHERE done_at < NOW() - INTERVAL ? SECOND`:
+		limit := now.Add(-time.Duration(asInt(args[0])) * time.Second)
+		kept := f.outbox[:0]
+		for _, row := range f.outbox {
+			if row.DoneAt == nil || !row.DoneAt.Before(limit) {
+				kept = append(kept, row)
+			}
+		}
+		affected := len(f.outbox) - len(kept)
+		f.outbox = kept
+		return fakeResult{0, int64(affected)}, nil, nil
+
+	case `UPDATE follow_outbox SET me = ?, friend = ? WHERE id = ?`:
+		me, friend := asString(args[0]), asString(args[1])
+		return f.updateOutbox(asInt(args[2]), func(row *fakeOutboxRow) {
+			row.Me, row.Friend = me, friend
+		}), nil, nil
+	}
+
+	if strings.HasPrefix(query, `CREATE TABLE IF NOT EXISTS follow_outbox `) {
+		return fakeResult{}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("fakesql: unsupported query %q", query)
+}
+
+// selectTweets returns the tweets matching where, newest first.
+func (f *fakeSQL) selectTweets(where func(Tweet) bool) *fakeRows {
+	tweets := []Tweet{}
+	for _, t := range f.tweets {
+		if where(t) {
+			tweets = append(tweets, t)
+		}
+	}
+	sort.SliceStable(tweets, func(i, j int) bool {
+		if !tweets[i].CreatedAt.Equal(tweets[j].CreatedAt) {
+			return tweets[i].CreatedAt.After(tweets[j].CreatedAt)
+		}
+		return tweets[i].ID > tweets[j].ID
+	})
+
+	rows := &fakeRows{columns: []string{"id", "user_id", "text", "created_at"}}
+	for _, t := range tweets {
+		rows.values = append(rows.values, []driver.Value{int64(t.ID), int64(t.UserID), t.Text, t.CreatedAt})
+	}
+	return rows
+}
+
+func (f *fakeSQL) updateOutbox(id int64, update func(*fakeOutboxRow)) driver.Result {
+	for _, row := range f.outbox {
+		if row.ID == id {
+			update(row)
+			return fakeResult{0, 1}
+		}
+	}
+	return fakeResult{0, 0}
+}
+
+func asInt(v driver.Value) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case string:
+		var i int64
+		fmt.Sscan(v, &i)
+		return i
+	}
+	return 0
+}
+
+func asString(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// asTime converts a DATETIME argument the way MariaDB compares a string with
+// a DATETIME column.
+func asTime(v driver.Value) (time.Time, error) {
+	if t, ok := v.(time.Time); ok {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", asString(v), time.Local)
+}
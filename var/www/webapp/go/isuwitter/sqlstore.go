@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"runtime/trace"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+// sqlTweetStore keeps tweets in MariaDB, with the timeline of each user and
+// the rendered home pages cached in Redis as tweet-<name> and home-<name>.
+type sqlTweetStore struct{}
+
+func (sqlTweetStore) Post(ctx context.Context, userID int, name, text string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO tweets (user_id, text, created_at) VALUES (?, ?, NOW())`, userID, text)
+	redisTweetStore(ctx, name, text)
+	return err
+}
+
+func (sqlTweetStore) Scan(ctx context.Context, until string, limit int, keep func(*Tweet) (bool, error)) ([]*Tweet, error) {
+	var rows *sql.Rows
+	var err error
+	if until == "" {
+		rows, err = db.QueryContext(ctx, `SELECT * FROM tweets ORDER BY created_at DESC`)
+	} else {
+		rows, err = db.QueryContext(ctx, `SELECT * FROM tweets WHERE created_at < ? ORDER BY created_at DESC`, until)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tweets := make([]*Tweet, 0)
+	for rows.Next() {
+		t := Tweet{}
+		err := rows.Scan(&t.ID, &t.UserID, &t.HTML, &t.CreatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		t.Time = t.CreatedAt.Format("2006-01-02 15:04:05")
+
+		ok, err := keep(&t)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tweets = append(tweets, &t)
+		}
+		if len(tweets) == limit {
+			break
+		}
+	}
+	return tweets, rows.Err()
+}
+
+// UserTimeline serves the first page from tweet-<name> and older pages from
+// MariaDB.
+func (sqlTweetStore) UserTimeline(ctx context.Context, userID int, name, until string) ([]*Tweet, error) {
+	tweets := make([]*Tweet, 0)
+
+	if until == "" {
+		lRange, err := redisFor(ctx).LRange("tweet-"+name, 0, int64(cfg.PerPage)-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, tweet := range lRange {
+			splited := strings.SplitN(tweet, "\t", 2)
+			t := Tweet{}
+			t.Time = splited[0]
+			t.HTML = splited[1]
+			t.UserName = name
+			tweets = append(tweets, &t)
+		}
+		return tweets, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT * FROM tweets WHERE user_id = ? AND created_at < ? ORDER BY created_at DESC`, userID, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Tweet{}
+		err := rows.Scan(&t.ID, &t.UserID, &t.HTML, &t.CreatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		t.Time = t.CreatedAt.Format("2006-01-02 15:04:05")
+		t.UserName = name
+		tweets = append(tweets, &t)
+		if len(tweets) == cfg.PerPage {
+			break
+		}
+	}
+	return tweets, rows.Err()
+}
+
+func (sqlTweetStore) HomeCache(ctx context.Context, name string) (string, error) {
+	home, err := redisFor(ctx).Get("home-" + name).Result()
+	if err == redis.Nil {
+		return "", errCacheMiss
+	}
+	return home, err
+}
+
+func (sqlTweetStore) SetHomeCache(ctx context.Context, name string, home string) error {
+	return redisFor(ctx).Set("home-"+name, home, 0).Err()
+}
+
+func (sqlTweetStore) ClearHomeCache(ctx context.Context, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = "home-" + name
+	}
+	return redisFor(ctx).Del(keys...).Err()
+}
+
+// hashPassword returns the hex SHA-1 stored in users.password.
+func hashPassword(salt, password string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
+}
+
+// sqlUserStore authenticates against the users table and answers lookups
+// from the in-memory directory loaded by initializeHandler.
+type sqlUserStore struct{}
+
+func (sqlUserStore) Authenticate(name, password string) (*User, error) {
+	user, err := findUser(`SELECT * FROM users WHERE name = ?`, name)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if user.Password != hashPassword(user.Salt, password) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func (sqlUserStore) Name(id int) string {
+	return getUserName(id)
+}
+
+func (sqlUserStore) DisplayName(name string) string {
+	return getDisplayName(name)
+}
+
+func (sqlUserStore) ID(name string) int {
+	return getuserID(name)
+}
+
+func (sqlUserStore) Names() []string {
+	directoryMu.RLock()
+	defer directoryMu.RUnlock()
+
+	names := make([]string, 0, len(userNameuserID))
+	for name := range userNameuserID {
+		names = append(names, name)
+	}
+	return names
+}
+
+// redisFollowStore keeps the social graph in Redis. Follows go through the
+// outbox to isutomo, which owns them, and are cached in friends-<name> and
+// its reverse index followers-<name>. mutes-<name> holds the users whose
+// tweets name does not want to see, and blocks-<name> the users name has
+// blocked. The "protected" set holds the users whose tweets are only visible
+// to the followers they approved, and follow-requests-<name> the pending
+// requests to follow name. recommend-<name> is a sorted set of suggestions
+// written by the recommendation job.
+type redisFollowStore struct {
+	users UserStore
+}
+
+func (redisFollowStore) Friends(pctx context.Context, name string) ([]string, error) {
+	_, friends, err := loadFriends(pctx, name)
+	return friends, err
+}
+
+func (redisFollowStore) Followers(pctx context.Context, name string) ([]string, error) {
+	_, task := trace.NewTask(pctx, "loadFollowers")
+	defer task.End()
+
+	followers, err := redisFor(pctx).SMembers("followers-" + name).Result()
+	if err != nil {
+		logger.Error("redis.SMembers", zap.Error(err))
+		return nil, err
+	}
+	return followers, nil
+}
+
+func (redisFollowStore) CountFollows(ctx context.Context, name string) (int64, int64, error) {
+	var following, followers *redis.IntCmd
+	_, err := redisFor(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		following = pipe.SCard("friends-" + name)
+		followers = pipe.SCard("followers-" + name)
+		return nil
+	})
+	if err != nil {
+		logger.Error("redis.SCard", zap.Error(err), zap.String("name", name))
+		return 0, 0, err
+	}
+	return following.Val(), followers.Val(), nil
+}
+
+func (redisFollowStore) IsFollowing(ctx context.Context, me, user string) (bool, error) {
+	return redisFor(ctx).SIsMember("friends-"+me, user).Result()
+}
+
+func (redisFollowStore) Follow(ctx context.Context, me, user string) error {
+	return follow(ctx, me, user)
+}
+
+func (redisFollowStore) Unfollow(ctx context.Context, me, user string) error {
+	return unfollow(ctx, me, user)
+}
+
+func (redisFollowStore) Mutes(ctx context.Context, name string) ([]string, error) {
+	mutes, err := redisFor(ctx).SMembers("mutes-" + name).Result()
+	if err != nil {
+		logger.Error("redis.SMembers", zap.Error(err), zap.String("key", "mutes-"+name))
+	}
+	return mutes, err
+}
+
+func (redisFollowStore) Blocks(ctx context.Context, name string) ([]string, error) {
+	blocks, err := redisFor(ctx).SMembers("blocks-" + name).Result()
+	if err != nil {
+		logger.Error("redis.SMembers", zap.Error(err), zap.String("key", "blocks-"+name))
+	}
+	return blocks, err
+}
+
+func (redisFollowStore) Hidden(ctx context.Context, name string) (map[string]bool, error) {
+	users, err := redisFor(ctx).SUnion("mutes-"+name, "blocks-"+name).Result()
+	if err != nil {
+		logger.Error("redis.SUnion", zap.Error(err), zap.String("name", name))
+		return nil, err
+	}
+	hidden := map[string]bool{}
+	for _, u := range users {
+		hidden[u] = true
+	}
+	return hidden, nil
+}
+
+func (redisFollowStore) IsMuting(ctx context.Context, me, user string) (bool, error) {
+	return redisFor(ctx).SIsMember("mutes-"+me, user).Result()
+}
+
+func (redisFollowStore) IsBlocking(ctx context.Context, owner, user string) (bool, error) {
+	return redisFor(ctx).SIsMember("blocks-"+owner, user).Result()
+}
+
+func (redisFollowStore) Mute(ctx context.Context, me, user string) error {
+	return redisFor(ctx).SAdd("mutes-"+me, user).Err()
+}
+
+func (redisFollowStore) Unmute(ctx context.Context, me, user string) error {
+	return redisFor(ctx).SRem("mutes-"+me, user).Err()
+}
+
+func (redisFollowStore) Block(ctx context.Context, me, user string) error {
+	_, err := redisFor(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd("blocks-"+me, user)
+		pipe.SRem("follow-requests-"+me, user)
+		return nil
+	})
+	return err
+}
+
+func (redisFollowStore) Unblock(ctx context.Context, me, user string) error {
+	return redisFor(ctx).SRem("blocks-"+me, user).Err()
+}
+
+func (redisFollowStore) IsProtected(ctx context.Context, name string) (bool, error) {
+	protected, err := redisFor(ctx).SIsMember("protected", name).Result()
+	if err != nil {
+		logger.Error("redis.SIsMember", zap.Error(err), zap.String("name", name))
+	}
+	return protected, err
+}
+
+func (redisFollowStore) SetProtected(ctx context.Context, name string, protected bool) error {
+	if protected {
+		return redisFor(ctx).SAdd("protected", name).Err()
+	}
+	_, err := redisFor(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem("protected", name)
+		pipe.Del("follow-requests-" + name)
+		return nil
+	})
+	return err
+}
+
+func (redisFollowStore) Protected(ctx context.Context) ([]string, error) {
+	return redisFor(ctx).SMembers("protected").Result()
+}
+
+func (redisFollowStore) FollowRequests(ctx context.Context, owner string) ([]string, error) {
+	return redisFor(ctx).SMembers("follow-requests-" + owner).Result()
+}
+
+func (redisFollowStore) HasRequestedFollow(ctx context.Context, me, owner string) (bool, error) {
+	return redisFor(ctx).SIsMember("follow-requests-"+owner, me).Result()
+}
+
+func (redisFollowStore) RequestFollow(ctx context.Context, me, owner string) error {
+	err := redisFor(ctx).SAdd("follow-requests-"+owner, me).Err()
+	if err != nil {
+		logger.Error("redis.SAdd", zap.Error(err), zap.String("owner", owner))
+	}
+	return err
+}
+
+func (redisFollowStore) RemoveFollowRequest(ctx context.Context, owner, me string) (bool, error) {
+	removed, err := redisFor(ctx).SRem("follow-requests-"+owner, me).Result()
+	return removed > 0, err
+}
+
+func (redisFollowStore) Recommendations(ctx context.Context, name string) ([]Recommendation, error) {
+	c := redisFor(ctx)
+	zs, err := c.ZRevRangeWithScores("recommend-"+name, 0, recommendCount-1).Result()
+	if err != nil {
+		logger.Error("redis.ZRevRangeWithScores", zap.Error(err), zap.String("name", name))
+		return nil, err
+	}
+	excluded, err := c.SUnion("friends-"+name, "mutes-"+name, "blocks-"+name).Result()
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, u := range excluded {
+		skip[u] = true
+	}
+
+	result := make([]Recommendation, 0, len(zs))
+	for _, z := range zs {
+		c, _ := z.Member.(string)
+		if c == "" || skip[c] {
+			continue
+		}
+		result = append(result, Recommendation{Name: c, Score: z.Score})
+	}
+	return result, nil
+}
+
+func (s redisFollowStore) RefreshRecommendations(name string) error {
+	recommendations, err := s.computeRecommendations(name)
+	if err != nil {
+		return err
+	}
+	zs, err := redisClient.ZRangeWithScores("recommend-"+name, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	stored := make([]Recommendation, len(zs))
+	for i, z := range zs {
+		c, _ := z.Member.(string)
+		stored[i] = Recommendation{Name: c, Score: z.Score}
+	}
+	if sameRecommendations(stored, recommendations) {
+		// keep the cached home, which shows the same ones
+		return nil
+	}
+
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del("recommend-" + name)
+		for _, rec := range recommendations {
+			pipe.ZAdd("recommend-"+name, redis.Z{Score: rec.Score, Member: rec.Name})
+		}
+		pipe.Del("home-" + name)
+		return nil
+	})
+	return err
+}
+
+// computeRecommendations scores the friends of name's friends by how many of
+// name's friends follow them, plus a bonus for recent activity. Users name
+// already follows, mutes or blocks and name itself are excluded.
+func (s redisFollowStore) computeRecommendations(name string) ([]Recommendation, error) {
+	friends, err := redisClient.SMembers("friends-" + name).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(friends) == 0 {
+		return []Recommendation{}, nil
+	}
+
+	keys := make([]string, len(friends))
+	for i, f := range friends {
+		keys[i] = "friends-" + f
+	}
+	candidates, err := redisClient.SUnion(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	excluded, err := redisClient.SUnion("friends-"+name, "mutes-"+name, "blocks-"+name).Result()
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{name: true}
+	for _, u := range excluded {
+		skip[u] = true
+	}
+
+	scores := map[string]float64{}
+	for _, c := range candidates {
+		if !skip[c] && s.users.ID(c) != 0 {
+			scores[c] = 0
+		}
+	}
+	if len(scores) == 0 {
+		return []Recommendation{}, nil
+	}
+
+	var overlaps []*redis.StringSliceCmd
+	latest := map[string]*redis.StringCmd{}
+	_, err = redisClient.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			overlaps = append(overlaps, pipe.SMembers(k))
+		}
+		for c := range scores {
+			latest[c] = pipe.LIndex("tweet-"+c, 0)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for _, cmd := range overlaps {
+		for _, c := range cmd.Val() {
+			if _, ok := scores[c]; ok {
+				scores[c]++
+			}
+		}
+	}
+	for c, cmd := range latest {
+		if isRecentTweet(cmd.Val()) {
+			scores[c] += recommendActiveBonus
+		}
+	}
+
+	return topRecommendations(scores), nil
+}
+
+// topRecommendations orders scores into at most recommendCount suggestions.
+func topRecommendations(scores map[string]float64) []Recommendation {
+	result := make([]Recommendation, 0, len(scores))
+	for c, score := range scores {
+		result = append(result, Recommendation{Name: c, Score: score})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > recommendCount {
+		result = result[:recommendCount]
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"runtime/trace"
+
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+)
+
+// errCacheMiss is returned by TweetStore.HomeCache when nothing is cached.
+var errCacheMiss = errors.New("cache miss")
+
+// TweetStore holds tweets and the rendered home pages.
+type TweetStore interface {
+	// Post stores a tweet of the user, whose text is already htmlified.
+	Post(ctx context.Context, userID int, name, text string) error
+	// Scan returns, newest first, up to limit tweets created before until
+	// ("" for no bound) for which keep returns true. Tweets are returned
+	// with UserName unset; keep may fill it in.
+	Scan(ctx context.Context, until string, limit int, keep func(*Tweet) (bool, error)) ([]*Tweet, error)
+	// UserTimeline returns the tweets of a user created before until, newest
+	// first, with UserName set to name.
+	UserTimeline(ctx context.Context, userID int, name, until string) ([]*Tweet, error)
+
+	HomeCache(ctx context.Context, name string) (string, error)
+	SetHomeCache(ctx context.Context, name, home string) error
+	ClearHomeCache(ctx context.Context, names ...string) error
+}
+
+// UserStore is the user directory.
+type UserStore interface {
+	// Authenticate returns the user if password is theirs, and nil if the
+	// user does not exist or the password does not match.
+	Authenticate(name, password string) (*User, error)
+	// Name returns the canonical name of a user, or "" if there is none.
+	Name(id int) string
+	// DisplayName returns the name the user with the canonical name name
+	// signed up with, or name if there is none.
+	DisplayName(name string) string
+	// ID returns the ID of a user, or 0 if there is none.
+	ID(name string) int
+	// Names returns the names of all users.
+	Names() []string
+}
+
+// FollowStore is the social graph: follows, mutes, blocks, protected
+// accounts with their follow requests, and follow recommendations.
+type FollowStore interface {
+	Friends(ctx context.Context, name string) ([]string, error)
+	Followers(ctx context.Context, name string) ([]string, error)
+	// CountFollows returns the number of users name follows and is
+	// followed by.
+	CountFollows(ctx context.Context, name string) (int64, int64, error)
+	IsFollowing(ctx context.Context, me, user string) (bool, error)
+	// Follow and Unfollow fail with the isutomo error codes
+	// client.CodeAlreadyFollowing and client.CodeNotFollowing, or with
+	// errFollowPending when the change is recorded but not applied yet.
+	Follow(ctx context.Context, me, user string) error
+	Unfollow(ctx context.Context, me, user string) error
+
+	Mutes(ctx context.Context, name string) ([]string, error)
+	Blocks(ctx context.Context, name string) ([]string, error)
+	// Hidden returns the users name muted or blocked.
+	Hidden(ctx context.Context, name string) (map[string]bool, error)
+	IsMuting(ctx context.Context, me, user string) (bool, error)
+	IsBlocking(ctx context.Context, owner, user string) (bool, error)
+	Mute(ctx context.Context, me, user string) error
+	Unmute(ctx context.Context, me, user string) error
+	// Block also drops the pending follow request of user to me.
+	Block(ctx context.Context, me, user string) error
+	Unblock(ctx context.Context, me, user string) error
+
+	IsProtected(ctx context.Context, name string) (bool, error)
+	// SetProtected also drops the pending follow requests when unprotecting.
+	SetProtected(ctx context.Context, name string, protected bool) error
+	Protected(ctx context.Context) ([]string, error)
+	FollowRequests(ctx context.Context, owner string) ([]string, error)
+	HasRequestedFollow(ctx context.Context, me, owner string) (bool, error)
+	RequestFollow(ctx context.Context, me, owner string) error
+	// RemoveFollowRequest reports whether me had requested to follow owner.
+	RemoveFollowRequest(ctx context.Context, owner, me string) (bool, error)
+
+	// Recommendations returns the stored suggestions for name, without the
+	// users name has followed, muted or blocked since they were computed.
+	Recommendations(ctx context.Context, name string) ([]Recommendation, error)
+	// RefreshRecommendations computes and stores the suggestions for name.
+	// When they differ from the stored ones, it also drops the cached home
+	// of name, which shows the previous ones.
+	RefreshRecommendations(name string) error
+}
+
+// app holds what the handlers depend on.
+type app struct {
+	tweets   TweetStore
+	users    UserStore
+	follows  FollowStore
+	render   *render.Render
+	sessions sessions.Store
+}
+
+// newApp returns the app backed by MariaDB, Redis and isutomo.
+func newApp(sessions sessions.Store) *app {
+	return &app{
+		tweets:   sqlTweetStore{},
+		users:    sqlUserStore{},
+		follows:  redisFollowStore{users: sqlUserStore{}},
+		render:   newRender(sqlUserStore{}),
+		sessions: sessions,
+	}
+}
+
+// newRender loads the views. They show user names as users typed them, by
+// looking up display in users.
+func newRender(users UserStore) *render.Render {
+	return render.New(render.Options{
+		Directory: "views",
+		Funcs: []template.FuncMap{
+			{
+				"raw": func(text string) template.HTML {
+					return template.HTML(text)
+				},
+				"add":     func(a, b int) int { return a + b },
+				"display": users.DisplayName,
+			},
+		},
+	})
+}
+
+func (a *app) getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
+	session, _ := a.sessions.Get(r, sessionName)
+
+	return session
+}
+
+func (a *app) getuserID(name string) int {
+	_, i := a.getuserIDCtx(context.TODO(), name)
+	return i
+}
+
+func (a *app) getuserIDCtx(pctx context.Context, name string) (context.Context, int) {
+	ctx, task := trace.NewTask(pctx, "getuserID")
+	defer task.End()
+
+	return ctx, a.users.ID(name)
+}
+
+func (a *app) getUserName(id int) string {
+	_, s := a.getUserNameCtx(context.TODO(), id)
+	return s
+}
+
+// sessionUserName returns the name of the logged-in user id, and tells it to
+// logRequests.
+func (a *app) sessionUserName(r *http.Request, id int) string {
+	name := a.getUserName(id)
+	requestLogOf(r).user = name
+	return name
+}
+
+func (a *app) getUserNameCtx(pctx context.Context, id int) (context.Context, string) {
+	ctx, task := trace.NewTask(pctx, "getUserName")
+	defer task.End()
+
+	return ctx, a.users.Name(id)
+}
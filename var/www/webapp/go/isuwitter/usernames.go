@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/bgpat/yisucon-20190629/var/www/webapp/go/isutomo/username"
+	"github.com/go-redis/redis"
+)
+
+// Redis sets keyed by user name whose members are user names as well.
+var userSetPrefixes = []string{"friends-", "followers-", "mutes-", "blocks-", "follow-requests-"}
+
+// migrateUsernames rewrites the Redis keys and members and the pending
+// outbox entries holding user names to their canonical form. It should run
+// after isutomo's -migrate-usernames, with isuwitter stopped. Sets and tweet
+// lists of names that only differ in case are merged; home and
+// recommendation caches are dropped since they are rebuilt on demand.
+func migrateUsernames(out io.Writer) (int, error) {
+	changed := 0
+
+	for _, prefix := range userSetPrefixes {
+		keys, err := scanKeys(prefix + "*")
+		if err != nil {
+			return changed, err
+		}
+		for _, key := range keys {
+			ok, err := canonicalizeSet(key, prefix+username.Canonical(strings.TrimPrefix(key, prefix)))
+			if err != nil {
+				return changed, err
+			}
+			if ok {
+				changed++
+				fmt.Fprintf(out, "set\t%s\n", key)
+			}
+		}
+	}
+
+	if ok, err := canonicalizeSet("protected", "protected"); err != nil {
+		return changed, err
+	} else if ok {
+		changed++
+		fmt.Fprintf(out, "set\tprotected\n")
+	}
+
+	keys, err := scanKeys("tweet-*")
+	if err != nil {
+		return changed, err
+	}
+	for _, key := range keys {
+		target := "tweet-" + username.Canonical(strings.TrimPrefix(key, "tweet-"))
+		if key == target {
+			continue
+		}
+		if err := mergeTweetLists(key, target); err != nil {
+			return changed, err
+		}
+		changed++
+		fmt.Fprintf(out, "list\t%s\n", key)
+	}
+
+	for _, pattern := range []string{"home-*", "recommend-*"} {
+		keys, err := scanKeys(pattern)
+		if err != nil {
+			return changed, err
+		}
+		if len(keys) > 0 {
+			if err := redisClient.Del(keys...).Err(); err != nil {
+				return changed, err
+			}
+		}
+	}
+
+	n, err := canonicalizeOutbox()
+	if err != nil {
+		return changed, err
+	}
+	if n > 0 {
+		fmt.Fprintf(out, "outbox\t%d\n", n)
+	}
+
+	return changed + n, nil
+}
+
+func scanKeys(pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		ks, next, err := redisClient.Scan(cursor, pattern, 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// canonicalizeSet moves the canonical forms of the members of key into
+// target, and reports whether anything had to change.
+func canonicalizeSet(key, target string) (bool, error) {
+	members, err := redisClient.SMembers(key).Result()
+	if err != nil {
+		return false, err
+	}
+	var stale, canonical []interface{}
+	for _, m := range members {
+		c := username.Canonical(m)
+		if c != m {
+			stale = append(stale, m)
+		}
+		canonical = append(canonical, c)
+	}
+	if key == target && len(stale) == 0 {
+		return false, nil
+	}
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		if len(canonical) > 0 {
+			pipe.SAdd(target, canonical...)
+		}
+		if key != target {
+			pipe.Del(key)
+		} else {
+			pipe.SRem(key, stale...)
+		}
+		return nil
+	})
+	return err == nil, err
+}
+
+// mergeTweetLists merges the tweets of key into target, keeping them newest
+// first like redisTweetStore does.
+func mergeTweetLists(key, target string) error {
+	var src, dst *redis.StringSliceCmd
+	_, err := redisClient.Pipelined(func(pipe redis.Pipeliner) error {
+		src = pipe.LRange(key, 0, -1)
+		dst = pipe.LRange(target, 0, -1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tweets := append(src.Val(), dst.Val()...)
+	// entries start with their "2006-01-02 15:04:05" timestamp
+	sort.SliceStable(tweets, func(i, j int) bool {
+		return tweets[i] > tweets[j]
+	})
+	values := make([]interface{}, len(tweets))
+	for i, t := range tweets {
+		values[i] = t
+	}
+	_, err = redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key, target)
+		if len(values) > 0 {
+			pipe.RPush(target, values...)
+		}
+		return nil
+	})
+	return err
+}
+
+func canonicalizeOutbox() (int, error) {
+	rows, err := db.Query(`SELECT id, me, friend FROM follow_outbox WHERE done_at IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+	type entry struct {
+		id         int64
+		me, friend string
+	}
+	var stale []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.me, &e.friend); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !username.IsCanonical(e.me) || !username.IsCanonical(e.friend) {
+			stale = append(stale, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range stale {
+		_, err := db.Exec(`UPDATE follow_outbox SET me = ?, friend = ? WHERE id = ?`,
+			username.Canonical(e.me), username.Canonical(e.friend), e.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}